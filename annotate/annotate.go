@@ -5,20 +5,29 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 
 	arg "github.com/alexflint/go-arg"
 	"github.com/biogo/store/interval"
 	"github.com/brentp/go-athenaeum/unsplit"
+	"github.com/brentp/smoove/shared"
 	"github.com/brentp/vcfgo"
 	"github.com/brentp/xopen"
+	"github.com/pkg/errors"
 )
 
 type cliargs struct {
-	GFF string `arg:"-g,help:path to GFF for gene annotation"`
-	VCF string `arg:"positional,required,help:path to VCF(s) to annotate."`
+	GFF            string `arg:"-g,help:path to GFF for gene annotation"`
+	Ped            string `arg:"help:optional path to PED file used to annotate mendelian errors and candidate de novos."`
+	MinParentDepth int    `arg:"help:minimum depth (DP) in each hom-ref parent required to report a de novo (only used with --ped)."`
+	SHQModel       string `arg:"help:optional path to JSON SHQ model (e.g. from smoove train-shq). default is built-in rules."`
+	Processes      int    `arg:"-p,help:number of processes to use for annotation."`
+	Upstream       int    `arg:"help:size of region upstream of each gene (according to strand) to annotate as upstream."`
+	Downstream     int    `arg:"help:size of region downstream of each gene (according to strand) to annotate as downstream."`
+	FeatureTypes   string `arg:"--feature-types,help:comma-delimited GFF feature types to annotate in addition to gene (e.g. CDS or lnc_RNA or enhancer). types ending in 'gene' (e.g. ncRNA_gene) are annotated as genes."`
+	OutVCF         string `arg:"-o,help:path to output VCF. if it ends with .gz it is written with BGZF and indexed. default is stdout."`
+	VCF            string `arg:"positional,required,help:path to VCF(s) to annotate."`
 }
 
 func (c cliargs) Description() string {
@@ -28,24 +37,29 @@ ftp://ftp.ensembl.org/pub/current_gff3/homo_sapiens/
 ftp://ftp.ensembl.org/pub/grch37/release-84/gff3/homo_sapiens/ `
 }
 
-func id2name(toks [][]byte) (id, name string) {
+// gffAttrs returns the ID, Name and first Parent from the attributes column
+// with any type prefix (e.g. gene: or transcript:) removed.
+func gffAttrs(toks [][]byte) (id, name, parent string) {
 	info := unsplit.New(toks[8], []byte{';'})
-	for id == "" || name == "" {
+	for {
 		p := info.Next()
 		if p == nil {
 			break
 		}
 		if bytes.HasPrefix(p, []byte("ID=")) {
-			tmp := bytes.SplitN(p, []byte{':'}, 2)
-			id = string(tmp[len(tmp)-1])
-			continue
-		}
-		if bytes.HasPrefix(p, []byte("Name=")) {
+			id = afterColon(p[3:])
+		} else if bytes.HasPrefix(p, []byte("Name=")) {
 			name = string(p[5:])
+		} else if bytes.HasPrefix(p, []byte("Parent=")) {
+			parent = afterColon(bytes.SplitN(p[7:], []byte{','}, 2)[0])
 		}
-
 	}
-	return id, name
+	return id, name, parent
+}
+
+func afterColon(b []byte) string {
+	tmp := bytes.SplitN(b, []byte{':'}, 2)
+	return string(tmp[len(tmp)-1])
 }
 
 // Integer-specific intervals
@@ -61,7 +75,7 @@ func (i irange) Overlap(b interval.IntRange) bool {
 	return i.End > b.Start && i.Start < b.End
 }
 func (i irange) ID() uintptr              { return i.UID }
-func (i irange) Range() interval.IntRange { return interval.IntRange{i.Start, i.End} }
+func (i irange) Range() interval.IntRange { return interval.IntRange{Start: i.Start, End: i.End} }
 
 // Overlaps checks for overlaps and fills result.
 func Overlaps(trees map[string]*interval.IntTree, chrom string, start, end int, result *[]irange) {
@@ -87,83 +101,62 @@ func Overlaps(trees map[string]*interval.IntTree, chrom string, start, end int,
 
 }
 
-func chromStartEnd(toks [][]byte) (string, int, int) {
+func chromStartEnd(toks [][]byte) (string, int, int, error) {
 	s, err := strconv.Atoi(string(toks[3]))
 	if err != nil {
-		panic(err)
+		return "", 0, 0, fmt.Errorf("bad start in gff line for %s: %w", toks[0], err)
 	}
 	e, err := strconv.Atoi(string(toks[4]))
 	if err != nil {
-		panic(err)
+		return "", 0, 0, fmt.Errorf("bad end in gff line for %s: %w", toks[0], err)
 	}
-	return string(toks[0]), s, e
+	return string(toks[0]), s, e, nil
 }
 
-func getParent(info []byte) string {
-	var s, e int
-	if bytes.HasPrefix(info, []byte("Parent=")) {
-		s = 7
-		e = bytes.IndexRune(info, ';')
-		if e == -1 {
-			e = len(info)
-		}
-	} else {
-		s = bytes.Index(info, []byte("Parent="))
-		if s == -1 {
-			panic(fmt.Sprintf("no parent in %s", info))
-		}
-		s += 7
-		e = bytes.IndexRune(info[s:], ';')
-		if e == -1 {
-			e = len(info)
-		} else {
-			e += s
-		}
-	}
-	if e > len(info) || s > len(info) || s < 0 || e < 0 {
-		log.Println(s, e, string(info))
-		log.Fatal("bad")
-	}
-	name := string(info[s:e])
-	tmp := strings.SplitN(name, ":", 2)
-	return tmp[len(tmp)-1]
+// gffOptions controls which features are read from the GFF.
+type gffOptions struct {
+	// Upstream and Downstream are the sizes of the flanks added to each gene (relative to its strand).
+	Upstream   int
+	Downstream int
+	// FeatureTypes are indexed in addition to genes. Types ending in "gene" (e.g. ncRNA_gene) are treated as genes.
+	FeatureTypes []string
 }
 
-func anyEqual(q []byte, db []string) bool {
-	for _, d := range db {
-		if string(q) == d {
-			return true
-		}
-	}
-	return false
+func (o *gffOptions) isGene(ftype []byte) bool {
+	return string(ftype) == "gene" || (bytes.HasSuffix(ftype, []byte("gene")) && contains(o.FeatureTypes, string(ftype)))
+}
+
+// namesGene is true for records that are indexed by name whatever the --feature-types: any *gene type
+// (e.g. Ensembl gives lnc_RNA an ncRNA_gene parent) and any named record without a parent.
+func namesGene(ftype []byte, name, parent string) bool {
+	return bytes.HasSuffix(ftype, []byte("gene")) || (parent == "" && name != "")
 }
 
-func passOne(path string, ftypes []string) map[string]string {
-	geneIdToNameMap := make(map[string]string, 64)
+// gffNames maps the ID of each gene to its name and the ID of every other feature to its parent.
+func gffNames(path string, opts *gffOptions) (genes, parents map[string]string, err error) {
+	genes = make(map[string]string, 64)
+	parents = make(map[string]string, 64)
 	f, err := xopen.Ropen(path)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
+	defer f.Close()
 
 	for {
-		var id, name string
 		line, err := f.ReadBytes('\n')
-		if len(line) != 0 {
-			if line[0] == '#' {
-				continue
-			}
-			toks := bytes.SplitN(line, []byte{'\t'}, 11)
-			if !anyEqual(toks[2], ftypes) {
-				continue
-			}
-
-			id, name = id2name(toks)
-			for _, ftype := range ftypes {
-				if !strings.HasSuffix(ftype, "gene") {
-					name = getParent(toks[8])
-				}
-				if id != "" && name != "" {
-					geneIdToNameMap[id] = name
+		if len(line) != 0 && line[0] != '#' {
+			toks := bytes.SplitN(bytes.TrimSpace(line), []byte{'\t'}, 11)
+			if len(toks) >= 9 {
+				id, name, parent := gffAttrs(toks)
+				if id != "" {
+					if opts.isGene(toks[2]) || namesGene(toks[2], name, parent) {
+						if name == "" {
+							name = id
+						}
+						genes[id] = name
+					} else if parent != "" {
+						parents[id] = parent
+					}
 				}
 			}
 		}
@@ -171,117 +164,125 @@ func passOne(path string, ftypes []string) map[string]string {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return nil, nil, err
 		}
 	}
-	return geneIdToNameMap
+	return genes, parents, nil
 }
 
-const upStreamDist = 5000
-const downStreamDist = 5000
-
-func readGff(path string) map[string]*interval.IntTree {
-	t := make(map[string]*interval.IntTree, 20)
-	geneToNameMap := passOne(path, []string{"gene"})
-	transcriptToGeneMap := passOne(path, []string{"transcript", "mRNA"})
-	if len(geneToNameMap) == 0 {
-		log.Fatal("no records found with 'gene' type in gff")
+// geneName follows Parent links (e.g. exon -> transcript -> gene) up to a gene.
+func geneName(parent string, genes, parents map[string]string) string {
+	for i := 0; i < 4 && parent != ""; i++ {
+		if name, ok := genes[parent]; ok {
+			return name
+		}
+		parent = parents[parent]
 	}
-	if len(transcriptToGeneMap) == 0 {
-		log.Fatal("no records found with 'transcript' or 'mRNA' type in gff")
+	return ""
+}
+
+// flanks returns the upstream and downstream regions of a gene according to its strand.
+func flanks(start, end int, strand byte, upstream, downstream int) (us, ue, ds, de int) {
+	if strand == '-' {
+		us, ue = end, end+upstream
+		ds, de = max(0, start-downstream), start
+	} else {
+		us, ue = max(0, start-upstream), start
+		ds, de = end, end+downstream
 	}
+	return us, ue, ds, de
+}
 
-	f, err := xopen.Ropen(path)
+// readGff returns an interval tree per chromosome of the genes (with flanks) and requested features in the GFF.
+// Errors are input errors as they are caused by a missing or malformed GFF.
+func readGff(path string, opts *gffOptions) (map[string]*interval.IntTree, error) {
+	t := make(map[string]*interval.IntTree, 20)
+	genes, parents, err := gffNames(path, opts)
 	if err != nil {
-		panic(err)
+		return nil, shared.InputError(errors.Wrapf(err, "error reading gff %s", path))
+	}
+	if len(genes) == 0 {
+		return nil, shared.Inputf("no records found with 'gene' type in gff %s", path)
 	}
+
 	var k int
-	for {
-		var id, name string
-		line, err := f.ReadBytes('\n')
-		if len(line) != 0 {
-			if line[0] == '#' {
-				continue
-			}
-			line = bytes.TrimSpace(line)
-			toks := bytes.SplitN(line, []byte{'\t'}, 11)
-			if bytes.Equal(toks[2], []byte("gene")) {
-				chrom, start, end := chromStartEnd(toks)
-				id, name = id2name(toks)
-				if _, ok := t[chrom]; !ok {
-					t[chrom] = &interval.IntTree{}
-				}
-				if err := t[chrom].Insert(irange{Start: start, End: end, UID: uintptr(k), Ftype: "gene", Name: name}, false); err != nil {
-					panic(err)
-				}
-				k++
-				var dstart, dend int
-				if toks[6][0] == '-' {
-					start, end = end, end+upStreamDist
-					dstart, dend = start-downStreamDist, start
-					if dstart < 0 {
-						dstart = 0
-					}
+	insert := func(chrom string, start, end int, ftype, name string) error {
+		if end <= start {
+			return nil
+		}
+		if _, ok := t[chrom]; !ok {
+			t[chrom] = &interval.IntTree{}
+		}
+		if err := t[chrom].Insert(irange{Start: start, End: end, UID: uintptr(k), Ftype: ftype, Name: name}, false); err != nil {
+			return err
+		}
+		k++
+		return nil
+	}
 
-				} else if toks[6][0] == '+' {
-					if start > upStreamDist {
-						start, end = start-upStreamDist, start
-					} else {
-						start, end = 0, start
-					}
-					dstart, dend = end, end+upStreamDist
-				} else {
-					log.Println("invalid strand: ", toks[6])
-				}
-				if err := t[chrom].Insert(irange{Start: start, End: end, UID: uintptr(k), Ftype: "upstream", Name: name}, false); err != nil {
-					panic(err)
-				}
-				k++
-				if err := t[chrom].Insert(irange{Start: dstart, End: dend, UID: uintptr(k), Ftype: "downstream", Name: name}, false); err != nil {
-					panic(err)
-				}
-				k++
-				continue
+	add := func(toks [][]byte) error {
+		if opts.isGene(toks[2]) {
+			chrom, start, end, err := chromStartEnd(toks)
+			if err != nil {
+				return err
 			}
-			if bytes.Equal(toks[2], []byte("transcript")) {
-				continue
+			id, _, _ := gffAttrs(toks)
+			name := genes[id]
+			if err := insert(chrom, start, end, string(toks[2]), name); err != nil {
+				return err
 			}
-
-			if !(bytes.Equal(toks[2], []byte("exon")) || bytes.HasSuffix(toks[2], []byte("prime_UTR"))) {
-				continue
+			if toks[6][0] != '-' && toks[6][0] != '+' {
+				log.Println("invalid strand: ", string(toks[6]))
+				return nil
 			}
-			// exon looks up transcript, but gene name is only in gene so we map transcript to gene and then store the gene name
-			id = getParent(toks[8])
-			//log.Println("id:", id)
-			//log.Println("transcript map:", transcriptToGeneMap)
-			//log.Println("gene map:", geneToNameMap)
-			name = transcriptToGeneMap[id]
-			if t, ok := geneToNameMap[name]; ok {
-				name = t
+			us, ue, ds, de := flanks(start, end, toks[6][0], opts.Upstream, opts.Downstream)
+			if err := insert(chrom, us, ue, "upstream", name); err != nil {
+				return err
 			}
-			if name == "" {
-				continue // psuedo gene
+			return insert(chrom, ds, de, "downstream", name)
+		}
+		if !contains(opts.FeatureTypes, string(toks[2])) {
+			return nil
+		}
+		id, name, parent := gffAttrs(toks)
+		if parent != "" {
+			// e.g. exon looks up transcript, but gene name is only in gene so we follow parents to the gene.
+			if name = geneName(parent, genes, parents); name == "" {
+				return nil // psuedo gene or parent type not requested.
 			}
-			chrom, start, end := chromStartEnd(toks)
+		} else if name == "" {
+			// features without a parent (e.g. regulatory regions) use their own name or ID.
+			name = orDot(id)
+		}
+		chrom, start, end, err := chromStartEnd(toks)
+		if err != nil {
+			return err
+		}
+		return insert(chrom, start, end, string(toks[2]), name)
+	}
 
-			if _, ok := t[chrom]; !ok {
-				t[chrom] = &interval.IntTree{}
-			}
-			if err := t[chrom].Insert(irange{Start: start, End: end, UID: uintptr(k), Ftype: string(toks[2]), Name: name}, false); err != nil {
-				panic(err)
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	defer f.Close()
+	for {
+		line, err := f.ReadBytes('\n')
+		if len(line) != 0 && line[0] != '#' {
+			if toks := bytes.SplitN(bytes.TrimSpace(line), []byte{'\t'}, 11); len(toks) >= 9 {
+				if aerr := add(toks); aerr != nil {
+					return nil, shared.InputError(errors.Wrapf(aerr, "error reading gff %s", path))
+				}
 			}
-			k++
 		}
-
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return nil, shared.InputError(errors.Wrapf(err, "error reading gff %s", path))
 		}
 	}
-	//log.Fatal(geneToNameMap["ENST00000565691"])
-	return t
+	return t, nil
 }
 
 func ostring(o irange, start, end int) string {
@@ -329,141 +330,160 @@ func abs(a int) int {
 	return a
 }
 
-func getcisum(v *vcfgo.Variant) float64 {
-	cipos, err := v.Info_.Get("CIPOS")
-	if err != nil {
-		log.Fatal(err)
-	}
-	ciend, err := v.Info_.Get("CIEND")
-	_ = ciend
-	if err != nil {
-		log.Fatal(err)
-	}
-	cisum := abs(cipos.([]int)[0])
-	cisum += abs(cipos.([]int)[1])
-	cisum += abs(ciend.([]int)[0])
-	cisum += abs(ciend.([]int)[1])
-	return float64(cisum)
-}
-
-func smooveSampleQuality(fields map[string]string, cisum float64) int {
-	ab, err := getval(fields, "AB", 0.5)
-	if err != nil {
-		return 0
-	}
-	as, err := getval(fields, "AS", 0)
-	if err != nil {
-		return 0
-	}
-	// high quality
-	if ab > 0.167 {
-		if as > 1.5 && cisum < 40 {
-			return 4
+// getcisum returns the total width of the CIPOS and CIEND intervals of v.
+func getcisum(v *vcfgo.Variant) (float64, error) {
+	var cisum int
+	for _, key := range []string{"CIPOS", "CIEND"} {
+		ci, err := v.Info_.Get(key)
+		if err != nil {
+			return 0, shared.Inputf("error getting %s for variant at %s:%d: %s", key, v.Chromosome, v.Pos, err)
 		}
+		vals, ok := ci.([]int)
+		if !ok || len(vals) != 2 {
+			return 0, shared.Inputf("expected %s with 2 integers for variant at %s:%d. got %v", key, v.Chromosome, v.Pos, ci)
+		}
+		cisum += abs(vals[0]) + abs(vals[1])
 	}
-	asc, err := getval(fields, "ASC", 0)
-	if err != nil {
-		return 0
-	}
-	// low quality
-	if ab <= 0.167 && asc < 0.5 && as < 0.5 {
-		return 1
-	}
-	ap, _ := getval(fields, "AP", 0)
-	if ap > 7 && cisum < 200 {
-		return 3
-	}
-	return 4
+	return float64(cisum), nil
 }
 
-func setSmooveQuality(variant *vcfgo.Variant) float64 {
+func setSmooveQuality(variant *vcfgo.Variant, shq *SHQConfig) (float64, error) {
 	var n, sum float64
-	cisum := getcisum(variant)
+	cisum, err := getcisum(variant)
+	if err != nil {
+		return 0, err
+	}
 	variant.Format = append(variant.Format, "SHQ")
 	for _, s := range variant.Samples {
-		if len(s.GT) == 2 && s.GT[0] == 0 && s.GT[1] == 1 {
-			q := smooveSampleQuality(s.Fields, cisum)
-			s.Fields["SHQ"] = strconv.Itoa(q)
+		q := shq.Score(s.GT, s.Fields, cisum)
+		s.Fields["SHQ"] = strconv.Itoa(q)
+		if q != -1 {
 			n++
 			sum += float64(q)
-
-		} else {
-			s.Fields["SHQ"] = "-1"
 		}
 	}
 	if n == 0 {
-		return -1
+		return -1, nil
 	}
-	return sum / n
+	return sum / n, nil
 }
 
-func annotate(vcf *vcfgo.Reader, out *vcfgo.Writer, genes map[string]*interval.IntTree) {
-
-	overlapping := make([]irange, 0, 24)
+// annotator holds the data needed to annotate a variant. It is not modified
+// after creation so it can be shared among goroutines.
+type annotator struct {
+	genes map[string]*interval.IntTree
+	shq   *SHQConfig
+	ped   *pedAnnotator
+}
 
-	for {
-		variant := vcf.Read()
-		if variant == nil {
-			break
-		}
-		mq := setSmooveQuality(variant)
-		variant.Info().Set("MSHQ", mq)
-		Overlaps(genes, variant.Chromosome, int(variant.Start()), int(variant.End()), &overlapping)
-		if len(overlapping) == 0 {
-			out.WriteVariant(variant)
-			continue
-		}
-		m := make(map[string]counter)
-		for _, o := range overlapping {
-			var c counter
-			var ok bool
-			var key = o.Name + "|" + o.Ftype
-			if c, ok = m[key]; !ok {
-				c = counter{}
-			}
-			c.n += 1
-			c.bases += min(int(variant.End()), o.End) - max(int(variant.Start()), o.Start)
-			//log.Printf("%s: %+v", key, c)
-			m[key] = c
-		}
-		sg := ""
-		for name, counts := range m {
-			sg += fmt.Sprintf(",%s:%d:%d", name, counts.n, counts.bases)
+// annotate sets SHQ, MSHQ, smoove_gene and (optionally) pedigree fields on a variant.
+// overlapping is used as scratch space.
+func (a *annotator) annotate(variant *vcfgo.Variant, overlapping *[]irange) error {
+	mq, err := setSmooveQuality(variant, a.shq)
+	if err != nil {
+		return err
+	}
+	variant.Info().Set("MSHQ", mq)
+	if a.ped != nil {
+		a.ped.annotate(variant)
+	}
+	Overlaps(a.genes, variant.Chromosome, int(variant.Start()), int(variant.End()), overlapping)
+	if len(*overlapping) == 0 {
+		return nil
+	}
+	m := make(map[string]counter)
+	for _, o := range *overlapping {
+		var c counter
+		var ok bool
+		var key = o.Name + "|" + o.Ftype
+		if c, ok = m[key]; !ok {
+			c = counter{}
 		}
-
-		variant.Info().Set("smoove_gene", sg[1:])
-		out.WriteVariant(variant)
+		c.n += 1
+		c.bases += min(int(variant.End()), o.End) - max(int(variant.Start()), o.Start)
+		m[key] = c
 	}
-
-	if err := vcf.Error(); err != nil {
-		log.Println(err)
+	sg := ""
+	for name, counts := range m {
+		sg += fmt.Sprintf(",%s:%d:%d", name, counts.n, counts.bases)
 	}
 
+	variant.Info().Set("smoove_gene", sg[1:])
+	return nil
+}
+
+func defaultArgs() *cliargs {
+	return &cliargs{MinParentDepth: 10, Processes: 1, Upstream: 5000, Downstream: 5000, FeatureTypes: "exon,five_prime_UTR,three_prime_UTR"}
 }
 
 func Main() {
 
-	cli := &cliargs{}
+	cli := defaultArgs()
 	arg.MustParse(cli)
+	if err := annotate(cli); err != nil {
+		shared.Fatal(err)
+	}
+}
 
-	genes := readGff(cli.GFF)
+// Run runs smoove annotate with args (without the program name) for use by other sub-commands.
+func Run(args []string) error {
+	cli := defaultArgs()
+	if err := shared.ParseArgs(cli, args); err != nil {
+		return err
+	}
+	return annotate(cli)
+}
+
+func annotate(cli *cliargs) error {
+	genes, err := readGff(cli.GFF, &gffOptions{Upstream: cli.Upstream, Downstream: cli.Downstream, FeatureTypes: splitFields(cli.FeatureTypes)})
+	if err != nil {
+		return err
+	}
+	shq := DefaultSHQConfig()
+	if cli.SHQModel != "" {
+		if shq, err = ReadSHQConfig(cli.SHQModel); err != nil {
+			return shared.InputError(err)
+		}
+	}
 
 	f, err := xopen.Ropen(cli.VCF)
 	if err != nil {
-		panic(err)
+		return shared.InputError(err)
 	}
-	vcf, err := vcfgo.NewReader(f, false)
-	vcf.AddFormatToHeader("SHQ", "1", "Integer", "smoove het quality: -1==NOT HET 0==UNKNOWN, 1==VERYLOW, 3=MED, 4=HIGH")
-	vcf.AddInfoToHeader("MSHQ", "1", "Float", "mean smoove het quality: -1==NOT HET 0==UNKNOWN, 1==VERYLOW, 3=MED, 4=HIGH")
-	vcf.AddInfoToHeader("smoove_gene", ".", "String", "genes overlapping variants. format is gene|feature:nfeatures:nbases,...")
+	defer f.Close()
+	vcf, err := vcfgo.NewReader(f, true)
 	if err != nil {
-		panic(err)
+		return shared.InputError(errors.Wrapf(err, "error reading %s", cli.VCF))
 	}
+	vcf.AddFormatToHeader("SHQ", "1", "Integer", "smoove het quality: -1==NOT HET OR HOM-ALT 0==UNKNOWN, 1==VERYLOW, 3=MED, 4=HIGH")
+	vcf.AddInfoToHeader("MSHQ", "1", "Float", "mean smoove het quality across het and hom-alt samples: -1==NONE 0==UNKNOWN, 1==VERYLOW, 3=MED, 4=HIGH")
+	vcf.AddInfoToHeader("smoove_gene", ".", "String", "genes overlapping variants. format is gene|feature:nfeatures:nbases,...")
 
-	out, err := vcfgo.NewWriter(os.Stdout, vcf.Header)
+	var ped *pedAnnotator
+	if cli.Ped != "" {
+		samples, err := readPed(cli.Ped)
+		if err != nil {
+			return err
+		}
+		ped = &pedAnnotator{trios: makeTrios(samples, vcf.Header.SampleNames), minParentDepth: cli.MinParentDepth}
+		if len(ped.trios) == 0 {
+			log.Printf("no trios from %s were found in the VCF. de novos will not be reported", cli.Ped)
+		}
+		ped.addHeader(vcf)
+	}
+
+	w, closer, err := shared.OpenOutput(cli.OutVCF, cli.Processes)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if _, err := vcfgo.NewWriter(w, vcf.Header); err != nil {
+		return err
 	}
 
-	annotate(vcf, out, genes)
+	a := &annotator{genes: genes, shq: shq, ped: ped}
+	if err := annotateAll(vcf, w, a, cli.Processes); err != nil {
+		// not closed so the partial output is removed on exit rather than kept.
+		return errors.Wrapf(err, "error annotating %s", cli.VCF)
+	}
+	return closer()
 }
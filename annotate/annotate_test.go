@@ -0,0 +1,88 @@
+package annotate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFlanks(t *testing.T) {
+	us, ue, ds, de := flanks(1000, 2000, '+', 100, 50)
+	if us != 900 || ue != 1000 || ds != 2000 || de != 2050 {
+		t.Errorf("bad + flanks: %d-%d %d-%d", us, ue, ds, de)
+	}
+	us, ue, ds, de = flanks(1000, 2000, '-', 100, 50)
+	if us != 2000 || ue != 2100 || ds != 950 || de != 1000 {
+		t.Errorf("bad - flanks: %d-%d %d-%d", us, ue, ds, de)
+	}
+	if us, _, _, _ = flanks(10, 20, '+', 100, 0); us != 0 {
+		t.Errorf("expected flank to be truncated at 0, got %d", us)
+	}
+}
+
+func TestGeneName(t *testing.T) {
+	genes := map[string]string{"ENSG1": "ABC"}
+	parents := map[string]string{"ENST1": "ENSG1", "ENSE1": "ENST1"}
+	if g := geneName("ENSE1", genes, parents); g != "ABC" {
+		t.Errorf("expected ABC, got %s", g)
+	}
+	if g := geneName("ENSX", genes, parents); g != "" {
+		t.Errorf("expected no gene, got %s", g)
+	}
+}
+
+func TestReadGffEnsembl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-gff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ensembl.gff3")
+	gff := `##gff-version 3
+##sequence-region   1 1 248956422
+1	GRCh38	chromosome	1	248956422	.	.	.	ID=chromosome:1;Alias=CM000663.2
+1	havana	ncRNA_gene	1000	5000	.	+	.	ID=gene:ENSG01;Name=LINC01;biotype=lncRNA;gene_id=ENSG01;version=1
+1	havana	lnc_RNA	1000	5000	.	+	.	ID=transcript:ENST01;Parent=gene:ENSG01;Name=LINC01-201;biotype=lncRNA;transcript_id=ENST01
+1	havana	exon	1000	1200	.	+	.	Parent=transcript:ENST01;Name=ENSE01;constitutive=1;exon_id=ENSE01;rank=1
+1	ensembl_havana	gene	10000	20000	.	-	.	ID=gene:ENSG02;Name=ABC;biotype=protein_coding;gene_id=ENSG02
+1	ensembl_havana	mRNA	10000	20000	.	-	.	ID=transcript:ENST02;Parent=gene:ENSG02;Name=ABC-201;biotype=protein_coding
+1	ensembl_havana	exon	10000	10500	.	-	.	Parent=transcript:ENST02;Name=ENSE02;exon_id=ENSE02;rank=2
+`
+	if err := ioutil.WriteFile(path, []byte(gff), 0644); err != nil {
+		t.Fatal(err)
+	}
+	trees, err := readGff(path, &gffOptions{Upstream: 100, Downstream: 100, FeatureTypes: []string{"lnc_RNA", "exon"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := func(start, end int) []string {
+		var res []irange
+		Overlaps(trees, "1", start, end, &res)
+		var s []string
+		for _, r := range res {
+			s = append(s, r.Name+"|"+r.Ftype)
+		}
+		sort.Strings(s)
+		return s
+	}
+	if got := strings.Join(found(1100, 1150), ","); got != "LINC01|exon,LINC01|lnc_RNA" {
+		t.Errorf("expected the lnc_RNA and its exon, got %s", got)
+	}
+	if got := strings.Join(found(10100, 10200), ","); got != "ABC|exon,ABC|gene" {
+		t.Errorf("expected the gene and its exon, got %s", got)
+	}
+	if got := strings.Join(found(20010, 20020), ","); got != "ABC|upstream" {
+		t.Errorf("expected upstream of the - strand gene, got %s", got)
+	}
+	// without lnc_RNA, the lncRNA exon is still named from the ncRNA_gene.
+	trees, err = readGff(path, &gffOptions{FeatureTypes: []string{"exon"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(found(1100, 1150), ","); got != "LINC01|exon" {
+		t.Errorf("expected the lncRNA exon, got %s", got)
+	}
+}
@@ -0,0 +1,129 @@
+package annotate
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/pkg/errors"
+)
+
+// batchSize is the number of variants sent to each worker at a time.
+const batchSize = 500
+
+type batch struct {
+	i        int
+	variants []*vcfgo.Variant
+	out      []byte
+	err      error
+}
+
+// annotateAll reads variants from vcf (which should be opened with lazy samples) in batches,
+// annotates them in procs goroutines and writes them to w in the original order.
+// The header must already be written.
+func annotateAll(vcf *vcfgo.Reader, w io.Writer, a *annotator, procs int) error {
+	if procs < 1 {
+		procs = 1
+	}
+	work := make(chan *batch, procs)
+	done := make(chan *batch, procs)
+	// limit the number of batches in memory in case one is much slower than others.
+	tokens := make(chan bool, 3*procs)
+	// failed is closed when a batch has an error so that the rest of the VCF isn't read.
+	failed := make(chan struct{})
+	var failOnce sync.Once
+
+	go func() {
+		defer close(work)
+		for i := 0; ; i++ {
+			select {
+			case <-failed:
+				return
+			default:
+			}
+			b := &batch{i: i, variants: make([]*vcfgo.Variant, 0, batchSize)}
+			for len(b.variants) < batchSize {
+				v := vcf.Read()
+				if v == nil {
+					break
+				}
+				b.variants = append(b.variants, v)
+			}
+			n := len(b.variants)
+			if n == 0 {
+				return
+			}
+			tokens <- true
+			work <- b
+			if n < batchSize {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(procs)
+	for k := 0; k < procs; k++ {
+		go func() {
+			defer wg.Done()
+			overlapping := make([]irange, 0, 24)
+			var buf bytes.Buffer
+			for b := range work {
+				buf.Reset()
+				for _, v := range b.variants {
+					if err := vcf.Header.ParseSamples(v); err != nil {
+						b.err = shared.InputError(errors.Wrapf(err, "error parsing samples at %s:%d", v.Chromosome, v.Pos))
+						break
+					}
+					if err := a.annotate(v, &overlapping); err != nil {
+						b.err = err
+						break
+					}
+					buf.WriteString(v.String())
+					buf.WriteByte('\n')
+				}
+				if b.err != nil {
+					failOnce.Do(func() { close(failed) })
+				}
+				b.out = append(b.out, buf.Bytes()...)
+				b.variants = nil
+				done <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// write batches in order as they are completed.
+	pending := make(map[int]*batch, 3*procs)
+	next := 0
+	var werr error
+	for b := range done {
+		pending[b.i] = b
+		for {
+			nb, ok := pending[next]
+			if !ok {
+				break
+			}
+			if werr == nil {
+				if werr = nb.err; werr == nil {
+					_, werr = w.Write(nb.out)
+				}
+			}
+			delete(pending, next)
+			next++
+			<-tokens
+		}
+	}
+	if werr != nil {
+		return werr
+	}
+	if err := vcf.Error(); err != nil {
+		return shared.InputError(err)
+	}
+	return nil
+}
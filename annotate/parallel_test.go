@@ -0,0 +1,79 @@
+package annotate
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/brentp/vcfgo"
+)
+
+const testHeader = `##fileformat=VCFv4.2
+##INFO=<ID=SVTYPE,Number=1,Type=String,Description="type">
+##INFO=<ID=END,Number=1,Type=Integer,Description="end">
+##INFO=<ID=CIPOS,Number=2,Type=Integer,Description="cipos">
+##INFO=<ID=CIEND,Number=2,Type=Integer,Description="ciend">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="genotype">
+##FORMAT=<ID=AB,Number=1,Type=Float,Description="allele balance">
+##FORMAT=<ID=AS,Number=1,Type=Integer,Description="alternate split">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	s1	s2
+`
+
+func TestAnnotateAllOrder(t *testing.T) {
+	n := 3*batchSize + 17
+	var b strings.Builder
+	b.WriteString(testHeader)
+	for i := 0; i < n; i++ {
+		pos := 1000 + 100*i
+		fmt.Fprintf(&b, "1\t%d\tv%d\tN\t<DEL>\t10\t.\tSVTYPE=DEL;END=%d;CIPOS=-5,5;CIEND=-5,5\tGT:AB:AS\t0/1:0.4:3\t0/0:0:0\n", pos, i, pos+50)
+	}
+	for _, procs := range []int{1, 3} {
+		vcf, err := vcfgo.NewReader(strings.NewReader(b.String()), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := annotateAll(vcf, &out, &annotator{shq: DefaultSHQConfig()}, procs); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != n {
+			t.Fatalf("procs: %d. expected %d variants, got %d", procs, n, len(lines))
+		}
+		for i, l := range lines {
+			toks := strings.Split(l, "\t")
+			if toks[2] != fmt.Sprintf("v%d", i) {
+				t.Fatalf("procs: %d. expected v%d at line %d, got %s", procs, i, i, toks[2])
+			}
+			if !strings.HasSuffix(l, "0/1:0.4:3:4\t0/0:0:0:-1") {
+				t.Fatalf("bad SHQ in %s", l)
+			}
+		}
+	}
+}
+
+func TestAnnotateAllSampleError(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(testHeader)
+	for i := 0; i < 10*batchSize; i++ {
+		s1 := "0/1:0.4:3"
+		if i == 7 {
+			// a sample with fewer fields than the FORMAT.
+			s1 = "0/1:0.4"
+		}
+		pos := 1000 + 100*i
+		fmt.Fprintf(&b, "1\t%d\tv%d\tN\t<DEL>\t10\t.\tSVTYPE=DEL;END=%d;CIPOS=-5,5;CIEND=-5,5\tGT:AB:AS\t%s\t0/0:0:0\n", pos, i, pos+50, s1)
+	}
+	vcf, err := vcfgo.NewReader(strings.NewReader(b.String()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := annotateAll(vcf, &out, &annotator{shq: DefaultSHQConfig()}, 2); err == nil || !strings.Contains(err.Error(), "1:1700") {
+		t.Fatalf("expected an error parsing the samples at 1:1700, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected nothing to be written after the first batch failed")
+	}
+}
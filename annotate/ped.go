@@ -0,0 +1,161 @@
+package annotate
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+)
+
+// pedSample is a single row from a PED/fam file.
+type pedSample struct {
+	Family   string
+	ID       string
+	Paternal string
+	Maternal string
+}
+
+func readPed(path string) ([]pedSample, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	defer f.Close()
+	samples := make([]pedSample, 0, 16)
+	for {
+		line, err := f.ReadString('\n')
+		if toks := strings.Fields(line); len(toks) != 0 && toks[0][0] != '#' {
+			if len(toks) < 5 {
+				return nil, shared.Inputf("expected at least 5 columns in ped file %s. got: %s", path, line)
+			}
+			samples = append(samples, pedSample{Family: toks[0], ID: toks[1], Paternal: toks[2], Maternal: toks[3]})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, shared.InputError(err)
+		}
+	}
+	return samples, nil
+}
+
+// trio holds the indexes into the VCF samples for a kid and both parents.
+type trio struct {
+	family string
+	kid    int
+	dad    int
+	mom    int
+}
+
+// makeTrios returns each kid from the pedigree that has both parents present in the VCF.
+func makeTrios(samples []pedSample, vcfSamples []string) []trio {
+	idx := make(map[string]int, len(vcfSamples))
+	for i, s := range vcfSamples {
+		idx[s] = i
+	}
+	trios := make([]trio, 0, 4)
+	for _, s := range samples {
+		k, kok := idx[s.ID]
+		d, dok := idx[s.Paternal]
+		m, mok := idx[s.Maternal]
+		if !(kok && dok && mok) {
+			continue
+		}
+		trios = append(trios, trio{family: s.Family, kid: k, dad: d, mom: m})
+	}
+	return trios
+}
+
+func known(gt []int) bool {
+	if len(gt) != 2 {
+		return false
+	}
+	return gt[0] >= 0 && gt[1] >= 0
+}
+
+func hasAllele(gt []int, a int) bool {
+	return gt[0] == a || gt[1] == a
+}
+
+// mendelError reports whether the kid's genotype can not be formed by one allele
+// from each parent. Any unknown genotype is not considered an error.
+func mendelError(kid, dad, mom []int) bool {
+	if !(known(kid) && known(dad) && known(mom)) {
+		return false
+	}
+	return !((hasAllele(dad, kid[0]) && hasAllele(mom, kid[1])) ||
+		(hasAllele(dad, kid[1]) && hasAllele(mom, kid[0])))
+}
+
+func isHomRef(gt []int) bool {
+	return known(gt) && gt[0] == 0 && gt[1] == 0
+}
+
+func isAlt(gt []int) bool {
+	return known(gt) && (gt[0] > 0 || gt[1] > 0)
+}
+
+// sexChrom is used to skip mendelian checks where males are hemizygous.
+func sexChrom(chrom string) bool {
+	chrom = strings.TrimPrefix(chrom, "chr")
+	return chrom == "X" || chrom == "Y"
+}
+
+// pedAnnotator sets mendelian error counts per family and flags candidate de novos.
+type pedAnnotator struct {
+	trios          []trio
+	minParentDepth int
+}
+
+func (p *pedAnnotator) addHeader(vcf *vcfgo.Reader) {
+	vcf.AddFormatToHeader("SDN", "1", "Integer", "smoove candidate de novo: 1 if kid is a high-quality (SHQ==4) carrier and both parents are homozygous reference with adequate depth")
+	vcf.AddInfoToHeader("smoove_mendel_errors", ".", "String", "mendelian errors per family. format is family:n_errors,...")
+	vcf.AddInfoToHeader("smoove_denovo", ".", "String", "samples with a candidate de novo call (SDN==1)")
+}
+
+func (p *pedAnnotator) depthOK(s *vcfgo.SampleGenotype) bool {
+	dp, err := getval(s.Fields, "DP", 0)
+	return err == nil && dp >= float64(p.minParentDepth)
+}
+
+func (p *pedAnnotator) annotate(variant *vcfgo.Variant) {
+	variant.Format = append(variant.Format, "SDN")
+	for _, s := range variant.Samples {
+		s.Fields["SDN"] = "0"
+	}
+	if len(p.trios) == 0 {
+		return
+	}
+	skipMendel := sexChrom(variant.Chromosome)
+	errs := make(map[string]int)
+	families := make([]string, 0, 2)
+	var denovos []string
+
+	for _, t := range p.trios {
+		kid, dad, mom := variant.Samples[t.kid], variant.Samples[t.dad], variant.Samples[t.mom]
+		if !skipMendel && mendelError(kid.GT, dad.GT, mom.GT) {
+			if _, ok := errs[t.family]; !ok {
+				families = append(families, t.family)
+			}
+			errs[t.family]++
+		}
+		if isAlt(kid.GT) && kid.Fields["SHQ"] == "4" && isHomRef(dad.GT) && isHomRef(mom.GT) && p.depthOK(dad) && p.depthOK(mom) {
+			kid.Fields["SDN"] = "1"
+			denovos = append(denovos, variant.Header.SampleNames[t.kid])
+		}
+	}
+	if len(families) > 0 {
+		me := make([]string, len(families))
+		for i, f := range families {
+			me[i] = fmt.Sprintf("%s:%d", f, errs[f])
+		}
+		variant.Info().Set("smoove_mendel_errors", strings.Join(me, ","))
+	}
+	if len(denovos) > 0 {
+		variant.Info().Set("smoove_denovo", strings.Join(denovos, ","))
+	}
+}
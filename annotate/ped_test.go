@@ -0,0 +1,37 @@
+package annotate
+
+import "testing"
+
+func TestMendelError(t *testing.T) {
+	cases := []struct {
+		kid, dad, mom []int
+		err           bool
+	}{
+		{[]int{0, 1}, []int{0, 0}, []int{0, 1}, false},
+		{[]int{0, 1}, []int{0, 0}, []int{0, 0}, true},
+		{[]int{1, 1}, []int{0, 1}, []int{0, 1}, false},
+		{[]int{1, 1}, []int{0, 1}, []int{0, 0}, true},
+		{[]int{0, 0}, []int{1, 1}, []int{0, 0}, true},
+		{[]int{0, 1}, []int{-1, -1}, []int{0, 0}, false},
+	}
+	for i, c := range cases {
+		if got := mendelError(c.kid, c.dad, c.mom); got != c.err {
+			t.Errorf("case %d: expected mendelian error: %v, got %v", i, c.err, got)
+		}
+	}
+}
+
+func TestMakeTrios(t *testing.T) {
+	ped := []pedSample{
+		{Family: "f1", ID: "kid", Paternal: "dad", Maternal: "mom"},
+		{Family: "f1", ID: "dad", Paternal: "0", Maternal: "0"},
+		{Family: "f2", ID: "kid2", Paternal: "dad2", Maternal: "mom2"},
+	}
+	trios := makeTrios(ped, []string{"mom", "dad", "kid", "kid2", "dad2"})
+	if len(trios) != 1 {
+		t.Fatalf("expected 1 trio, got %d", len(trios))
+	}
+	if trios[0] != (trio{family: "f1", kid: 2, dad: 1, mom: 0}) {
+		t.Errorf("unexpected trio: %+v", trios[0])
+	}
+}
@@ -0,0 +1,197 @@
+package annotate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// shqRules is the decision-rule SHQ model. The defaults reproduce the original
+// hard-coded smoove thresholds.
+type shqRules struct {
+	// AB above this is required for a high quality call. AB at or below this may be very low quality.
+	MinAB float64 `json:"min_ab"`
+	// high quality (4) requires AS > HighMinAS and CI sum < HighMaxCISum
+	HighMinAS    float64 `json:"high_min_as"`
+	HighMaxCISum float64 `json:"high_max_cisum"`
+	// very low quality (1) requires ASC < LowMaxASC and AS < LowMaxAS
+	LowMaxASC float64 `json:"low_max_asc"`
+	LowMaxAS  float64 `json:"low_max_as"`
+	// medium quality (3) requires AP > MedMinAP and CI sum < MedMaxCISum
+	MedMinAP    float64 `json:"med_min_ap"`
+	MedMaxCISum float64 `json:"med_max_cisum"`
+}
+
+func (r *shqRules) score(fields map[string]string, cisum float64) int {
+	ab, err := getval(fields, "AB", 0.5)
+	if err != nil {
+		return 0
+	}
+	as, err := getval(fields, "AS", 0)
+	if err != nil {
+		return 0
+	}
+	// high quality
+	if ab > r.MinAB {
+		if as > r.HighMinAS && cisum < r.HighMaxCISum {
+			return 4
+		}
+	}
+	asc, err := getval(fields, "ASC", 0)
+	if err != nil {
+		return 0
+	}
+	// low quality
+	if ab <= r.MinAB && asc < r.LowMaxASC && as < r.LowMaxAS {
+		return 1
+	}
+	ap, _ := getval(fields, "AP", 0)
+	if ap > r.MedMinAP && cisum < r.MedMaxCISum {
+		return 3
+	}
+	return 4
+}
+
+// featureNames are the per-sample values available to the logistic SHQ model.
+// CISUM is the sum of the absolute values of CIPOS and CIEND. DHFFC and DHBFC
+// are from duphold and are used as |log2(x)| so that both deletions and
+// duplications score by the magnitude of the depth change.
+var featureNames = []string{"AB", "AS", "ASC", "AP", "CISUM", "DHFFC", "DHBFC"}
+
+// shqFeatures extracts featureNames from a sample. It returns false if AB or AS
+// is missing in which case the SHQ is unknown (0).
+func shqFeatures(fields map[string]string, cisum float64) ([]float64, bool) {
+	x := make([]float64, len(featureNames))
+	var err error
+	if x[0], err = getval(fields, "AB", 0.5); err != nil {
+		return x, false
+	}
+	if x[1], err = getval(fields, "AS", 0); err != nil {
+		return x, false
+	}
+	x[2], _ = getval(fields, "ASC", 0)
+	x[3], _ = getval(fields, "AP", 0)
+	x[4] = cisum
+	for i, k := range featureNames[5:] {
+		v, err := getval(fields, k, 1)
+		if err != nil || v <= 0 || math.IsNaN(v) {
+			v = 1
+		}
+		x[5+i] = math.Abs(math.Log2(v))
+	}
+	return x, true
+}
+
+// shqLogistic is a logistic model over standardized featureNames.
+type shqLogistic struct {
+	Intercept float64            `json:"intercept"`
+	Weights   map[string]float64 `json:"weights"`
+	// Means and SDs are used to standardize each feature before applying the weights.
+	Means map[string]float64 `json:"means"`
+	SDs   map[string]float64 `json:"sds"`
+	// Cutoffs on the predicted probability to get SHQ of 2, 3, and 4 respectively. Below the first is 1.
+	Cutoffs [3]float64 `json:"cutoffs"`
+}
+
+func (l *shqLogistic) prob(x []float64) float64 {
+	z := l.Intercept
+	for i, k := range featureNames {
+		w, ok := l.Weights[k]
+		if !ok {
+			continue
+		}
+		sd := l.SDs[k]
+		if sd == 0 {
+			sd = 1
+		}
+		z += w * (x[i] - l.Means[k]) / sd
+	}
+	return 1 / (1 + math.Exp(-z))
+}
+
+func (l *shqLogistic) score(fields map[string]string, cisum float64) int {
+	x, ok := shqFeatures(fields, cisum)
+	if !ok {
+		return 0
+	}
+	p := l.prob(x)
+	q := 1
+	for _, c := range l.Cutoffs {
+		if p >= c {
+			q++
+		}
+	}
+	return q
+}
+
+// shqModel holds exactly one of the rule-based or logistic models.
+type shqModel struct {
+	Rules    *shqRules    `json:"rules,omitempty"`
+	Logistic *shqLogistic `json:"logistic,omitempty"`
+}
+
+func (m *shqModel) score(fields map[string]string, cisum float64) int {
+	if m.Logistic != nil {
+		return m.Logistic.score(fields, cisum)
+	}
+	return m.Rules.score(fields, cisum)
+}
+
+// SHQConfig defines how the smoove het quality (SHQ) is calculated for heterozygous
+// and homozygous-alternate genotypes.
+type SHQConfig struct {
+	Het    shqModel `json:"het"`
+	HomAlt shqModel `json:"hom_alt"`
+}
+
+func defaultRules() *shqRules {
+	return &shqRules{MinAB: 0.167, HighMinAS: 1.5, HighMaxCISum: 40, LowMaxASC: 0.5, LowMaxAS: 0.5, MedMinAP: 7, MedMaxCISum: 200}
+}
+
+// DefaultSHQConfig returns the built-in rules. hom-alts use the het rules but require a higher allele balance.
+func DefaultSHQConfig() *SHQConfig {
+	hom := defaultRules()
+	hom.MinAB = 0.5
+	return &SHQConfig{Het: shqModel{Rules: defaultRules()}, HomAlt: shqModel{Rules: hom}}
+}
+
+// ReadSHQConfig reads an SHQ model from a JSON file as written by `smoove train-shq`.
+func ReadSHQConfig(path string) (*SHQConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &SHQConfig{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("error reading SHQ model from %s: %s", path, err)
+	}
+	for name, m := range map[string]*shqModel{"het": &c.Het, "hom_alt": &c.HomAlt} {
+		if (m.Rules == nil) == (m.Logistic == nil) {
+			return nil, fmt.Errorf("SHQ model for %s in %s must have exactly one of 'rules' or 'logistic'", name, path)
+		}
+	}
+	return c, nil
+}
+
+func isHet(gt []int) bool {
+	return len(gt) == 2 && gt[0] == 0 && gt[1] == 1
+}
+
+func isHomAlt(gt []int) bool {
+	return len(gt) == 2 && gt[0] == 1 && gt[1] == 1
+}
+
+// Score returns the SHQ for a sample or -1 if the genotype is not het or hom-alt.
+func (c *SHQConfig) Score(gt []int, fields map[string]string, cisum float64) int {
+	if isHet(gt) {
+		return c.Het.score(fields, cisum)
+	}
+	if isHomAlt(gt) {
+		return c.HomAlt.score(fields, cisum)
+	}
+	return -1
+}
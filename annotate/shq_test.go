@@ -0,0 +1,51 @@
+package annotate
+
+import "testing"
+
+func TestDefaultRules(t *testing.T) {
+	c := DefaultSHQConfig()
+	het := []int{0, 1}
+	if q := c.Score(het, map[string]string{"AB": "0.4", "AS": "3"}, 10); q != 4 {
+		t.Errorf("expected high quality, got %d", q)
+	}
+	if q := c.Score(het, map[string]string{"AB": "0.1", "AS": "0", "ASC": "0"}, 10); q != 1 {
+		t.Errorf("expected very low quality, got %d", q)
+	}
+	if q := c.Score(het, map[string]string{"AB": "0.1", "AS": "1", "ASC": "1", "AP": "8"}, 100); q != 3 {
+		t.Errorf("expected medium quality, got %d", q)
+	}
+	if q := c.Score(het, map[string]string{"AS": "3"}, 10); q != 0 {
+		t.Errorf("expected unknown quality, got %d", q)
+	}
+	if q := c.Score([]int{0, 0}, map[string]string{"AB": "0.4", "AS": "3"}, 10); q != -1 {
+		t.Errorf("expected -1 for hom-ref, got %d", q)
+	}
+	hom := []int{1, 1}
+	if q := c.Score(hom, map[string]string{"AB": "0.9", "AS": "3"}, 10); q != 4 {
+		t.Errorf("expected high quality hom-alt, got %d", q)
+	}
+	if q := c.Score(hom, map[string]string{"AB": "0.3", "AS": "0", "ASC": "0"}, 10); q != 1 {
+		t.Errorf("expected very low quality hom-alt, got %d", q)
+	}
+}
+
+func TestFitLogistic(t *testing.T) {
+	ts := &trainingSet{}
+	for i := 0; i < 50; i++ {
+		ab := float64(i%10) / 20
+		ts.x = append(ts.x, []float64{0.3 + ab, 4, 0, 0, 10, 1, 0})
+		ts.y = append(ts.y, 1)
+		ts.x = append(ts.x, []float64{0.02 + ab/10, 0, 0, 0, 300, 0, 0})
+		ts.y = append(ts.y, 0)
+	}
+	l := fitLogistic(ts)
+	m := shqModel{Logistic: l}
+	good := map[string]string{"AB": "0.5", "AS": "4", "DHFFC": "0.5"}
+	bad := map[string]string{"AB": "0.03", "AS": "0"}
+	if q := m.score(good, 10); q != 4 {
+		t.Errorf("expected high quality from trained model, got %d", q)
+	}
+	if q := m.score(bad, 300); q != 1 {
+		t.Errorf("expected low quality from trained model, got %d", q)
+	}
+}
@@ -0,0 +1,200 @@
+package annotate
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+	"github.com/pkg/errors"
+)
+
+type tableargs struct {
+	Info     string `arg:"-i,help:comma-delimited INFO fields to output as columns. smoove_gene is split into gene and feature columns."`
+	Format   string `arg:"-f,help:comma-delimited FORMAT fields to output for each sample."`
+	Carriers bool   `arg:"-c,help:output one row per variant and carrier (het or hom-alt) sample instead of one row per variant."`
+	Out      string `arg:"-o,help:output path. if it ends in .gz it is compressed. default is stdout."`
+	VCF      string `arg:"positional,required,help:VCF (usually from smoove annotate) to convert to a table."`
+}
+
+func (c tableargs) Description() string {
+	return `write a tab-delimited table of SVs. fixed columns are chrom, start (VCF POS), end, id, svtype, svlen, cipos, ciend.
+with --carriers, per-sample columns are named by FORMAT field; otherwise they are named {sample}_{field}.`
+}
+
+// infoFields splits the INFO column into a map. Flags have a value of "1".
+func infoFields(info string) map[string]string {
+	m := make(map[string]string, 16)
+	if info == "." || info == "" {
+		return m
+	}
+	for _, kv := range strings.Split(info, ";") {
+		if eq := strings.IndexByte(kv, '='); eq != -1 {
+			m[kv[:eq]] = kv[eq+1:]
+		} else {
+			m[kv] = "1"
+		}
+	}
+	return m
+}
+
+// splitGenes converts smoove_gene (gene|feature:n:bases,...) into unique genes and features.
+func splitGenes(sg string) (genes, features string) {
+	if sg == "" {
+		return ".", "."
+	}
+	var gs, fs []string
+	for _, g := range strings.Split(sg, ",") {
+		g = strings.SplitN(g, ":", 2)[0]
+		pair := strings.SplitN(g, "|", 2)
+		if !contains(gs, pair[0]) {
+			gs = append(gs, pair[0])
+		}
+		if len(pair) == 2 && !contains(fs, pair[1]) {
+			fs = append(fs, pair[1])
+		}
+	}
+	if len(fs) == 0 {
+		fs = append(fs, ".")
+	}
+	return strings.Join(gs, ","), strings.Join(fs, ",")
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, h := range haystack {
+		if h == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func orDot(s string) string {
+	if s == "" {
+		return "."
+	}
+	return s
+}
+
+func svlen(v *vcfgo.Variant, info map[string]string) string {
+	if l, ok := info["SVLEN"]; ok {
+		return strings.TrimPrefix(l, "-")
+	}
+	if info["SVTYPE"] == "BND" {
+		return "."
+	}
+	return strconv.Itoa(int(v.End()) - int(v.Pos))
+}
+
+func splitFields(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func TableMain() {
+	cli := tableargs{Info: "MSHQ,smoove_gene", Format: "GT,SHQ,DHFFC", Out: "-"}
+	arg.MustParse(&cli)
+	if err := table(cli); err != nil {
+		shared.Fatal(err)
+	}
+}
+
+func table(cli tableargs) error {
+	f, err := xopen.Ropen(cli.VCF)
+	if err != nil {
+		return shared.InputError(err)
+	}
+	defer f.Close()
+	vcf, err := vcfgo.NewReader(f, false)
+	if err != nil {
+		return shared.InputError(errors.Wrapf(err, "error reading %s", cli.VCF))
+	}
+	w, err := xopen.Wopen(cli.Out)
+	if err != nil {
+		return shared.InputError(err)
+	}
+	if err := writeTable(vcf, w.Writer, cli); err != nil {
+		w.Close()
+		return err
+	}
+	// Close flushes the buffered (and possibly compressed) output so its error must be checked.
+	return errors.Wrapf(w.Close(), "error writing %s", cli.Out)
+}
+
+// writeTable writes the header and a row for each variant (or each carrier) in vcf to w and flushes it.
+func writeTable(vcf *vcfgo.Reader, w *bufio.Writer, cli tableargs) error {
+	infos, formats := splitFields(cli.Info), splitFields(cli.Format)
+	header := []string{"chrom", "start", "end", "id", "svtype", "svlen", "cipos", "ciend"}
+	for _, k := range infos {
+		if k == "smoove_gene" {
+			header = append(header, "gene", "feature")
+		} else {
+			header = append(header, k)
+		}
+	}
+	if cli.Carriers {
+		header = append(header, "sample")
+		header = append(header, formats...)
+	} else {
+		for _, s := range vcf.Header.SampleNames {
+			for _, k := range formats {
+				header = append(header, s+"_"+k)
+			}
+		}
+	}
+	writeRow(w, header)
+
+	row := make([]string, 0, len(header))
+	for {
+		v := vcf.Read()
+		if v == nil {
+			break
+		}
+		info := infoFields(v.Info().String())
+		row = append(row[:0], v.Chromosome, strconv.Itoa(int(v.Pos)), strconv.Itoa(int(v.End())), v.Id(),
+			orDot(info["SVTYPE"]), svlen(v, info), orDot(info["CIPOS"]), orDot(info["CIEND"]))
+		for _, k := range infos {
+			if k == "smoove_gene" {
+				g, f := splitGenes(info[k])
+				row = append(row, g, f)
+			} else {
+				row = append(row, orDot(info[k]))
+			}
+		}
+		if !cli.Carriers {
+			for _, s := range v.Samples {
+				for _, k := range formats {
+					row = append(row, orDot(s.Fields[k]))
+				}
+			}
+			writeRow(w, row)
+			continue
+		}
+		n := len(row)
+		for i, s := range v.Samples {
+			if !isAlt(s.GT) {
+				continue
+			}
+			row = append(row[:n], vcf.Header.SampleNames[i])
+			for _, k := range formats {
+				row = append(row, orDot(s.Fields[k]))
+			}
+			writeRow(w, row)
+		}
+	}
+	if err := vcf.Error(); err != nil {
+		return shared.InputError(errors.Wrapf(err, "error reading %s", cli.VCF))
+	}
+	// bufio.Writer keeps the first write error so it is reported here.
+	return w.Flush()
+}
+
+func writeRow(w *bufio.Writer, row []string) {
+	w.WriteString(strings.Join(row, "\t"))
+	w.WriteByte('\n')
+}
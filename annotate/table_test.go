@@ -0,0 +1,77 @@
+package annotate
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/brentp/vcfgo"
+)
+
+func TestInfoFields(t *testing.T) {
+	m := infoFields("SVTYPE=DEL;IMPRECISE;SVLEN=-100;smoove_gene=A|exon:1:10")
+	if m["SVTYPE"] != "DEL" || m["IMPRECISE"] != "1" || m["SVLEN"] != "-100" || m["smoove_gene"] != "A|exon:1:10" {
+		t.Errorf("unexpected info: %v", m)
+	}
+	if len(infoFields(".")) != 0 {
+		t.Errorf("expected no fields for .")
+	}
+}
+
+func TestSplitGenes(t *testing.T) {
+	for _, c := range [][3]string{
+		{"", ".", "."},
+		{"A|exon:2:100,A|UTR:1:5,B|exon:1:10", "A,B", "exon,UTR"},
+		{"A:1:10", "A", "."},
+	} {
+		if g, f := splitGenes(c[0]); g != c[1] || f != c[2] {
+			t.Errorf("%q: expected %s %s, got %s %s", c[0], c[1], c[2], g, f)
+		}
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	vcfs := testHeader +
+		"1\t1000\tdel\tN\t<DEL>\t10\t.\tSVTYPE=DEL;END=1100;SVLEN=-100;CIPOS=-5,5\tGT:AB\t0/1:0.4\t1/1:0.9\n" +
+		"1\t2000\tdup\tN\t<DUP>\t10\t.\tSVTYPE=DUP;END=2500\tGT:AB\t0/0:0\t0/1:0.3\n" +
+		"1\t3000\tbnd\tN\tN]2:100]\t10\t.\tSVTYPE=BND\tGT:AB\t./.:.\t0/0:0\n"
+	table := func(carriers bool) []string {
+		vcf, err := vcfgo.NewReader(strings.NewReader(vcfs), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := writeTable(vcf, bufio.NewWriter(&out), tableargs{Info: "SVTYPE", Format: "GT,AB", Carriers: carriers}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(out.String()), "\n")
+	}
+
+	rows := table(false)
+	if len(rows) != 4 || rows[0] != "chrom\tstart\tend\tid\tsvtype\tsvlen\tcipos\tciend\tSVTYPE\ts1_GT\ts1_AB\ts2_GT\ts2_AB" {
+		t.Fatalf("unexpected table: %q", rows)
+	}
+	if !strings.HasPrefix(rows[1], "1\t1000\t1100\tdel\tDEL\t100\t-5,5\t.\tDEL\t") {
+		t.Errorf("expected svlen from SVLEN in %s", rows[1])
+	}
+	if !strings.HasPrefix(rows[2], "1\t2000\t2500\tdup\tDUP\t500\t") {
+		t.Errorf("expected svlen from END in %s", rows[2])
+	}
+	if toks := strings.Split(rows[3], "\t"); toks[5] != "." {
+		t.Errorf("expected no svlen for a BND in %s", rows[3])
+	}
+
+	rows = table(true)
+	if len(rows) != 4 || !strings.HasSuffix(rows[0], "\tsample\tGT\tAB") {
+		t.Fatalf("expected a row per carrier: %q", rows)
+	}
+	for i, want := range []string{"del\tDEL", "del\tDEL", "dup\tDUP"} {
+		if !strings.Contains(rows[i+1], want) {
+			t.Errorf("expected %s in %s", want, rows[i+1])
+		}
+	}
+	if !strings.HasSuffix(rows[1], "\ts1\t0/1\t0.4") || !strings.HasSuffix(rows[2], "\ts2\t1/1\t0.9") || !strings.HasSuffix(rows[3], "\ts2\t0/1\t0.3") {
+		t.Errorf("unexpected carrier rows: %q", rows[1:])
+	}
+}
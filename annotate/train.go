@@ -0,0 +1,286 @@
+package annotate
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/biogo/store/interval"
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+	"github.com/pkg/errors"
+)
+
+type trainargs struct {
+	Truth      string  `arg:"-t,required,help:truth-set VCF of SVs for this sample (e.g. GIAB HG002_SVs_Tier1)."`
+	Sample     string  `arg:"-s,help:sample in the VCF that corresponds to the truth-set. default is the first sample."`
+	MinOverlap float64 `arg:"help:minimum reciprocal overlap to a truth SV of the same type for a call to be a true positive."`
+	PassOnly   bool    `arg:"help:only use truth-set variants with FILTER of PASS or '.'."`
+	Out        string  `arg:"-o,required,help:path to write JSON SHQ model for use with smoove annotate --shqmodel."`
+	VCF        string  `arg:"positional,required,help:genotyped (and optionally duphold annotated) smoove VCF."`
+}
+
+func (c trainargs) Description() string {
+	return `fit logistic SHQ models for het and hom-alt genotypes from a sample with a truth-set.
+a call is labelled as true if it overlaps a truth SV of the same SVTYPE. BNDs are ignored.`
+}
+
+// minTrainClass is the minimum number of true and of false calls needed to fit a model.
+const minTrainClass = 10
+
+func svtype(v *vcfgo.Variant) string {
+	t, err := v.Info().Get("SVTYPE")
+	if err != nil || t == nil {
+		return ""
+	}
+	s, _ := t.(string)
+	return s
+}
+
+func readTruth(path string, passOnly bool) (map[string]*interval.IntTree, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	defer f.Close()
+	vcf, err := vcfgo.NewReader(f, true)
+	if err != nil {
+		return nil, shared.InputError(errors.Wrapf(err, "error reading %s", path))
+	}
+	t := make(map[string]*interval.IntTree, 24)
+	var k int
+	for {
+		v := vcf.Read()
+		if v == nil {
+			break
+		}
+		if passOnly && !(v.Filter == "PASS" || v.Filter == ".") {
+			continue
+		}
+		st := svtype(v)
+		if st == "" || st == "BND" {
+			continue
+		}
+		s, e := int(v.Start()), int(v.End())
+		if e <= s {
+			e = s + 1
+		}
+		if _, ok := t[v.Chromosome]; !ok {
+			t[v.Chromosome] = &interval.IntTree{}
+		}
+		if err := t[v.Chromosome].Insert(irange{Start: s, End: e, UID: uintptr(k), Ftype: st}, false); err != nil {
+			return nil, shared.InputError(errors.Wrapf(err, "error adding truth variant at %s:%d", v.Chromosome, v.Pos))
+		}
+		k++
+	}
+	if err := vcf.Error(); err != nil {
+		return nil, shared.InputError(errors.Wrapf(err, "error reading %s", path))
+	}
+	return t, nil
+}
+
+func reciprocal(s0, e0, s1, e1 int, minOverlap float64) bool {
+	ov := float64(min(e0, e1) - max(s0, s1))
+	if ov <= 0 {
+		return false
+	}
+	return ov/float64(e0-s0) >= minOverlap && ov/float64(e1-s1) >= minOverlap
+}
+
+type trainingSet struct {
+	x [][]float64
+	y []float64
+}
+
+func (t *trainingSet) counts() (pos, neg int) {
+	for _, v := range t.y {
+		if v == 1 {
+			pos++
+		} else {
+			neg++
+		}
+	}
+	return pos, neg
+}
+
+// fitLogistic fits weights over standardized features by gradient descent with a small L2 penalty.
+func fitLogistic(t *trainingSet) *shqLogistic {
+	nf := len(featureNames)
+	means := make([]float64, nf)
+	sds := make([]float64, nf)
+	n := float64(len(t.x))
+	for _, x := range t.x {
+		for j, v := range x {
+			means[j] += v / n
+		}
+	}
+	for _, x := range t.x {
+		for j, v := range x {
+			sds[j] += (v - means[j]) * (v - means[j]) / n
+		}
+	}
+	for j := range sds {
+		sds[j] = math.Sqrt(sds[j])
+		if sds[j] == 0 {
+			sds[j] = 1
+		}
+	}
+	z := make([][]float64, len(t.x))
+	for i, x := range t.x {
+		z[i] = make([]float64, nf)
+		for j, v := range x {
+			z[i][j] = (v - means[j]) / sds[j]
+		}
+	}
+
+	const iterations = 2000
+	const rate = 0.1
+	const l2 = 1e-3
+	w := make([]float64, nf)
+	var b float64
+	grad := make([]float64, nf)
+	for it := 0; it < iterations; it++ {
+		var gb float64
+		for j := range grad {
+			grad[j] = 0
+		}
+		for i, x := range z {
+			p := b
+			for j, v := range x {
+				p += w[j] * v
+			}
+			d := 1/(1+math.Exp(-p)) - t.y[i]
+			gb += d
+			for j, v := range x {
+				grad[j] += d * v
+			}
+		}
+		b -= rate * gb / n
+		for j := range w {
+			w[j] -= rate * (grad[j]/n + l2*w[j])
+		}
+	}
+
+	l := &shqLogistic{Intercept: b, Weights: make(map[string]float64, nf), Means: make(map[string]float64, nf),
+		SDs: make(map[string]float64, nf), Cutoffs: [3]float64{0.2, 0.5, 0.8}}
+	for j, k := range featureNames {
+		l.Weights[k] = w[j]
+		l.Means[k] = means[j]
+		l.SDs[k] = sds[j]
+	}
+	return l
+}
+
+func TrainMain() {
+	cli := trainargs{MinOverlap: 0.5}
+	arg.MustParse(&cli)
+	if err := train(cli); err != nil {
+		shared.Fatal(err)
+	}
+}
+
+func train(cli trainargs) error {
+	truth, err := readTruth(cli.Truth, cli.PassOnly)
+	if err != nil {
+		return err
+	}
+
+	f, err := xopen.Ropen(cli.VCF)
+	if err != nil {
+		return shared.InputError(err)
+	}
+	defer f.Close()
+	vcf, err := vcfgo.NewReader(f, false)
+	if err != nil {
+		return shared.InputError(errors.Wrapf(err, "error reading %s", cli.VCF))
+	}
+	si := 0
+	if cli.Sample != "" {
+		si = -1
+		for i, s := range vcf.Header.SampleNames {
+			if s == cli.Sample {
+				si = i
+			}
+		}
+		if si == -1 {
+			return shared.Inputf("sample %s not found in %s", cli.Sample, cli.VCF)
+		}
+	}
+
+	het, hom := &trainingSet{}, &trainingSet{}
+	overlapping := make([]irange, 0, 8)
+	for {
+		v := vcf.Read()
+		if v == nil {
+			break
+		}
+		st := svtype(v)
+		if st == "BND" || len(v.Samples) <= si {
+			continue
+		}
+		s := v.Samples[si]
+		var ts *trainingSet
+		if isHet(s.GT) {
+			ts = het
+		} else if isHomAlt(s.GT) {
+			ts = hom
+		} else {
+			continue
+		}
+		cisum, err := getcisum(v)
+		if err != nil {
+			return err
+		}
+		x, ok := shqFeatures(s.Fields, cisum)
+		if !ok {
+			continue
+		}
+		start, end := int(v.Start()), int(v.End())
+		var y float64
+		Overlaps(truth, v.Chromosome, start, end, &overlapping)
+		for _, o := range overlapping {
+			if o.Ftype == st && reciprocal(start, end, o.Start, o.End, cli.MinOverlap) {
+				y = 1
+				break
+			}
+		}
+		ts.x = append(ts.x, x)
+		ts.y = append(ts.y, y)
+	}
+	if err := vcf.Error(); err != nil {
+		return shared.InputError(errors.Wrapf(err, "error reading %s", cli.VCF))
+	}
+
+	model := DefaultSHQConfig()
+	for _, g := range []struct {
+		name string
+		ts   *trainingSet
+		m    *shqModel
+	}{{"het", het, &model.Het}, {"hom-alt", hom, &model.HomAlt}} {
+		pos, neg := g.ts.counts()
+		shared.Slogger.Printf("%s calls: %d true, %d false", g.name, pos, neg)
+		if pos < minTrainClass || neg < minTrainClass {
+			shared.Slogger.Printf("too few %s calls to train. using default rules", g.name)
+			continue
+		}
+		*g.m = shqModel{Logistic: fitLogistic(g.ts)}
+	}
+
+	out, err := os.Create(cli.Out)
+	if err != nil {
+		return shared.InputError(err)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(model); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "error writing %s", cli.Out)
+	}
+	if err := out.Close(); err != nil {
+		return errors.Wrapf(err, "error writing %s", cli.Out)
+	}
+	shared.Slogger.Printf("wrote SHQ model to %s. use with: smoove annotate --shqmodel %s", cli.Out, cli.Out)
+	return nil
+}
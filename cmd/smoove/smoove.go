@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime/debug"
 	"strconv"
 
 	"github.com/brentp/smoove"
 	"github.com/brentp/smoove/annotate"
+	"github.com/brentp/smoove/cohort"
+	"github.com/brentp/smoove/doctor"
 	"github.com/brentp/smoove/duphold"
 	"github.com/brentp/smoove/hipstr"
 	"github.com/brentp/smoove/lumpy"
@@ -29,10 +32,15 @@ var progs = []progPair{
 	progPair{"merge", "merge and sort (using svtools) calls from multiple samples", merge.Main},
 	progPair{"genotype", "parallelize svtyper on an input VCF", svtyper.Main},
 	progPair{"paste", "square final calls from multiple samples (each with same number of variants)", paste.Main},
+	progPair{"cohort", "run call, merge, genotype, paste and annotate for the samples in a manifest", cohort.Main},
 	progPair{"plot-counts", "plot counts of split, discordant reads before, after smoove filtering", merge.PlotCountsMain},
 	progPair{"annotate", "annotate a VCF with gene and quality of SV call", annotate.Main},
+	progPair{"table", "write a tab-delimited table of variants (or carriers) from an annotated VCF", annotate.TableMain},
+	progPair{"train-shq", "fit the SHQ model used by annotate from calls on a sample with a truth-set", annotate.TrainMain},
+	progPair{"doctor", "check versions of required programs and TMPDIR space", doctor.Main},
 	progPair{"hipstr", "run hipSTR in parallel", hipstr.Main},
-	progPair{"duphold", "run duphold in parallel (this can be done by adding a flag to call or genotype)", duphold.Main},
+	progPair{"str", "genotype repeat expansions with ExpansionHunter in parallel", hipstr.StrMain},
+	progPair{"duphold", "annotate depth changes like duphold (this can be done by adding a flag to call or genotype)", duphold.Main},
 }
 
 func Description() string {
@@ -49,10 +57,13 @@ smoove calls several programs. Those with 'Y' are found on your $PATH. Only thos
  *[{{svtyper}}] svtyper
  *[{{mosdepth}}] mosdepth [extra filtering of split and discordant files for better scaling]
 
-  [{{duphold}}] duphold [(optional) annotate calls with depth changes]
+  [{{duphold}}] duphold [(optional) only needed for smoove duphold --external]
   [{{svtools}}] svtools [only needed for large cohorts].
 
+Run 'smoove doctor' to also check their versions.
+
 Available sub-commands are below. Each can be run with -h for additional help.
+All accept --log-format (text or json) and --log-level (debug, info, warn or error).
 
 `
 	t := fasttemplate.New(tmpl, "{{", "}}")
@@ -117,6 +128,23 @@ func main() {
 	}
 	// remove the prog name from the call
 	os.Args = append(os.Args[:1], os.Args[2:]...)
+	args, format, level, err := shared.LogFlags(os.Args[1:])
+	if err == nil {
+		err = shared.ConfigureLogging(format, level)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(shared.ExitInput)
+	}
+	os.Args = append(os.Args[:1], args...)
 	shared.Slogger.Printf("starting with version %s", smoove.Version)
+	shared.HandleSignals()
+	// errors are reported by each sub-command; anything that still panics is a bug.
+	defer func() {
+		if r := recover(); r != nil {
+			shared.Slogger.Printf("%v\n%s", r, debug.Stack())
+			shared.Fatal(fmt.Errorf("panic: %v", r))
+		}
+	}()
 	(*p).main()
 }
@@ -0,0 +1,265 @@
+// Package cohort runs the steps of population calling (call, merge, genotype, paste and annotate)
+// for the samples in a manifest.
+package cohort
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/smoove/annotate"
+	"github.com/brentp/smoove/lumpy"
+	"github.com/brentp/smoove/merge"
+	"github.com/brentp/smoove/paste"
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/smoove/svtyper"
+	"github.com/brentp/xopen"
+)
+
+type cliargs struct {
+	Name      string `arg:"-n,required,help:cohort name used in output files."`
+	Fasta     string `arg:"-f,required,help:fasta file."`
+	Exclude   string `arg:"-e,help:BED of exclude regions."`
+	GFF       string `arg:"-g,help:optional GFF for gene annotation of the final VCF."`
+	OutDir    string `arg:"-o,help:output directory."`
+	Jobs      int    `arg:"-j,help:number of samples to call or genotype at once."`
+	Processes int    `arg:"-p,help:number of processors for each sample and for each cohort step."`
+	DupHold   bool   `arg:"-d,help:run duphold when genotyping each sample."`
+	EmitJobs  string `arg:"--emit-jobs,help:write a job script for each step to this directory for a batch scheduler instead of running the steps."`
+	Manifest  string `arg:"positional,required,help:file with the path to a BAM or CRAM per line. a sample name and a tab may precede the path."`
+}
+
+func (c cliargs) Description() string {
+	return `this runs population calling for the samples in the manifest:
+  call each sample -> merge -> genotype each sample at the merged sites -> paste -> annotate
+steps that have completed are recorded in {outdir}/.done/ and skipped so a failed or interrupted run
+can be continued by running the same command. if any step is run, all of the steps that depend on it are also run.`
+}
+
+// sample is a line from the manifest.
+type sample struct {
+	name string
+	path string
+}
+
+// readManifest reads the samples from path. Blank lines and lines starting with # are skipped. The
+// sample name is taken from the read-group if it isn't given.
+func readManifest(path, fasta string) ([]sample, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	defer f.Close()
+	var samples []sample
+	seen := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		toks := strings.Split(line, "\t")
+		var s sample
+		switch len(toks) {
+		case 1:
+			s = sample{name: shared.SampleName(toks[0], fasta), path: toks[0]}
+		case 2:
+			s = sample{name: strings.TrimSpace(toks[0]), path: strings.TrimSpace(toks[1])}
+		default:
+			return nil, shared.Inputf("expected a path or a sample and a path on line %d of %s. got: %s", i, path, line)
+		}
+		if !xopen.Exists(s.path) {
+			return nil, shared.Inputf("%s from line %d of %s not found", s.path, i, path)
+		}
+		if p, ok := seen[s.name]; ok {
+			return nil, shared.Inputf("sample %s is in %s for both %s and %s", s.name, path, p, s.path)
+		}
+		seen[s.name] = s.path
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, shared.InputError(err)
+	}
+	if len(samples) == 0 {
+		return nil, shared.Inputf("no samples found in %s", path)
+	}
+	return samples, nil
+}
+
+// step is a smoove sub-command run for the cohort.
+type step struct {
+	// id is unique to the step (e.g. call-NA12878) and is used for its done file and job script.
+	id     string
+	cmd    string
+	args   []string
+	run    func([]string) error
+	output string
+}
+
+// stages returns the steps for the samples in the order that they must be run. The steps within
+// a stage are independent.
+func stages(cli cliargs, samples []sample) [][]step {
+	p := strconv.Itoa(cli.Processes)
+	called := filepath.Join(cli.OutDir, "called")
+	genotyped := filepath.Join(cli.OutDir, "genotyped")
+	sites := filepath.Join(cli.OutDir, cli.Name+".sites.vcf.gz")
+	square := filepath.Join(cli.OutDir, cli.Name+".smoove.square.vcf.gz")
+
+	var calls, genotypes []step
+	var callVCFs, genotypedVCFs []string
+	for _, s := range samples {
+		out := filepath.Join(called, s.name+"-smoove.genotyped.vcf.gz")
+		args := []string{"--outdir", called, "--name", s.name, "--fasta", cli.Fasta, "-p", p, "--genotype"}
+		if cli.Exclude != "" {
+			args = append(args, "--exclude", cli.Exclude)
+		}
+		calls = append(calls, step{id: "call-" + s.name, cmd: "call", args: append(args, s.path), run: lumpy.Call, output: out})
+		callVCFs = append(callVCFs, out)
+
+		out = filepath.Join(genotyped, s.name+"-joint-smoove.genotyped.vcf.gz")
+		args = []string{"-x", "-p", p, "--name", s.name + "-joint", "--outdir", genotyped, "--fasta", cli.Fasta, "--vcf", sites}
+		if cli.DupHold {
+			args = append(args, "-d")
+		}
+		genotypes = append(genotypes, step{id: "genotype-" + s.name, cmd: "genotype", args: append(args, s.path), run: svtyper.Run, output: out})
+		genotypedVCFs = append(genotypedVCFs, out)
+	}
+
+	mergeStep := step{id: "merge", cmd: "merge", run: merge.Run, output: sites,
+		args: append([]string{"--name", cli.Name, "--fasta", cli.Fasta, "--outdir", cli.OutDir}, callVCFs...)}
+	pasteStep := step{id: "paste", cmd: "paste", run: paste.Run, output: square,
+		args: append([]string{"--name", cli.Name, "--outdir", cli.OutDir}, genotypedVCFs...)}
+	anno := filepath.Join(cli.OutDir, cli.Name+".smoove.square.anno.vcf.gz")
+	args := []string{"-p", p, "-o", anno}
+	if cli.GFF != "" {
+		args = append(args, "--gff", cli.GFF)
+	}
+	annotateStep := step{id: "annotate", cmd: "annotate", run: annotate.Run, output: anno, args: append(args, square)}
+
+	return [][]step{calls, {mergeStep}, genotypes, {pasteStep}, {annotateStep}}
+}
+
+func (s step) donePath(outdir string) string {
+	return filepath.Join(outdir, ".done", s.id)
+}
+
+// complete reports whether the step has finished and its output still exists.
+func (s step) complete(outdir string) bool {
+	return xopen.Exists(s.donePath(outdir)) && xopen.Exists(s.output)
+}
+
+// runStages runs each stage with at most jobs steps at once. Complete steps are skipped unless a
+// step in an earlier stage was run.
+func runStages(cli cliargs, stages [][]step) error {
+	if err := os.MkdirAll(filepath.Join(cli.OutDir, ".done"), 0755); err != nil {
+		return shared.InputError(err)
+	}
+	var ran bool
+	for _, st := range stages {
+		jobs := make([]shared.Job, 0, len(st))
+		for _, s := range st {
+			log := shared.Slogger.With("stage", s.cmd)
+			if !ran && s.complete(cli.OutDir) {
+				log.Printf("skipping %s. %s is complete", s.id, s.output)
+				continue
+			}
+			s := s
+			os.Remove(s.donePath(cli.OutDir))
+			jobs = append(jobs, shared.Job{Name: s.id, Log: log, Done: func() error {
+				log.Printf("running smoove %s %s", s.cmd, shared.Quote(s.args...))
+				if err := s.run(s.args); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(s.donePath(cli.OutDir), []byte(shared.Quote(s.args...)+"\n"), 0644)
+			}})
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+		ran = true
+		if err := shared.Run(context.Background(), cli.Jobs, shared.Jobs(jobs...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitJobs writes a script for each step to dir along with jobs.tsv which lists the stage, id and
+// script of each step. Each script must be run after all of the scripts of the previous stage.
+func emitJobs(cli cliargs, stages [][]step, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return shared.InputError(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "smoove"
+	}
+	// paths in the manifest and arguments may be relative.
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	tsv, err := os.Create(filepath.Join(dir, "jobs.tsv"))
+	if err != nil {
+		return shared.InputError(err)
+	}
+	defer tsv.Close()
+	fmt.Fprintln(tsv, "#stage\tid\tscript")
+	for i, st := range stages {
+		for _, s := range st {
+			path, err := filepath.Abs(filepath.Join(dir, fmt.Sprintf("%d-%s.sh", i+1, s.id)))
+			if err != nil {
+				return err
+			}
+			var b strings.Builder
+			fmt.Fprintf(&b, "#!/bin/bash\n# stage %d of %d for cohort %s.", i+1, len(stages), cli.Name)
+			if i > 0 {
+				fmt.Fprintf(&b, " run after every script from stage %d has finished.", i)
+			}
+			b.WriteString("\n")
+			fmt.Fprintf(&b, "set -euo pipefail\ncd %s\n", shared.Quote(wd))
+			fmt.Fprintf(&b, "%s\n", shared.Quote(append([]string{exe, s.cmd}, s.args...)...))
+			fmt.Fprintf(&b, "mkdir -p %s\n", shared.Quote(filepath.Dir(s.donePath(cli.OutDir))))
+			fmt.Fprintf(&b, "touch %s\n", shared.Quote(s.donePath(cli.OutDir)))
+			if err := ioutil.WriteFile(path, []byte(b.String()), 0755); err != nil {
+				return shared.InputError(err)
+			}
+			fmt.Fprintf(tsv, "%d\t%s\t%s\n", i+1, s.id, path)
+		}
+	}
+	shared.Slogger.Printf("wrote job scripts and %s", tsv.Name())
+	return tsv.Close()
+}
+
+func Main() {
+	cli := cliargs{OutDir: "./", Jobs: 1, Processes: 3}
+	arg.MustParse(&cli)
+	runtime.GOMAXPROCS(cli.Processes)
+	err := cohort(cli)
+	if rerr := shared.WriteReport(filepath.Join(cli.OutDir, cli.Name+"-smoove.run.json")); rerr != nil {
+		shared.Slogger.Warnf("couldn't write run report: %s", rerr)
+	}
+	if err != nil {
+		shared.Fatal(err)
+	}
+}
+
+func cohort(cli cliargs) error {
+	samples, err := readManifest(cli.Manifest, cli.Fasta)
+	if err != nil {
+		return err
+	}
+	shared.Slogger.Printf("read %d samples from %s", len(samples), cli.Manifest)
+	st := stages(cli, samples)
+	if cli.EmitJobs != "" {
+		return emitJobs(cli, st, cli.EmitJobs)
+	}
+	return runStages(cli, st)
+}
@@ -0,0 +1,87 @@
+package cohort
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCohort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-cohort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.bam", "b.bam"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := filepath.Join(dir, "manifest.txt")
+	ioutil.WriteFile(manifest, []byte("# samples\nA\t"+filepath.Join(dir, "a.bam")+"\n\nB\t"+filepath.Join(dir, "b.bam")+"\n"), 0644)
+	samples, err := readManifest(manifest, "ref.fa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || samples[1].name != "B" {
+		t.Fatalf("unexpected samples: %v", samples)
+	}
+	ioutil.WriteFile(manifest, []byte("A\t"+filepath.Join(dir, "a.bam")+"\nA\t"+filepath.Join(dir, "b.bam")+"\n"), 0644)
+	if _, err := readManifest(manifest, "ref.fa"); err == nil {
+		t.Errorf("expected error for duplicate sample")
+	}
+
+	cli := cliargs{Name: "c", Fasta: "ref.fa", OutDir: dir, Jobs: 2, Processes: 1}
+	st := stages(cli, samples)
+	// steps in a stage run in parallel.
+	var mu sync.Mutex
+	var ran []string
+	for i := range st {
+		for j := range st[i] {
+			s := &st[i][j]
+			s.run = func([]string) error {
+				mu.Lock()
+				ran = append(ran, s.id)
+				mu.Unlock()
+				return ioutil.WriteFile(s.output, nil, 0644)
+			}
+		}
+	}
+	os.MkdirAll(filepath.Join(dir, "called"), 0755)
+	os.MkdirAll(filepath.Join(dir, "genotyped"), 0755)
+	if err := runStages(cli, st); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 7 {
+		t.Fatalf("expected 7 steps to run, got %v", ran)
+	}
+
+	// only the removed output and the steps after it are run again.
+	ran = ran[:0]
+	os.Remove(st[2][1].output)
+	if err := runStages(cli, st); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ran, ",") != "genotype-B,paste,annotate" {
+		t.Errorf("unexpected steps: %v", ran)
+	}
+
+	jobs := filepath.Join(dir, "jobs")
+	if err := emitJobs(cli, st, jobs); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(jobs, "3-genotype-A.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), " genotype -x -p 1 --name A-joint") || !strings.Contains(string(b), "touch "+filepath.Join(dir, ".done", "genotype-A")) {
+		t.Errorf("unexpected job script:\n%s", b)
+	}
+	b, _ = ioutil.ReadFile(filepath.Join(jobs, "jobs.tsv"))
+	if n := strings.Count(string(b), "\n"); n != 8 {
+		t.Errorf("expected a header and 7 jobs in jobs.tsv, got:\n%s", b)
+	}
+}
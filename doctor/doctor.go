@@ -0,0 +1,210 @@
+// Package doctor checks that the programs smoove uses are installed and recent enough and that
+// the temporary directory is usable.
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/smoove/shared"
+)
+
+type cliargs struct {
+	MinTmpGB float64 `arg:"--min-tmp-gb,help:minimum free space (in GB) required in TMPDIR."`
+}
+
+func (c cliargs) Description() string {
+	return "check the versions of the programs that smoove calls and that TMPDIR is writable with enough space"
+}
+
+// dep is a program that smoove calls. args are run to get the version (and usage if feature is set);
+// the output is matched against version and must contain feature.
+type dep struct {
+	name     string
+	required bool
+	args     []string
+	version  *regexp.Regexp
+	min      string
+	feature  string
+	hint     string
+}
+
+var deps = []dep{
+	{name: "bgzip", required: true, args: []string{"--version"}, version: regexp.MustCompile(`bgzip \(htslib\) (\S+)`),
+		hint: "install htslib (e.g. conda install -c bioconda htslib)"},
+	{name: "tabix", required: true, args: []string{"--version"}, version: regexp.MustCompile(`tabix \(htslib\) (\S+)`),
+		hint: "install htslib (e.g. conda install -c bioconda htslib)"},
+	{name: "gsort", required: true, hint: "download from https://github.com/brentp/gsort/releases"},
+	{name: "bcftools", required: true, args: []string{"--version"}, version: regexp.MustCompile(`bcftools (\S+)`), min: "1.5",
+		hint: "old versions of bcftools segfault on `bcftools view -O z -c 1`. update with conda install -c bioconda bcftools"},
+	{name: "samtools", required: true, args: []string{"--version"}, version: regexp.MustCompile(`samtools (\S+)`), min: "1.3",
+		hint: "--input-fmt-option is needed for CRAM. update with conda install -c bioconda samtools"},
+	{name: "lumpy", required: true, version: regexp.MustCompile(`\(v (\S+)\)`), min: "0.2.13",
+		hint: "build lumpy from source or use conda install -c bioconda lumpy-sv"},
+	{name: "lumpy_filter", required: true, feature: "threads",
+		hint: "lumpy_filter must accept a number of threads. build lumpy from source or use conda install -c bioconda lumpy-sv"},
+	{name: "mosdepth", required: true, args: []string{"--version"}, version: regexp.MustCompile(`mosdepth (\S+)`), min: "0.2.4",
+		hint: "--fast-mode requires mosdepth 0.2.4. update with conda install -c bioconda mosdepth"},
+	{name: "svtyper", required: true, args: []string{"-h"}, feature: "--max_ci_dist",
+		hint: "svtyper must support --max_ci_dist. update with pip install -U svtyper"},
+	{name: "svtools", args: []string{"--version"}, version: regexp.MustCompile(`svtools (\S+)`),
+		hint: "only needed for smoove merge. install with conda install -c bioconda svtools"},
+	{name: "duphold", hint: "only needed for smoove duphold --external"},
+	{name: "HipSTR", hint: "only needed for smoove hipstr"},
+	{name: "ExpansionHunter", hint: "only needed for smoove str"},
+}
+
+// result is the outcome of checking one dep. ok is false if it's missing or too old.
+type result struct {
+	dep
+	found   bool
+	version string
+	ok      bool
+	msg     string
+}
+
+// versionLess compares dotted versions numerically (e.g. 1.9 < 1.10). Non-numeric suffixes are ignored.
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(strings.TrimPrefix(a, "v"), "."), strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+func leadingInt(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	v, _ := strconv.Atoi(s[:i])
+	return v
+}
+
+// output runs the program and returns stdout and stderr. The exit status is ignored because many tools
+// exit non-zero after printing their usage.
+func output(name string, args []string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	out, _ := cmd.CombinedOutput()
+	return string(out)
+}
+
+func check(d dep) result {
+	r := result{dep: d, ok: true}
+	if _, err := exec.LookPath(d.name); err != nil {
+		r.ok = !d.required
+		r.msg = "not found on PATH"
+		return r
+	}
+	r.found = true
+	if d.version == nil && d.feature == "" {
+		return r
+	}
+	out := output(d.name, d.args)
+	if d.version != nil {
+		if m := d.version.FindStringSubmatch(out); m != nil {
+			r.version = m[1]
+		}
+		if d.min != "" {
+			if r.version == "" {
+				r.ok = false
+				r.msg = fmt.Sprintf("couldn't find the version (need >= %s)", d.min)
+				return r
+			}
+			if versionLess(r.version, d.min) {
+				r.ok = false
+				r.msg = fmt.Sprintf("version %s is older than %s", r.version, d.min)
+				return r
+			}
+		}
+	}
+	if d.feature != "" && !strings.Contains(out, d.feature) {
+		r.ok = false
+		r.msg = fmt.Sprintf("usage doesn't mention %s", d.feature)
+	}
+	return r
+}
+
+// checkTmp checks that a file can be written to dir and that it has at least minGB free.
+func checkTmp(dir string, minGB float64) (string, bool) {
+	f, err := ioutil.TempFile(dir, "smoove-doctor-")
+	if err != nil {
+		return fmt.Sprintf("can't write to TMPDIR %s: %s. set TMPDIR to a writable directory", dir, err), false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fmt.Sprintf("can't get free space for TMPDIR %s: %s", dir, err), false
+	}
+	gb := float64(uint64(st.Bavail)*uint64(st.Bsize)) / (1 << 30)
+	if gb < minGB {
+		return fmt.Sprintf("TMPDIR %s has %.1fGB free (need %.1fGB). set TMPDIR to something with more space, e.g. export TMPDIR=/path/to/big", dir, gb, minGB), false
+	}
+	return fmt.Sprintf("TMPDIR %s is writable with %.1fGB free", dir, gb), true
+}
+
+// Doctor writes a line for each check to w and returns the number of problems.
+func Doctor(w io.Writer, minTmpGB float64) int {
+	var problems int
+	for _, d := range deps {
+		r := check(d)
+		status := "ok"
+		switch {
+		case !r.ok:
+			status = "FAIL"
+			problems++
+		case !r.found || r.msg != "":
+			status = "--"
+		}
+		line := fmt.Sprintf("[%-4s] %s", status, d.name)
+		if r.version != "" {
+			line += " " + r.version
+		}
+		if d.min != "" {
+			line += fmt.Sprintf(" (need >= %s)", d.min)
+		}
+		if r.msg != "" {
+			line += ": " + r.msg + ". " + d.hint
+		}
+		fmt.Fprintln(w, line)
+	}
+	msg, ok := checkTmp(os.TempDir(), minTmpGB)
+	if ok {
+		fmt.Fprintf(w, "[%-4s] %s\n", "ok", msg)
+	} else {
+		fmt.Fprintf(w, "[%-4s] %s\n", "FAIL", msg)
+		problems++
+	}
+	return problems
+}
+
+func Main() {
+	cli := cliargs{MinTmpGB: 10}
+	arg.MustParse(&cli)
+	if n := Doctor(os.Stdout, cli.MinTmpGB); n > 0 {
+		fmt.Fprintf(os.Stderr, "smoove doctor found %d problem(s)\n", n)
+		os.Exit(shared.ExitDependency)
+	}
+}
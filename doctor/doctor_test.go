@@ -0,0 +1,68 @@
+package doctor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVersionLess(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		less bool
+	}{
+		{"1.9", "1.10", true},
+		{"1.10", "1.9", false},
+		{"0.2.3", "0.2.4", true},
+		{"0.2.4", "0.2.4", false},
+		{"v0.3.0", "0.2.13", false},
+		{"1.3", "1.3.1", true},
+		{"1.10-rc1", "1.10", false},
+	} {
+		if got := versionLess(c.a, c.b); got != c.less {
+			t.Errorf("%s < %s: expected %v", c.a, c.b, c.less)
+		}
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	dir := t.TempDir()
+	fakes := map[string]string{
+		"bcftools": "echo 'bcftools 1.2'",
+		"mosdepth": "echo 'mosdepth 0.2.6'",
+		"svtyper":  "echo 'usage: svtyper [-h] [--max_reads MAX_READS]' >&2; exit 1",
+		"samtools": "echo 'samtools 1.10'; echo 'Using htslib 1.10'",
+	}
+	for name, body := range fakes {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	var out bytes.Buffer
+	if n := Doctor(&out, 0); n == 0 {
+		t.Fatal("expected problems")
+	}
+	lines := make(map[string]string)
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		lines[strings.TrimSuffix(strings.Fields(l[len("[FAIL] "):])[0], ":")] = l
+	}
+	for name, want := range map[string]string{
+		"bcftools":        "[FAIL] bcftools 1.2 (need >= 1.5): version 1.2 is older than 1.5",
+		"mosdepth":        "[ok  ] mosdepth 0.2.6 (need >= 0.2.4)",
+		"samtools":        "[ok  ] samtools 1.10",
+		"svtyper":         "[FAIL] svtyper: usage doesn't mention --max_ci_dist",
+		"lumpy":           "[FAIL] lumpy (need >= 0.2.13): not found on PATH",
+		"ExpansionHunter": "[--  ] ExpansionHunter: not found on PATH",
+		"TMPDIR":          "[ok  ] TMPDIR",
+	} {
+		if !strings.HasPrefix(lines[name], want) {
+			t.Errorf("expected %q, got %q", want, lines[name])
+		}
+	}
+}
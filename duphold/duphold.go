@@ -1,13 +1,14 @@
 package duphold
 
 import (
-	"os/exec"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"runtime"
 	"strings"
-	"sync"
 
 	arg "github.com/alexflint/go-arg"
-	"github.com/brentp/go-athenaeum/tempclean"
 	"github.com/brentp/smoove/shared"
 )
 
@@ -15,40 +16,44 @@ type cliargs struct {
 	Fasta     string   `arg:"-f,required,help:fasta file."`
 	VCF       string   `arg:"-v,required,help:path to input SV VCF"`
 	Processes int      `arg:"-p,help:number of threads ot use."`
-	SNPs      string   `arg:"-s,help:optional path to SNP/Indel VCF containing these samples for annotation with allele balance."`
+	SNPs      string   `arg:"-s,help:optional path to SNP/Indel VCF containing these samples. het SNPs within deletions are used to check the deletion genotype."`
+	External  bool     `arg:"-x,help:run the duphold binary on each BAM and merge with bcftools instead of calculating depth changes in smoove."`
 	OutVCF    string   `arg:"-o,required,help:path to output SV VCF"`
 	Bams      []string `arg:"positional,required,help:paths to sample BAM/CRAMs"`
-}
-
-type pair struct {
-	bamPath string
-	i       int
+	DryRun    bool     `arg:"--dry-run,help:print the commands that would be run and exit without running them."`
 }
 
 func Main() {
 
 	cli := cliargs{Processes: runtime.GOMAXPROCS(0)}
 	arg.MustParse(&cli)
-	shared.Slogger.Printf("running duphold on %d files in %d processes", len(cli.Bams), cli.Processes)
-
-	ch := make(chan pair)
-	var wg sync.WaitGroup
-	wg.Add(len(cli.Bams))
-
-	go func() {
-		for i, b := range cli.Bams {
-			ch <- pair{b, i}
+	if cli.DryRun {
+		plan(shared.NewPlan(os.Stdout), cli)
+		return
+	}
+	if !cli.External {
+		shared.Slogger.Printf("calculating depth changes for %d files in %d processes", len(cli.Bams), cli.Processes)
+		if err := Annotate(cli.VCF, cli.OutVCF, cli.Fasta, cli.Bams, cli.SNPs, cli.Processes); err != nil {
+			shared.Fatal(err)
 		}
-		close(ch)
-	}()
+		shared.Slogger.Printf("finished duphold")
+		return
+	}
+	if err := external(cli); err != nil {
+		shared.Fatal(err)
+	}
+}
 
-	paths := make([]string, 0, len(cli.Bams))
-	ftype := "v"
-	if strings.HasSuffix(cli.OutVCF, "bcf") {
-		ftype = "b"
-	} else if strings.HasSuffix(cli.OutVCF, "vcf.gz") {
-		ftype = "z"
+// external runs the duphold binary on each BAM and merges the results with bcftools.
+func external(cli cliargs) error {
+	if shared.HasProg("duphold") != "Y" {
+		return shared.DependencyError(fmt.Errorf("duphold binary not found. install it or run without --external"))
 	}
+	shared.Slogger.Printf("running duphold on %d files in %d processes", len(cli.Bams), cli.Processes)
+	defer shared.BeginStage("duphold")()
+
+	paths := make([]string, 0, len(cli.Bams))
+	shared.RemoveOnExit(cli.OutVCF)
 	if len(cli.Bams) == 1 {
 		// if only a single bam, use the outfile directly.
 		paths = append(paths, cli.OutVCF)
@@ -56,73 +61,104 @@ func Main() {
 		// for > 1 bams, use tmp bcf files.
 
 		for _ = range cli.Bams {
-			t, err := tempclean.TempFile("dh", "smoove-duphold.bcf")
+			t, err := ioutil.TempFile("", "smoove-duphold-*.bcf")
 			if err != nil {
-				panic(err)
+				return err
 			}
 			t.Close()
+			shared.RemoveOnExit(t.Name())
 			paths = append(paths, t.Name())
 		}
 	}
 
+	t, procs := threads(cli.Processes, len(cli.Bams))
+	cli.Processes = procs
+	jobs := make([]shared.Job, 0, len(cli.Bams))
+	for i, b := range cli.Bams {
+		sampleBcf := paths[i]
+		jobs = append(jobs, shared.Job{Name: b,
+			Log:     shared.Slogger.With("sample", shared.SampleName(b, cli.Fasta), "stage", "duphold"),
+			Cmds:    dupholdCmds(cli, t, b, sampleBcf),
+			Cleanup: func() { os.Remove(sampleBcf); os.Remove(sampleBcf + ".csi") },
+		})
+	}
+	if err := shared.Run(context.Background(), cli.Processes, shared.Jobs(jobs...)); err != nil {
+		return err
+	}
+	if len(cli.Bams) > 1 {
+		shared.Slogger.Printf("starting bcftools merge")
+		cmd := shared.Command("bcftools", mergeArgs(cli.OutVCF, paths)...)
+		shared.LogOutput(cmd, shared.Slogger.With("stage", "duphold", "tool", "bcftools"))
+		if err := shared.RunCmd(cmd); err != nil {
+			return shared.ToolError("bcftools merge", err)
+		}
+		for _, p := range paths {
+			os.Remove(p)
+			os.Remove(p + ".csi")
+			shared.Keep(p)
+		}
+	}
+	shared.Keep(cli.OutVCF)
+	shared.Slogger.Printf("finished duphold")
+	return nil
+}
+
+// threads returns the number of threads for each duphold process and the number of processes to
+// run at once.
+func threads(procs, nbams int) (string, int) {
 	var t = "1"
-	if cli.Processes > len(cli.Bams) {
+	if procs > nbams {
 		t = "2"
-		if cli.Processes > 2*len(cli.Bams) {
+		if procs > 2*nbams {
 			t = "3"
 		}
-		cli.Processes = len(cli.Bams)
+		procs = nbams
 	}
-	cmds := make([]*exec.Cmd, 0, 20)
-	mu := sync.RWMutex{}
-	for i := 0; i < cli.Processes; i++ {
-		go func() {
-			for b := range ch {
-				sampleBcf := paths[b.i]
-				args := []string{"-d", "-t", t, "-o", sampleBcf, "-f", cli.Fasta, "-b", b.bamPath, "-v", cli.VCF}
-				if cli.SNPs != "" {
-					args = append(args, []string{"-s", cli.SNPs}...)
-				}
-				cmd := exec.Command("duphold", args...)
-				cmd.Stderr = shared.Slogger
-				cmd.Stdout = shared.Slogger
-				mu.Lock()
-				cmds = append(cmds, cmd)
-				mu.Unlock()
-				if err := cmd.Run(); err != nil {
-					mu.Lock()
-					for _, c := range cmds {
-						if c != nil {
-							c.Process.Kill()
-						}
-					}
-					tempclean.Fatalf("%s", err)
-					mu.Unlock()
-				}
-				cmd = exec.Command("bcftools", "index", "--csi", "--threads", t, sampleBcf)
-				cmd.Stderr = shared.Slogger
-				cmd.Stdout = shared.Slogger
-				if err := cmd.Run(); err != nil {
-					tempclean.Fatalf("%s", err)
-				}
-				wg.Done()
-			}
-		}()
+	return t, procs
+}
+
+// dupholdCmds runs duphold on bam and indexes the output.
+func dupholdCmds(cli cliargs, t, bam, out string) [][]string {
+	args := []string{"duphold", "-d", "-t", t, "-o", out, "-f", cli.Fasta, "-b", bam, "-v", cli.VCF}
+	if cli.SNPs != "" {
+		args = append(args, []string{"-s", cli.SNPs}...)
 	}
-	wg.Wait()
-	if len(cli.Bams) > 1 {
-		shared.Slogger.Printf("starting bcftools merge")
-		args := []string{"merge", "--threads", "3", "-o", cli.OutVCF, "-O", ftype}
-		args = append(args, paths...)
+	return [][]string{args, {"bcftools", "index", "-f", "--csi", "--threads", t, out}}
+}
+
+// mergeArgs are the arguments to bcftools to merge the per-sample outputs to out.
+func mergeArgs(out string, paths []string) []string {
+	ftype := "v"
+	if strings.HasSuffix(out, "bcf") {
+		ftype = "b"
+	} else if strings.HasSuffix(out, "vcf.gz") {
+		ftype = "z"
+	}
+	return append([]string{"merge", "--threads", "3", "-o", out, "-O", ftype}, paths...)
+}
 
-		cmd := exec.Command("bcftools", args...)
-		cmd.Stderr = shared.Slogger
-		cmd.Stdout = shared.Slogger
-		if err := cmd.Run(); err != nil {
-			tempclean.Fatalf("%s", err)
-		} else {
-			tempclean.Cleanup()
+// plan writes the commands that duphold would run.
+func plan(p *shared.Plan, cli cliargs) {
+	p.Step("duphold: annotate %s with depth changes and write %s", cli.VCF, cli.OutVCF)
+	if !cli.External {
+		p.Note("calculates depth changes for %d files in %d processes", len(cli.Bams), cli.Processes)
+		return
+	}
+	t, procs := threads(cli.Processes, len(cli.Bams))
+	p.Note("runs %d of these at a time", procs)
+	paths := []string{cli.OutVCF}
+	if len(cli.Bams) > 1 {
+		paths = paths[:0]
+		for i := range cli.Bams {
+			paths = append(paths, fmt.Sprintf("$TMPDIR/smoove-duphold-%d.bcf", i+1))
 		}
 	}
-	shared.Slogger.Printf("finished duphold")
+	for i, b := range cli.Bams {
+		for _, c := range dupholdCmds(cli, t, b, paths[i]) {
+			p.Cmd(c...)
+		}
+	}
+	if len(cli.Bams) > 1 {
+		p.Cmd(append([]string{"bcftools"}, mergeArgs(cli.OutVCF, paths)...)...)
+	}
 }
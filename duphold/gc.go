@@ -0,0 +1,98 @@
+package duphold
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/brentp/xopen"
+)
+
+// window is the size of the bins used for GC content and for the expected depth used by DHBFC.
+const window = 250
+
+// noGC marks windows with too many Ns to have a useful GC content.
+const noGC = 255
+
+// readGC returns the GC percent of each window for every chromosome in chroms.
+func readGC(path string, chroms map[string]bool) (map[string][]uint8, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gcs := make(map[string][]uint8, len(chroms))
+	var cur []uint8
+	var name string
+	var use bool
+	// counts for the current window.
+	var gc, n, i int
+	flush := func() {
+		if i == 0 {
+			return
+		}
+		if n*10 > i {
+			cur = append(cur, noGC)
+		} else {
+			cur = append(cur, uint8(100*gc/(i-n)))
+		}
+		gc, n, i = 0, 0, 0
+	}
+	for {
+		line, err := f.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 && line[0] == '>' {
+			if use {
+				flush()
+				gcs[name] = cur
+			}
+			name = ""
+			if toks := bytes.Fields(line[1:]); len(toks) > 0 {
+				name = string(toks[0])
+			}
+			use = chroms[name]
+			cur = nil
+			gc, n, i = 0, 0, 0
+		} else if use {
+			for _, c := range line {
+				switch c {
+				case 'G', 'C', 'g', 'c', 'S', 's':
+					gc++
+				case 'N', 'n':
+					n++
+				}
+				i++
+				if i == window {
+					flush()
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if use {
+		flush()
+		gcs[name] = cur
+	}
+	return gcs, nil
+}
+
+// eventGC returns the mean GC percent of the windows overlapping [start, end) or noGC if they are all Ns.
+func eventGC(gcs []uint8, start, end int) int {
+	var s, n int
+	for w := start / window; w <= (end-1)/window && w < len(gcs); w++ {
+		if gcs[w] == noGC {
+			continue
+		}
+		s += int(gcs[w])
+		n++
+	}
+	if n == 0 {
+		return noGC
+	}
+	return (s + n/2) / n
+}
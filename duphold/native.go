@@ -0,0 +1,468 @@
+package duphold
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+)
+
+// flank is the number of bases on either side of an event used for DHFFC and DHSP.
+const flank = 1000
+
+// minBinWindows is the number of windows with a given GC content needed to use them as the expected depth for DHBFC.
+const minBinWindows = 20
+
+// maxDepth bounds the histogram used for medians; higher depths are counted as maxDepth-1.
+const maxDepth = 4096
+
+type event struct {
+	start, end int
+	// i is the index of the variant in the VCF.
+	i int
+}
+
+type depthResult struct {
+	ffc, bfc float64
+	sp       int
+	ok       bool
+}
+
+func (d depthResult) set(fields map[string]string) {
+	if !d.ok {
+		return
+	}
+	fields["DHFFC"] = fmtRatio(d.ffc)
+	fields["DHBFC"] = fmtRatio(d.bfc)
+	fields["DHSP"] = strconv.Itoa(d.sp)
+}
+
+func fmtRatio(v float64) string {
+	if v < 0 {
+		return "."
+	}
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+type depthAnnotator struct {
+	fasta string
+	// events and their start positions are sorted by start for each chromosome.
+	events map[string][]event
+	starts map[string][]int
+	gc     map[string][]uint8
+	n      int
+}
+
+// isDepthEvent is true for variants where a change in depth is meaningful.
+func isDepthEvent(v *vcfgo.Variant) bool {
+	t, err := v.Info().Get("SVTYPE")
+	if err != nil {
+		return false
+	}
+	st, _ := t.(string)
+	return st != "BND" && st != "INS" && int(v.End()) > int(v.Start())
+}
+
+func newDepthAnnotator(variants []*vcfgo.Variant, fasta string) (*depthAnnotator, error) {
+	a := &depthAnnotator{fasta: fasta, events: make(map[string][]event, 24), starts: make(map[string][]int, 24), n: len(variants)}
+	chroms := make(map[string]bool, 24)
+	for i, v := range variants {
+		if !isDepthEvent(v) {
+			continue
+		}
+		a.events[v.Chromosome] = append(a.events[v.Chromosome], event{start: int(v.Start()), end: int(v.End()), i: i})
+		chroms[v.Chromosome] = true
+	}
+	for c, evs := range a.events {
+		sort.Slice(evs, func(i, j int) bool { return evs[i].start < evs[j].start })
+		st := make([]int, len(evs))
+		for i, e := range evs {
+			st[i] = e.start
+		}
+		a.starts[c] = st
+	}
+	var err error
+	a.gc, err = readGC(fasta, chroms)
+	return a, err
+}
+
+// sampleName returns the SM of the first read-group or the file name if there is none.
+func sampleName(h *sam.Header, path string) string {
+	for _, rg := range h.RGs() {
+		if sm := rg.Get(sam.NewTag("SM")); sm != "" {
+			return sm
+		}
+	}
+	b := filepath.Base(path)
+	return strings.TrimSuffix(b, filepath.Ext(b))
+}
+
+const skipFlags = sam.Unmapped | sam.Secondary | sam.QCFail | sam.Duplicate | sam.Supplementary
+
+// depths reads the alignments in path once and returns the sample name and a result for each variant.
+func (a *depthAnnotator) depths(path string, threads int) (string, []depthResult, error) {
+	br, err := shared.Open(path, threads, a.fasta)
+	if err != nil {
+		return "", nil, err
+	}
+	defer br.Close()
+	sample := sampleName(br.Header(), path)
+	res := make([]depthResult, a.n)
+	hist := make([]int, maxDepth)
+
+	var cur *sam.Reference
+	var depth []int32
+	var evs []event
+	var starts []int
+	var sp []int
+	finish := func() {
+		if cur != nil && len(evs) > 0 {
+			a.finish(depth, a.gc[cur.Name()], evs, sp, res, hist)
+		}
+	}
+
+	for {
+		r, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sample, nil, fmt.Errorf("error reading %s: %s", path, err)
+		}
+		if r.Ref != cur {
+			finish()
+			if r.Ref == nil {
+				// unmapped reads at the end of the file.
+				cur = nil
+				break
+			}
+			cur = r.Ref
+			evs, starts = a.events[cur.Name()], a.starts[cur.Name()]
+			if len(evs) > 0 {
+				depth = zeroed(depth, cur.Len()+1)
+				sp = make([]int, len(evs))
+			}
+		}
+		if len(evs) == 0 || r.Flags&skipFlags != 0 {
+			continue
+		}
+		pos := r.Pos
+		for _, co := range r.Cigar {
+			t := co.Type()
+			if t == sam.CigarMatch || t == sam.CigarEqual || t == sam.CigarMismatch {
+				if pos < len(depth) {
+					depth[pos]++
+					depth[imin(pos+co.Len(), len(depth)-1)]--
+				}
+			}
+			pos += co.Len() * t.Consumes().Reference
+		}
+		// count pairs with one read in the flank before an event and the mate in the flank after it.
+		if r.Flags&sam.Paired == 0 || r.Flags&sam.MateUnmapped != 0 || r.MateRef != r.Ref || r.MatePos <= r.Pos {
+			continue
+		}
+		for j := sort.SearchInts(starts, r.Pos+1); j < len(starts) && starts[j] <= r.Pos+flank; j++ {
+			if r.MatePos >= evs[j].end && r.MatePos < evs[j].end+flank {
+				sp[j]++
+			}
+		}
+	}
+	finish()
+	return sample, res, nil
+}
+
+func zeroed(d []int32, n int) []int32 {
+	if cap(d) < n {
+		return make([]int32, n)
+	}
+	d = d[:n]
+	for i := range d {
+		d[i] = 0
+	}
+	return d
+}
+
+// finish calculates the results for the events on a chromosome from the depth deltas.
+func (a *depthAnnotator) finish(depth []int32, gc []uint8, evs []event, sp []int, res []depthResult, hist []int) {
+	for i := 1; i < len(depth); i++ {
+		depth[i] += depth[i-1]
+	}
+	bins := gcBinMedians(depth, gc)
+
+	for j, e := range evs {
+		s, end := imax(0, e.start), imin(e.end, len(depth)-1)
+		if end <= s {
+			continue
+		}
+		emed := median(hist, depth[s:end])
+		fmed := median(hist, depth[imax(0, s-flank):s], depth[end:imin(len(depth), end+flank)])
+		r := depthResult{ffc: -1, bfc: -1, sp: sp[j], ok: true}
+		if fmed > 0 {
+			r.ffc = emed / fmed
+		}
+		if bmed := bins.expected(eventGC(gc, s, end)); bmed > 0 {
+			r.bfc = emed / bmed
+		}
+		res[e.i] = r
+	}
+}
+
+type gcBins struct {
+	medians [101]float64
+	counts  [101]int
+	// all is the median across all windows and is used when there are too few windows with a similar GC.
+	all float64
+}
+
+// gcBinMedians returns the median of the mean window depth for windows with each GC percent.
+func gcBinMedians(depth []int32, gc []uint8) *gcBins {
+	var vals [101][]float64
+	all := make([]float64, 0, len(depth)/window+1)
+	for w := 0; w < len(gc) && (w+1)*window <= len(depth); w++ {
+		var s int64
+		for _, d := range depth[w*window : (w+1)*window] {
+			s += int64(d)
+		}
+		m := float64(s) / window
+		all = append(all, m)
+		if gc[w] != noGC && gc[w] <= 100 {
+			vals[gc[w]] = append(vals[gc[w]], m)
+		}
+	}
+	b := &gcBins{all: fmedian(all)}
+	for i, v := range vals {
+		b.medians[i] = fmedian(v)
+		b.counts[i] = len(v)
+	}
+	return b
+}
+
+// expected returns the median depth for windows with the GC percent closest to gc with enough windows.
+func (b *gcBins) expected(gc int) float64 {
+	if gc == noGC {
+		return b.all
+	}
+	for d := 0; d <= 100; d++ {
+		for _, g := range []int{gc - d, gc + d} {
+			if g >= 0 && g <= 100 && b.counts[g] >= minBinWindows {
+				return b.medians[g]
+			}
+		}
+	}
+	return b.all
+}
+
+func fmedian(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	sort.Float64s(v)
+	return v[(len(v)-1)/2]
+}
+
+// median returns the (lower) median of the depths in ds using hist which must have length maxDepth.
+func median(hist []int, ds ...[]int32) float64 {
+	for i := range hist {
+		hist[i] = 0
+	}
+	var n int
+	for _, d := range ds {
+		for _, v := range d {
+			if v >= maxDepth {
+				v = maxDepth - 1
+			} else if v < 0 {
+				v = 0
+			}
+			hist[v]++
+		}
+		n += len(d)
+	}
+	if n == 0 {
+		return 0
+	}
+	half := (n + 1) / 2
+	var c int
+	for i, k := range hist {
+		c += k
+		if c >= half {
+			return float64(i)
+		}
+	}
+	return maxDepth - 1
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Annotate adds DHFFC, DHBFC and DHSP to each sample in bams for the variants in vcfPath and writes the
+// result to outPath. Each alignment file is read once and no intermediate files are written.
+// If snps is not empty, deletions are also checked for SNP zygosity (see setZygosity).
+func Annotate(vcfPath, outPath, fasta string, bams []string, snps string, procs int) error {
+	defer shared.BeginStage("duphold")()
+	f, err := xopen.Ropen(vcfPath)
+	if err != nil {
+		return shared.InputError(err)
+	}
+	defer f.Close()
+	vcf, err := vcfgo.NewReader(f, true)
+	if err != nil {
+		return shared.Inputf("error reading %s: %s", vcfPath, err)
+	}
+	variants := make([]*vcfgo.Variant, 0, 4096)
+	for {
+		v := vcf.Read()
+		if v == nil {
+			break
+		}
+		variants = append(variants, v)
+	}
+	if err := vcf.Error(); err != nil {
+		shared.Slogger.Warnf("reading %s: %s", vcfPath, err)
+	}
+
+	a, err := newDepthAnnotator(variants, fasta)
+	if err != nil {
+		return shared.Inputf("error reading GC content from %s: %s", fasta, err)
+	}
+
+	if procs < 1 {
+		procs = 1
+	}
+	threads := 1
+	if procs > len(bams) {
+		threads = procs / len(bams)
+	}
+	cols := make(map[string]int, len(vcf.Header.SampleNames))
+	for i, s := range vcf.Header.SampleNames {
+		cols[s] = i
+	}
+
+	type sampleResult struct {
+		col int
+		res []depthResult
+	}
+	results := make([]sampleResult, len(bams))
+	errs := make([]error, len(bams))
+	ch := make(chan int, len(bams))
+	for i := range bams {
+		ch <- i
+	}
+	close(ch)
+	var wg sync.WaitGroup
+	for k := 0; k < imin(procs, len(bams)); k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				sample, res, err := a.depths(bams[i], threads)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				col, ok := cols[sample]
+				if !ok {
+					errs[i] = shared.Inputf("sample %s from %s not found in %s", sample, bams[i], vcfPath)
+					continue
+				}
+				results[i] = sampleResult{col: col, res: res}
+				shared.Slogger.With("sample", sample, "stage", "duphold").Printf("calculated depth changes")
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	var counts snpCounts
+	if snps != "" {
+		if counts, err = countSNPs(snps, variants, cols); err != nil {
+			return shared.Inputf("error reading SNPs from %s: %s", snps, err)
+		}
+		addZygosityHeader(vcf)
+	}
+
+	vcf.AddFormatToHeader("DHFFC", "1", "Float", "duphold depth fold-change for the variant relative to the flanking regions")
+	vcf.AddFormatToHeader("DHBFC", "1", "Float", "duphold depth fold-change for the variant relative to bins in the chromosome with similar GC-content")
+	vcf.AddFormatToHeader("DHSP", "1", "Integer", "duphold number of spanning read-pairs with one read in each flank of the event")
+
+	w, closer, err := shared.OpenOutput(outPath, procs)
+	if err != nil {
+		return err
+	}
+	if _, err := vcfgo.NewWriter(w, vcf.Header); err != nil {
+		return err
+	}
+	for i, v := range variants {
+		if err := vcf.Header.ParseSamples(v); err != nil {
+			shared.Slogger.Warnf("error parsing samples at %s:%d: %s", v.Chromosome, v.Pos, err)
+		}
+		for _, k := range []string{"DHFFC", "DHBFC", "DHSP"} {
+			if len(v.Samples) > 0 && !contains(v.Format, k) {
+				v.Format = append(v.Format, k)
+				for _, s := range v.Samples {
+					s.Fields[k] = "."
+				}
+			}
+		}
+		for _, r := range results {
+			if r.col < len(v.Samples) {
+				r.res[i].set(v.Samples[r.col].Fields)
+			}
+		}
+		if counts != nil && isDeletion(v) {
+			setZygosity(v, counts[i])
+		}
+		if _, err := fmt.Fprintln(w, v.String()); err != nil {
+			return err
+		}
+	}
+	return closer()
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, h := range haystack {
+		if h == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// AnnotateInPlace runs Annotate on a bgzipped VCF and replaces it (and its index) with the annotated output.
+func AnnotateInPlace(path, fasta string, bams []string, snps string, procs int) error {
+	tmp := strings.TrimSuffix(path, ".vcf.gz") + ".tmp.vcf.gz"
+	if err := Annotate(path, tmp, fasta, bams, snps, procs); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Remove(path + ".csi")
+	if xopen.Exists(tmp + ".csi") {
+		if err := os.Rename(tmp+".csi", path+".csi"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,246 @@
+package duphold
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/xopen"
+)
+
+func TestMedian(t *testing.T) {
+	hist := make([]int, maxDepth)
+	if m := median(hist, []int32{1, 5, 3}); m != 3 {
+		t.Errorf("expected 3, got %f", m)
+	}
+	if m := median(hist, []int32{1, 2}, []int32{8, 9}); m != 2 {
+		t.Errorf("expected lower median of 2, got %f", m)
+	}
+	if m := median(hist, []int32{maxDepth + 10}); m != maxDepth-1 {
+		t.Errorf("expected clipped median, got %f", m)
+	}
+}
+
+const testVCF = `##fileformat=VCFv4.2
+##contig=<ID=chr1,length=20000>
+##INFO=<ID=SVTYPE,Number=1,Type=String,Description="type">
+##INFO=<ID=END,Number=1,Type=Integer,Description="end">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	s1
+chr1	8000	1	N	<DEL>	.	.	SVTYPE=DEL;END=10000	GT	0/1
+chr1	14000	2	N	<DUP>	.	.	SVTYPE=DUP;END=15000	GT	0/0
+chr1	3000	3	N	<BND>	.	.	SVTYPE=BND	GT	0/0
+`
+
+// writeTestData writes a fasta, a VCF, and a BAM with a depth of 10 that is halved in the deletion.
+func writeTestData(t *testing.T, dir string) (fa, vcf, bpath string) {
+	const chromLen = 20000
+	fa = filepath.Join(dir, "ref.fa")
+	if err := ioutil.WriteFile(fa, []byte(">chr1 test\n"+strings.Repeat("ACGT", chromLen/4)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vcf = filepath.Join(dir, "sv.vcf")
+	if err := ioutil.WriteFile(vcf, []byte(testVCF), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := sam.NewReference("chr1", "", "", chromLen, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, err := sam.NewReadGroup("rg1", "", "", "", "", "", "", "s1", "", "", time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddReadGroup(rg); err != nil {
+		t.Fatal(err)
+	}
+	bpath = filepath.Join(dir, "s1.bam")
+	f, err := os.Create(bpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := bam.NewWriter(f, h, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := bytes.Repeat([]byte{'A'}, 100)
+	qual := bytes.Repeat([]byte{30}, 100)
+	write := func(pos, mpos int, flags sam.Flags) {
+		r, err := sam.NewRecord(fmt.Sprintf("r%d", pos), ref, ref, pos, mpos, mpos-pos+100, 60,
+			[]sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 100)}, seq, qual, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Flags = flags
+		if err := bw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pos := 0; pos < chromLen-100; pos += 10 {
+		if pos >= 7900 && pos < 10000 && pos%20 != 0 {
+			continue
+		}
+		write(pos, pos, 0)
+		if pos >= 7500 && pos < 7600 {
+			// pairs spanning the deletion.
+			write(pos, pos+2600, sam.Paired)
+		}
+	}
+	// duplicates are ignored.
+	for i := 0; i < 50; i++ {
+		write(14500, 14500, sam.Duplicate)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fa, vcf, bpath
+}
+
+func TestAnnotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-duphold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fa, vcf, bpath := writeTestData(t, dir)
+	out := filepath.Join(dir, "out.vcf")
+	if err := Annotate(vcf, out, fa, []string{bpath}, "", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	rdr, err := xopen.Ropen(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	var lines []string
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if line[0] != '#' {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 variants, got %d", len(lines))
+	}
+	get := func(line, key string) string {
+		toks := strings.Split(line, "\t")
+		for i, k := range strings.Split(toks[8], ":") {
+			if k == key {
+				return strings.Split(toks[9], ":")[i]
+			}
+		}
+		return ""
+	}
+	ratio := func(line, key string) float64 {
+		v, err := strconv.ParseFloat(get(line, key), 64)
+		if err != nil {
+			t.Fatalf("bad %s in %s: %s", key, line, err)
+		}
+		return v
+	}
+
+	if v := ratio(lines[0], "DHFFC"); v < 0.4 || v > 0.6 {
+		t.Errorf("expected DHFFC of ~0.5 for deletion, got %f", v)
+	}
+	if v := ratio(lines[0], "DHBFC"); v < 0.4 || v > 0.6 {
+		t.Errorf("expected DHBFC of ~0.5 for deletion, got %f", v)
+	}
+	if get(lines[0], "DHSP") != "10" {
+		t.Errorf("expected 10 spanning pairs, got %s", get(lines[0], "DHSP"))
+	}
+	if v := ratio(lines[1], "DHFFC"); v < 0.9 || v > 1.1 {
+		t.Errorf("expected DHFFC of ~1 for duplicates-only region, got %f", v)
+	}
+	if get(lines[2], "DHFFC") != "." {
+		t.Errorf("expected missing DHFFC for BND, got %s", get(lines[2], "DHFFC"))
+	}
+}
+
+func TestZygosity(t *testing.T) {
+	for _, c := range []struct {
+		gt []int
+		c  snpCount
+		z  int
+		ok bool
+	}{
+		{[]int{0, 0}, snpCount{het: 10}, 0, false},
+		{[]int{0, 1}, snpCount{het: 1, alt: 1}, 0, false},
+		{[]int{0, 1}, snpCount{het: 3, alt: 2}, zygosityImpossible, true},
+		{[]int{0, 1}, snpCount{het: 3, alt: 20}, zygosityOK, true},
+		{[]int{1, 1}, snpCount{het: 4}, zygosityImpossible, true},
+		{[]int{1, 1}, snpCount{alt: 5}, zygosityHomToHet, true},
+	} {
+		z, ok := zygosity(c.gt, c.c)
+		if z != c.z || ok != c.ok {
+			t.Errorf("%v %v: expected %d %v, got %d %v", c.gt, c.c, c.z, c.ok, z, ok)
+		}
+	}
+}
+
+func TestAnnotateSNPs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-duphold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fa, vcf, bpath := writeTestData(t, dir)
+	snps := filepath.Join(dir, "snps.vcf")
+	snpVCF := `##fileformat=VCFv4.2
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	other	s1
+chr1	5000	.	A	G	50	PASS	.	GT	0/1	0/1
+chr1	8500	.	A	G	50	PASS	.	GT	0/1	0/1
+chr1	9000	.	A	G	50	PASS	.	GT	0/0	0/1
+chr1	9100	.	A	G	50	LowQual	.	GT	0/0	0/1
+chr1	9200	.	A	GT	50	PASS	.	GT	0/0	0/1
+chr1	9500	.	C	T	50	PASS	.	GT	0/0	0|1
+`
+	if err := ioutil.WriteFile(snps, []byte(snpVCF), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.vcf")
+	if err := Annotate(vcf, out, fa, []string{bpath}, snps, 1); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("##FILTER=<ID=SNP_ZYGOSITY")) {
+		t.Errorf("expected SNP_ZYGOSITY filter in header")
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "chr1\t8000\t") {
+			continue
+		}
+		toks := strings.Split(line, "\t")
+		if toks[6] != "SNP_ZYGOSITY" {
+			t.Errorf("expected deletion to be filtered, got %s", toks[6])
+		}
+		if !strings.HasSuffix(toks[8], "DHSNP:DHZC") || !strings.HasSuffix(toks[9], ":3,0:1") {
+			t.Errorf("unexpected zygosity fields: %s %s", toks[8], toks[9])
+		}
+		return
+	}
+	t.Errorf("deletion not found in output")
+}
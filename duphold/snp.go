@@ -0,0 +1,211 @@
+package duphold
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+)
+
+// a deletion can not contain heterozygous SNPs: a het deletion leaves a single haplotype and
+// a hom-alt deletion leaves none. A deletion sample with at least minHetSNPs het SNPs that make
+// up at least minHetFraction of the non-reference SNPs is flagged as inconsistent.
+const minHetSNPs = 3
+const minHetFraction = 0.3
+
+// zygosity outcomes recorded in DHZC.
+const (
+	zygosityOK = iota
+	zygosityImpossible
+	zygosityHomToHet
+)
+
+const zygosityFilter = "SNP_ZYGOSITY"
+
+type snpCount struct {
+	het, alt uint16
+}
+
+type deletion struct {
+	start, end int
+	i          int
+}
+
+// snpCounts maps variant index to the het and hom-alt SNP counts for each sample column in the SV VCF.
+type snpCounts map[int][]snpCount
+
+func isDeletion(v *vcfgo.Variant) bool {
+	t, err := v.Info().Get("SVTYPE")
+	if err != nil {
+		return false
+	}
+	st, _ := t.(string)
+	return st == "DEL" && int(v.End()) > int(v.Start())
+}
+
+// countSNPs counts the het and hom-alt PASS biallelic SNPs in the path VCF that fall within each deletion
+// for samples that are also in the SV VCF. The SNP VCF must be sorted.
+func countSNPs(path string, variants []*vcfgo.Variant, cols map[string]int) (snpCounts, error) {
+	dels := make(map[string][]deletion, 24)
+	for i, v := range variants {
+		if isDeletion(v) {
+			dels[v.Chromosome] = append(dels[v.Chromosome], deletion{start: int(v.Start()), end: int(v.End()), i: i})
+		}
+	}
+	for _, ds := range dels {
+		sort.Slice(ds, func(i, j int) bool { return ds[i].start < ds[j].start })
+	}
+
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vcf, err := vcfgo.NewReader(f, true)
+	if err != nil {
+		return nil, err
+	}
+	// snpCols maps the sample index in the SNP VCF to the column in the SV VCF.
+	snpCols := make(map[int]int, len(cols))
+	for i, s := range vcf.Header.SampleNames {
+		if c, ok := cols[s]; ok {
+			snpCols[i] = c
+		}
+	}
+	if len(snpCols) == 0 {
+		shared.Slogger.Printf("no samples in common between %s and the SV VCF; not checking zygosity", path)
+	}
+
+	counts := make(snpCounts, 1024)
+	nsamples := len(cols)
+	var chrom string
+	var ds, active []deletion
+	var next int
+	for {
+		v := vcf.Read()
+		if v == nil {
+			break
+		}
+		if v.Chromosome != chrom {
+			chrom, ds, active, next = v.Chromosome, dels[v.Chromosome], active[:0], 0
+		}
+		if len(ds) == 0 || len(snpCols) == 0 {
+			continue
+		}
+		pos := int(v.Start())
+		for next < len(ds) && ds[next].start <= pos {
+			active = append(active, ds[next])
+			next++
+		}
+		k := 0
+		for _, d := range active {
+			if d.end > pos {
+				active[k] = d
+				k++
+			}
+		}
+		active = active[:k]
+		if len(active) == 0 || len(v.Reference) != 1 || len(v.Alternate) != 1 || len(v.Alternate[0]) != 1 || !(v.Filter == "PASS" || v.Filter == ".") {
+			continue
+		}
+		if err := vcf.Header.ParseSamples(v); err != nil {
+			continue
+		}
+		for si, col := range snpCols {
+			gt := v.Samples[si].GT
+			if len(gt) != 2 || gt[0] < 0 || gt[1] < 0 || gt[0]+gt[1] == 0 {
+				continue
+			}
+			for _, d := range active {
+				cs, ok := counts[d.i]
+				if !ok {
+					cs = make([]snpCount, nsamples)
+					counts[d.i] = cs
+				}
+				if gt[0] != gt[1] {
+					cs[col].het = incr(cs[col].het)
+				} else {
+					cs[col].alt = incr(cs[col].alt)
+				}
+			}
+		}
+	}
+	return counts, vcf.Error()
+}
+
+func incr(c uint16) uint16 {
+	if c == math.MaxUint16 {
+		return c
+	}
+	return c + 1
+}
+
+// zygosity returns the outcome for a deletion genotype given the SNPs within it and whether it could be checked.
+func zygosity(gt []int, c snpCount) (int, bool) {
+	if len(gt) != 2 || gt[0] < 0 || gt[1] < 0 || gt[0]+gt[1] == 0 {
+		return 0, false
+	}
+	n := int(c.het) + int(c.alt)
+	if n < minHetSNPs {
+		return 0, false
+	}
+	if int(c.het) >= minHetSNPs && float64(c.het)/float64(n) >= minHetFraction {
+		return zygosityImpossible, true
+	}
+	// reads with SNPs inside a hom-alt deletion mean that at least one haplotype is present.
+	if gt[0] == gt[1] {
+		return zygosityHomToHet, true
+	}
+	return zygosityOK, true
+}
+
+func addZygosityHeader(vcf *vcfgo.Reader) {
+	vcf.AddFormatToHeader("DHSNP", "2", "Integer", "duphold number of heterozygous and homozygous-alternate SNPs within the deletion")
+	vcf.AddFormatToHeader("DHZC", "1", "Integer", "duphold SNP zygosity check: 0==consistent 1==het SNPs are impossible with this deletion genotype 2==hom-alt changed to het because SNPs were called within the deletion")
+	vcf.Header.Filters[zygosityFilter] = "all non-reference samples checked had het SNPs within the deletion"
+}
+
+// setZygosity records the SNP counts and zygosity check for each sample and adds the filter if
+// every non-reference sample that could be checked is inconsistent.
+func setZygosity(v *vcfgo.Variant, cs []snpCount) {
+	if len(v.Samples) == 0 {
+		return
+	}
+	for _, k := range []string{"DHSNP", "DHZC"} {
+		if !contains(v.Format, k) {
+			v.Format = append(v.Format, k)
+		}
+	}
+	var checked, impossible int
+	for i, s := range v.Samples {
+		s.Fields["DHSNP"], s.Fields["DHZC"] = ".", "."
+		if cs == nil || i >= len(cs) {
+			continue
+		}
+		s.Fields["DHSNP"] = strconv.Itoa(int(cs[i].het)) + "," + strconv.Itoa(int(cs[i].alt))
+		z, ok := zygosity(s.GT, cs[i])
+		if !ok {
+			continue
+		}
+		s.Fields["DHZC"] = strconv.Itoa(z)
+		checked++
+		switch z {
+		case zygosityImpossible:
+			impossible++
+		case zygosityHomToHet:
+			s.GT = []int{0, 1}
+			s.Fields["GT"] = "0/1"
+		}
+	}
+	if checked > 0 && impossible == checked {
+		if v.Filter == "" || v.Filter == "." || v.Filter == "PASS" {
+			v.Filter = zygosityFilter
+		} else if !contains(strings.Split(v.Filter, ";"), zygosityFilter) {
+			v.Filter += ";" + zygosityFilter
+		}
+	}
+}
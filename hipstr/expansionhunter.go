@@ -0,0 +1,408 @@
+package hipstr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/xopen"
+)
+
+type eargs struct {
+	Catalog string   `arg:"-c,required,help:ExpansionHunter variant catalog JSON"`
+	Fasta   string   `arg:"-f,required,help:path to reference fasta file"`
+	Out     string   `arg:"-o,help:path to output VCF. if it ends with .gz it is written as BGZF and indexed. default is stdout."`
+	Sex     string   `arg:"help:sex of all samples sent to ExpansionHunter (female or male)."`
+	WorkDir string   `arg:"--workdir,help:directory to keep completed chunks in so that a failed run can be resumed by re-running the same command. removed on success."`
+	Retries int      `arg:"help:number of times to retry a chunk that fails before stopping."`
+	Bams    []string `arg:"positional,required,help:bams or crams in which to genotype the catalog loci"`
+}
+
+// StrMain is the entry-point for `smoove str`.
+func StrMain() {
+	cli := &eargs{Sex: "female", Retries: 1}
+	arg.MustParse(cli)
+	if cli.Sex != "female" && cli.Sex != "male" {
+		shared.Fatal(shared.Inputf("--sex must be female or male, got %s", cli.Sex))
+	}
+
+	w, closer, err := shared.OpenOutput(cli.Out, runtime.GOMAXPROCS(0))
+	if err != nil {
+		shared.Fatal(err)
+	}
+	if err := ExpansionHunter(cli, w); err != nil {
+		shared.Fatal(err)
+	}
+	if err := closer(); err != nil {
+		shared.Fatal(err)
+	}
+}
+
+func (args *eargs) manifestHeader() string {
+	return fmt.Sprintf("#smoove-str\tcatalog=%s\tfasta=%s\tsex=%s\tchunk=%d\tbams=%s", args.Catalog, args.Fasta, args.Sex, variantsPerRegion, strings.Join(args.Bams, ","))
+}
+
+// splitCatalog writes the loci in the catalog to files of variantsPerRegion loci in wd and returns their paths.
+func splitCatalog(catalog string, wd *workDir) ([]string, error) {
+	f, err := xopen.Ropen(catalog)
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	defer f.Close()
+	var loci []json.RawMessage
+	if err := json.NewDecoder(f).Decode(&loci); err != nil {
+		return nil, shared.Inputf("error reading variant catalog %s: %s", catalog, err)
+	}
+	if len(loci) == 0 {
+		return nil, shared.Inputf("no loci found in variant catalog %s", catalog)
+	}
+	var paths []string
+	for i := 0; i < len(loci); i += variantsPerRegion {
+		end := i + variantsPerRegion
+		if end > len(loci) {
+			end = len(loci)
+		}
+		b, err := json.MarshalIndent(loci[i:end], "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(wd.dir, fmt.Sprintf("catalog-%06d.json", len(paths)))
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// ehJob genotypes the catalog chunk in a single sample. k is the index of the sample and chunk in wd.
+func ehJob(args *eargs, bam string, catalog string, k int, wd *workDir) shared.Job {
+	vcf := wd.vcf(k)
+	prefix := strings.TrimSuffix(vcf, ".vcf")
+	clean := func() {
+		for _, suffix := range []string{".vcf", ".json", "_realigned.bam"} {
+			os.Remove(prefix + suffix)
+		}
+	}
+	return shared.Job{Name: fmt.Sprintf("%s (%s)", bam, filepath.Base(catalog)),
+		Log: shared.Slogger.With("sample", shared.SampleName(bam, args.Fasta), "stage", "str", "chunk", strings.TrimSuffix(filepath.Base(catalog), ".json")),
+		Cmds: [][]string{{"ExpansionHunter", "--reads", bam, "--reference", args.Fasta, "--variant-catalog", catalog,
+			"--sex", args.Sex, "--output-prefix", prefix}},
+		Retries: args.Retries,
+		Done: func() error {
+			// only the VCF is used.
+			os.Remove(prefix + ".json")
+			os.Remove(prefix + "_realigned.bam")
+			return wd.markDone(k)
+		},
+		Cleanup: clean,
+	}
+}
+
+// ExpansionHunter genotypes the loci in the variant catalog for each sample in chunks in parallel and
+// writes a single multi-sample VCF to wtr in the order of the catalog.
+func ExpansionHunter(args *eargs, wtr io.Writer) error {
+	if _, err := exec.LookPath("ExpansionHunter"); err != nil {
+		return shared.DependencyError(fmt.Errorf("error can't find ExpansionHunter executable"))
+	}
+	wd, err := openWorkDir(args.WorkDir, args.manifestHeader(), ".vcf")
+	if err != nil {
+		return err
+	}
+	catalogs, err := splitCatalog(args.Catalog, wd)
+	if err != nil {
+		wd.close(false)
+		return err
+	}
+	n := len(catalogs)
+	jobs := make(chan shared.Job)
+	go func() {
+		defer close(jobs)
+		for si, bam := range args.Bams {
+			for ci, c := range catalogs {
+				if k := si*n + ci; !wd.isDone(k) {
+					jobs <- ehJob(args, bam, c, k, wd)
+				}
+			}
+		}
+	}()
+	err = shared.Run(context.Background(), runtime.GOMAXPROCS(0), jobs)
+	if err == nil {
+		err = mergeSamples(args.Bams, n, wd, wtr)
+	}
+	for _, c := range catalogs {
+		os.Remove(c)
+	}
+	wd.close(err == nil)
+	if err == nil {
+		shared.Slogger.Printf("genotyped %d chunks of the catalog in %d samples", n, len(args.Bams))
+	}
+	return err
+}
+
+// ehRecord is a locus from a single-sample ExpansionHunter VCF.
+type ehRecord struct {
+	toks   []string
+	filter string
+}
+
+// ehChunk is the header and records of a single-sample ExpansionHunter VCF.
+type ehChunk struct {
+	header []string
+	sample string
+	keys   []string
+	recs   map[string]ehRecord
+}
+
+func readEHChunk(path string) (*ehChunk, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &ehChunk{recs: make(map[string]ehRecord)}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1<<24)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "##") {
+			c.header = append(c.header, line)
+			continue
+		}
+		toks := strings.Split(line, "\t")
+		if line[0] == '#' {
+			if len(toks) > 9 {
+				c.sample = toks[9]
+			}
+			continue
+		}
+		if len(toks) < 10 {
+			return nil, fmt.Errorf("expected a single sample in %s, got: %s", path, line)
+		}
+		// loci are identified by their position and the INFO which has the repeat unit and id.
+		key := toks[0] + "\t" + toks[1] + "\t" + toks[3] + "\t" + toks[7]
+		if _, ok := c.recs[key]; !ok {
+			c.keys = append(c.keys, key)
+		}
+		c.recs[key] = ehRecord{toks: toks, filter: toks[6]}
+	}
+	return c, s.Err()
+}
+
+// repeatCount returns n for a symbolic <STRn> allele.
+func repeatCount(alt string) (int, bool) {
+	if !strings.HasPrefix(alt, "<STR") || !strings.HasSuffix(alt, ">") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(alt[4 : len(alt)-1])
+	return n, err == nil
+}
+
+// mergeAlts returns the union of the alternate alleles sorted by repeat count.
+func mergeAlts(alts [][]string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, as := range alts {
+		for _, a := range as {
+			if !seen[a] {
+				seen[a] = true
+				merged = append(merged, a)
+			}
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		ni, oki := repeatCount(merged[i])
+		nj, okj := repeatCount(merged[j])
+		if oki && okj {
+			return ni < nj
+		}
+		return oki && !okj
+	})
+	return merged
+}
+
+// remapGT changes the allele indexes in gt from the sample's alts to the merged alts.
+func remapGT(gt string, alts []string, merged map[string]int) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(gt); i++ {
+		if i < len(gt) && gt[i] != '/' && gt[i] != '|' {
+			continue
+		}
+		tok := gt[start:i]
+		if a, err := strconv.Atoi(tok); err == nil && a > 0 && a <= len(alts) {
+			tok = strconv.Itoa(merged[alts[a-1]] + 1)
+		}
+		b.WriteString(tok)
+		if i < len(gt) {
+			b.WriteByte(gt[i])
+		}
+		start = i + 1
+	}
+	return b.String()
+}
+
+// mergeLocus combines the records for a locus from each sample. samples without a record are missing.
+func mergeLocus(recs []*ehRecord) string {
+	var first *ehRecord
+	alts := make([][]string, len(recs))
+	var format []string
+	fidx := make(map[string]bool)
+	for i, r := range recs {
+		if r == nil {
+			continue
+		}
+		if first == nil {
+			first = r
+		}
+		if r.toks[4] != "." {
+			alts[i] = strings.Split(r.toks[4], ",")
+		}
+		for _, k := range strings.Split(r.toks[8], ":") {
+			if !fidx[k] {
+				fidx[k] = true
+				format = append(format, k)
+			}
+		}
+	}
+	format = append(format, "FT")
+	merged := mergeAlts(alts)
+	midx := make(map[string]int, len(merged))
+	for i, a := range merged {
+		midx[a] = i
+	}
+
+	toks := append([]string{}, first.toks[:9]...)
+	toks[4] = "."
+	if len(merged) > 0 {
+		toks[4] = strings.Join(merged, ",")
+	}
+	toks[5] = "."
+	toks[8] = strings.Join(format, ":")
+	// the locus passes if any sample passes.
+	toks[6] = first.filter
+	for i, r := range recs {
+		if r == nil {
+			missing := make([]string, len(format))
+			for j := range missing {
+				missing[j] = "."
+			}
+			toks = append(toks, strings.Join(missing, ":"))
+			continue
+		}
+		if r.filter == "PASS" {
+			toks[6] = "PASS"
+		}
+		vals := make(map[string]string)
+		fields := strings.Split(r.toks[9], ":")
+		for j, k := range strings.Split(r.toks[8], ":") {
+			if j < len(fields) {
+				vals[k] = fields[j]
+			}
+		}
+		if gt, ok := vals["GT"]; ok {
+			vals["GT"] = remapGT(gt, alts[i], midx)
+		}
+		vals["FT"] = r.filter
+		out := make([]string, len(format))
+		for j, k := range format {
+			if v, ok := vals[k]; ok && v != "" {
+				out[j] = v
+			} else {
+				out[j] = "."
+			}
+		}
+		toks = append(toks, strings.Join(out, ":"))
+	}
+	return strings.Join(toks, "\t")
+}
+
+// mergeHeader returns the meta-information lines from the first chunk with the ALT lines from all chunks.
+func mergeHeader(chunks [][]string) []string {
+	var header []string
+	seen := make(map[string]bool)
+	for i, c := range chunks {
+		for _, line := range c {
+			if (i == 0 || strings.HasPrefix(line, "##ALT=")) && !seen[line] {
+				seen[line] = true
+				header = append(header, line)
+			}
+		}
+	}
+	return append(header, `##FORMAT=<ID=FT,Number=1,Type=String,Description="ExpansionHunter FILTER for the sample">`)
+}
+
+// mergeSamples writes the per-sample VCFs in wd as a single VCF with one column per sample.
+// It works one chunk at a time so that memory use doesn't grow with the size of the catalog.
+func mergeSamples(bams []string, n int, wd *workDir, wtr io.Writer) error {
+	// the header is first so the ALT lines from all chunks are read before any records.
+	var headers [][]string
+	names := make([]string, len(bams))
+	for si, bam := range bams {
+		for ci := 0; ci < n; ci++ {
+			c, err := readEHChunk(wd.vcf(si*n + ci))
+			if err != nil {
+				return err
+			}
+			headers = append(headers, c.header)
+			if ci == 0 {
+				names[si] = c.sample
+				if names[si] == "" {
+					names[si] = strings.TrimSuffix(filepath.Base(bam), filepath.Ext(bam))
+				}
+			}
+		}
+	}
+	w := bufio.NewWriter(wtr)
+	for _, line := range mergeHeader(headers) {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t"+strings.Join(names, "\t"))
+
+	for ci := 0; ci < n; ci++ {
+		chunks := make([]*ehChunk, len(bams))
+		var keys []string
+		seen := make(map[string]bool)
+		for si := range bams {
+			c, err := readEHChunk(wd.vcf(si*n + ci))
+			if err != nil {
+				return err
+			}
+			chunks[si] = c
+			for _, k := range c.keys {
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+		}
+		recs := make([]*ehRecord, len(bams))
+		for _, k := range keys {
+			for si, c := range chunks {
+				recs[si] = nil
+				if r, ok := c.recs[k]; ok {
+					recs[si] = &r
+				}
+			}
+			if _, err := fmt.Fprintln(w, mergeLocus(recs)); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,98 @@
+package hipstr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeExpansionHunter writes one call per catalog locus with an allele that depends on the sample.
+// LocusId L1 is not reported for sample b.
+const fakeExpansionHunter = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case $1 in
+		--reads) reads=$2; shift;;
+		--variant-catalog) catalog=$2; shift;;
+		--output-prefix) prefix=$2; shift;;
+	esac
+	shift
+done
+sample=$(basename $reads .bam)
+alt="<STR10>"
+if [ $sample = b ]; then alt="<STR12>"; fi
+{
+printf '##fileformat=VCFv4.1\n##ALT=<ID=%s,Description="Allele comprised of repeat units">\n' "$(echo $alt | tr -d '<>')"
+printf '#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t%s\n' $sample
+grep -o '"LocusId": "L[0-9]*"' $catalog | tr -dc '0-9\n' | while read i; do
+	if [ $sample = b ] && [ $i = 1 ]; then continue; fi
+	printf 'chr1\t%d\t.\tA\t%s\t.\tPASS\tEND=%d;REPID=L%d\tGT:REPCN\t0/1:5/10\n' $((i*100+1)) $alt $((i*100+30)) $i
+done
+} > $prefix.vcf
+echo '{}' > $prefix.json
+`
+
+func TestExpansionHunter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-str")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ExpansionHunter"), []byte(fakeExpansionHunter), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	n := variantsPerRegion + 3
+	var loci []string
+	for i := 0; i < n; i++ {
+		loci = append(loci, fmt.Sprintf(`{"LocusId": "L%d", "LocusStructure": "(CAG)*", "ReferenceRegion": "chr1:%d-%d", "VariantType": "Repeat"}`, i, i*100, i*100+30))
+	}
+	catalog := filepath.Join(dir, "catalog.json")
+	if err := ioutil.WriteFile(catalog, []byte("["+strings.Join(loci, ",\n")+"]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := ExpansionHunter(&eargs{Catalog: catalog, Fasta: "ref.fa", Sex: "female", Bams: []string{"a.bam", "b.bam"}}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []string
+	var header string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(line, "#CHROM") {
+			header = line
+		} else if line[0] != '#' {
+			recs = append(recs, line)
+		}
+	}
+	if !strings.HasSuffix(header, "FORMAT\ta\tb") {
+		t.Errorf("unexpected samples: %s", header)
+	}
+	if strings.Count(out.String(), "##ALT=") != 2 {
+		t.Errorf("expected ALT lines from both samples")
+	}
+	if len(recs) != n {
+		t.Fatalf("expected %d loci, got %d", n, len(recs))
+	}
+	for i, r := range recs {
+		toks := strings.Split(r, "\t")
+		if toks[1] != fmt.Sprint(i*100+1) {
+			t.Fatalf("out of order at %d: %s", i, toks[1])
+		}
+		if i == 1 {
+			if toks[4] != "<STR10>" || toks[10] != ".:.:." {
+				t.Errorf("expected missing call for b: %s", r)
+			}
+			continue
+		}
+		if toks[4] != "<STR10>,<STR12>" || toks[8] != "GT:REPCN:FT" || toks[9] != "0/1:5/10:PASS" || toks[10] != "0/2:5/10:PASS" {
+			t.Errorf("unexpected merged locus: %s", r)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package hipstr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/smoove/shared"
+)
+
+// filterArgs are the call and locus-level filters recommended for HipSTR output
+// (see HipSTR's filter_vcf.py). Filtered calls are set to missing; filtered loci get a FILTER.
+type filterArgs struct {
+	NoFilter          bool    `arg:"--no-filter,help:output raw HipSTR calls without filtering."`
+	MinCallQual       float64 `arg:"--min-call-qual,help:mask calls with a posterior quality (Q) below this."`
+	MaxCallFlankIndel float64 `arg:"--max-call-flank-indel,help:mask calls where more than this fraction of reads have an indel in the flanks."`
+	MaxCallStutter    float64 `arg:"--max-call-stutter,help:mask calls where more than this fraction of reads have a stutter artifact."`
+	MinCallAlleleBias float64 `arg:"--min-call-allele-bias,help:mask calls with an allele bias (log10 p-value) below this."`
+	MinCallStrandBias float64 `arg:"--min-call-strand-bias,help:mask calls with a strand bias (log10 p-value) below this."`
+	MinSpanReads      int     `arg:"--min-span-reads,help:mask calls with fewer than this many reads spanning the STR."`
+	MinLocCallRate    float64 `arg:"--min-loc-call-rate,help:filter loci where less than this fraction of samples have an unmasked call."`
+	MinLocHet         float64 `arg:"--min-loc-het,help:filter loci where less than this fraction of calls are heterozygous."`
+	MaxLocHet         float64 `arg:"--max-loc-het,help:filter loci where more than this fraction of calls are heterozygous."`
+}
+
+func defaultFilterArgs() filterArgs {
+	return filterArgs{MinCallQual: 0.9, MaxCallFlankIndel: 0.15, MaxCallStutter: 0.15, MinCallAlleleBias: -2, MinCallStrandBias: -2, MaxLocHet: 1}
+}
+
+// reasons a call is masked. the counts are reported at the end.
+var callFilters = [...]string{"quality", "flank-indel", "stutter", "allele-bias", "strand-bias", "spanning-reads"}
+
+const (
+	locCallRate = "LOW_CALL_RATE"
+	locHet      = "HET_RATE"
+)
+
+// filterer applies filterArgs and counts masked calls and filtered loci. It is not safe
+// for concurrent use; HipStr calls it with the output locked.
+type filterer struct {
+	filterArgs
+	calls    int
+	masked   [len(callFilters)]int
+	loci     int
+	locCalls int
+	locHets  int
+}
+
+// header returns the FILTER lines to add before the #CHROM line.
+func (f *filterer) header() string {
+	return fmt.Sprintf("##FILTER=<ID=%s,Description=\"fewer than %g of samples have an unmasked call\">\n", locCallRate, f.MinLocCallRate) +
+		fmt.Sprintf("##FILTER=<ID=%s,Description=\"fraction of heterozygous calls outside of [%g, %g]\">\n", locHet, f.MinLocHet, f.MaxLocHet) +
+		fmt.Sprintf("##smoove_hipstr_filters=min-call-qual:%g,max-call-flank-indel:%g,max-call-stutter:%g,min-call-allele-bias:%g,min-call-strand-bias:%g,min-span-reads:%d\n",
+			f.MinCallQual, f.MaxCallFlankIndel, f.MaxCallStutter, f.MinCallAlleleBias, f.MinCallStrandBias, f.MinSpanReads)
+}
+
+func fval(fields []string, i int) (float64, bool) {
+	if i < 0 || i >= len(fields) || fields[i] == "." || fields[i] == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(fields[i], 64)
+	return v, err == nil
+}
+
+// spanning returns the total number of reads in a MALLREADS field (allele|count;allele|count).
+func spanning(mall string) int {
+	var n int
+	for _, ac := range strings.Split(mall, ";") {
+		if p := strings.IndexByte(ac, '|'); p != -1 {
+			c, _ := strconv.Atoi(ac[p+1:])
+			n += c
+		}
+	}
+	return n
+}
+
+// maskReason returns the index in callFilters of the first filter that fails or -1.
+func (f *filterer) maskReason(fields []string, idx map[string]int) int {
+	key := func(k string) int {
+		if i, ok := idx[k]; ok {
+			return i
+		}
+		return -1
+	}
+	if q, ok := fval(fields, key("Q")); ok && q < f.MinCallQual {
+		return 0
+	}
+	if dp, ok := fval(fields, key("DP")); ok && dp > 0 {
+		if fi, ok := fval(fields, key("DFLANKINDEL")); ok && fi/dp > f.MaxCallFlankIndel {
+			return 1
+		}
+		if st, ok := fval(fields, key("DSTUTTER")); ok && st/dp > f.MaxCallStutter {
+			return 2
+		}
+	}
+	if ab, ok := fval(fields, key("AB")); ok && ab < f.MinCallAlleleBias {
+		return 3
+	}
+	if fs, ok := fval(fields, key("FS")); ok && fs < f.MinCallStrandBias {
+		return 4
+	}
+	if f.MinSpanReads > 0 {
+		if i := key("MALLREADS"); i >= 0 && i < len(fields) && spanning(fields[i]) < f.MinSpanReads {
+			return 5
+		}
+	}
+	return -1
+}
+
+func isHetGT(gt string) bool {
+	alleles := strings.FieldsFunc(gt, func(r rune) bool { return r == '/' || r == '|' })
+	if len(alleles) < 2 {
+		return false
+	}
+	for _, a := range alleles[1:] {
+		if a != alleles[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// line masks calls in a VCF variant line (without the newline) and sets the locus FILTER.
+func (f *filterer) line(line string) string {
+	toks := strings.Split(line, "\t")
+	if len(toks) < 10 {
+		return line
+	}
+	f.loci++
+	format := strings.Split(toks[8], ":")
+	idx := make(map[string]int, len(format))
+	for i, k := range format {
+		idx[k] = i
+	}
+	gti, hasGT := idx["GT"]
+	var called, hets int
+	for s := 9; s < len(toks); s++ {
+		fields := strings.Split(toks[s], ":")
+		if !hasGT || gti >= len(fields) || strings.HasPrefix(fields[gti], ".") {
+			continue
+		}
+		f.calls++
+		if r := f.maskReason(fields, idx); r != -1 {
+			f.masked[r]++
+			toks[s] = "."
+			continue
+		}
+		called++
+		if isHetGT(fields[gti]) {
+			hets++
+		}
+	}
+
+	var filters []string
+	if float64(called) < f.MinLocCallRate*float64(len(toks)-9) {
+		filters = append(filters, locCallRate)
+		f.locCalls++
+	}
+	if called > 0 {
+		h := float64(hets) / float64(called)
+		if h < f.MinLocHet || h > f.MaxLocHet {
+			filters = append(filters, locHet)
+			f.locHets++
+		}
+	}
+	if len(filters) > 0 {
+		if toks[6] != "." && toks[6] != "PASS" && toks[6] != "" {
+			filters = append([]string{toks[6]}, filters...)
+		}
+		toks[6] = strings.Join(filters, ";")
+	}
+	return strings.Join(toks, "\t")
+}
+
+// report logs the number of calls masked by each filter and the number of filtered loci.
+func (f *filterer) report() {
+	parts := make([]string, len(callFilters))
+	for i, name := range callFilters {
+		parts[i] = fmt.Sprintf("%s: %d", name, f.masked[i])
+	}
+	shared.Slogger.Printf("masked calls out of %d: %s", f.calls, strings.Join(parts, ", "))
+	shared.Slogger.Printf("filtered loci out of %d: %s: %d, %s: %d", f.loci, locCallRate,
+		f.locCalls, locHet, f.locHets)
+}
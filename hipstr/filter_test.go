@@ -0,0 +1,42 @@
+package hipstr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterLine(t *testing.T) {
+	f := &filterer{filterArgs: defaultFilterArgs()}
+	f.MinSpanReads = 5
+	f.MinLocCallRate = 0.5
+	fmt := "GT:GB:Q:PQ:DP:DSTUTTER:DFLANKINDEL:AB:FS:MALLREADS"
+	samples := []string{
+		"0|1:0|3:0.99:0.5:20:1:0:0:0:0|10;3|10",  // passes
+		"0|0:0|0:0.50:0.5:20:1:0:0:0:0|20",       // quality
+		"0|1:0|3:0.99:0.5:20:0:10:0:0:0|10;3|10", // flank indel
+		"0|1:0|3:0.99:0.5:20:5:0:0:0:0|10;3|10",  // stutter
+		"1|1:3|3:0.99:0.5:3:0:0:0:0:3|3",         // spanning reads
+		".",
+	}
+	line := "chr1\t100\tSTR1\tACACAC\tACACACAC\t.\tPASS\t.\t" + fmt + "\t" + strings.Join(samples, "\t")
+	toks := strings.Split(f.line(line), "\t")
+	if toks[9] != samples[0] {
+		t.Errorf("expected first call to pass, got %s", toks[9])
+	}
+	for i := 10; i < 14; i++ {
+		if toks[i] != "." {
+			t.Errorf("expected sample %d to be masked, got %s", i-9, toks[i])
+		}
+	}
+	if toks[6] != locCallRate {
+		t.Errorf("expected %s, got %s", locCallRate, toks[6])
+	}
+	for i, n := range []int{1, 1, 1, 0, 0, 1} {
+		if f.masked[i] != n {
+			t.Errorf("expected %d masked by %s, got %d", n, callFilters[i], f.masked[i])
+		}
+	}
+	if f.calls != 5 || f.loci != 1 || f.locCalls != 1 {
+		t.Errorf("unexpected counts: %d calls, %d loci, %d low call rate", f.calls, f.loci, f.locCalls)
+	}
+}
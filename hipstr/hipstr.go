@@ -1,12 +1,12 @@
 // Package hipstr parallelizes calling of HipSTR and does best-practices filtering.
+// It also runs ExpansionHunter over chunks of a variant catalog for `smoove str`.
 package hipstr
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"runtime"
@@ -15,155 +15,260 @@ import (
 	"sync"
 
 	arg "github.com/alexflint/go-arg"
+	"github.com/brentp/smoove/shared"
 	"github.com/brentp/xopen"
 )
 
 type hargs struct {
 	Regions string   `arg:"-r,required,help:BED file of regions containing STRs"`
 	Fasta   string   `arg:"-f,required,help:path to reference fasta file"`
+	Out     string   `arg:"-o,help:path to output VCF. if it ends with .gz it is written as BGZF and indexed. default is stdout."`
+	WorkDir string   `arg:"--workdir,help:directory to keep completed chunks in so that a failed run can be resumed by re-running the same command. removed on success."`
+	Retries int      `arg:"help:number of times to retry a chunk that fails before stopping."`
 	Bams    []string `arg:"positional,required,help:bams in which to call STRs"`
+	filterArgs
 }
 
 func Main() {
 
-	cli := &hargs{}
+	cli := &hargs{Retries: 1, filterArgs: defaultFilterArgs()}
 	arg.MustParse(cli)
 
-	o := bufio.NewWriter(os.Stdout)
-	defer o.Flush()
-
-	HipStr(cli, o)
+	w, closer, err := shared.OpenOutput(cli.Out, runtime.GOMAXPROCS(0))
+	if err != nil {
+		shared.Fatal(err)
+	}
+	if err := HipStr(cli, w); err != nil {
+		shared.Fatal(err)
+	}
+	if err := closer(); err != nil {
+		shared.Fatal(err)
+	}
 }
 
-func check(e error) {
-	if e != nil {
-		panic(e)
+// writeBamList writes the bams one per line for HipSTR's --bam-files so that the command-line
+// doesn't get too large for big cohorts.
+func writeBamList(bams []string) (string, error) {
+	f, err := ioutil.TempFile("", "hipstr-bams-")
+	if err != nil {
+		return "", err
+	}
+	shared.RemoveOnExit(f.Name())
+	if _, err = f.WriteString(strings.Join(bams, "\n") + "\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
 	}
+	return f.Name(), f.Close()
 }
 
-// TODO: use --bams-files <FILE> so that command-line doesnt get so large.
-const cmd_tmpl = `HipSTR --silent --bams %s --fasta %s --regions %s --str-vcf %s`
-
-func worker(args hargs, delete bool) (*xopen.Reader, string) {
-	if delete {
-		defer os.Remove(args.Regions)
+// job returns a job that calls STRs in the regions chunk and sends the output to out.
+func job(args *hargs, bamList string, r region, wd *workDir, out *wl) shared.Job {
+	vcf := wd.vcf(r.i)
+	return shared.Job{Name: r.path,
+		Log:     shared.Slogger.With("stage", "hipstr", "chunk", strconv.Itoa(r.i)),
+		Cmds:    [][]string{{"HipSTR", "--silent", "--bam-files", bamList, "--fasta", args.Fasta, "--regions", r.path, "--str-vcf", vcf}},
+		Retries: args.Retries,
+		Done: func() error {
+			os.Remove(r.path)
+			if err := wd.markDone(r.i); err != nil {
+				return err
+			}
+			return out.done(r.i, vcf)
+		},
+		Cleanup: func() {
+			os.Remove(r.path)
+			os.Remove(vcf)
+		},
 	}
-	t, err := ioutil.TempFile("", "hipstr-vcf-gz")
-	check(err)
-	check(t.Close())
-	defer os.Remove(t.Name())
-	tname := t.Name() + ".vcf.gz"
-	cmd := fmt.Sprintf(cmd_tmpl, strings.Join(args.Bams, ","), args.Fasta, args.Regions, tname)
-	p := exec.Command("bash", "-c", cmd)
-
-	p.Stderr = os.Stderr
-	p.Stdout = os.Stdout
-
-	check(p.Run())
-
-	x, err := xopen.Ropen(tname)
-	check(err)
-	return x, tname
 }
 
 const variantsPerRegion = 400
 
-func makeRegions(regions string) chan string {
+// region is a chunk of the regions BED. i is used to write the output in the original order.
+type region struct {
+	i    int
+	path string
+}
+
+// makeRegions splits the regions into chunks of variantsPerRegion. Chunks that are not already
+// complete in wd are written to BED files in wd. If reading or writing fails, the channel is closed
+// early and the error is available from the returned function after the channel is drained.
+func makeRegions(regions string, wd *workDir) (chan region, func() error, error) {
 	f, err := xopen.Ropen(regions)
-	check(err)
-	ch := make(chan string, 10)
+	if err != nil {
+		return nil, nil, shared.InputError(err)
+	}
+	ch := make(chan region, 10)
+	var rerr error
 	go func() {
+		defer close(ch)
 		defer f.Close()
 		k, group := 0, 0
-		w, err := xopen.Wopen("tmp:hipstr-" + strconv.Itoa(group) + "-")
-		check(err)
+		var chunk strings.Builder
+		send := func() error {
+			r := region{i: group, path: wd.bed(group)}
+			if !wd.isDone(group) {
+				if err := ioutil.WriteFile(r.path, []byte(chunk.String()), 0644); err != nil {
+					return err
+				}
+			}
+			ch <- r
+			chunk.Reset()
+			k = 0
+			group++
+			return nil
+		}
 		for {
 			line, err := f.ReadString('\n')
 			if len(line) != 0 {
 				k++
-				_, verr := w.WriteString(line)
-				check(verr)
+				chunk.WriteString(line)
 				if k == variantsPerRegion {
-					k = 0
-					w.Close()
-					log.Println(w.Name())
-					ch <- w.Name()
-					group++
-					w, err = xopen.Wopen("tmp:hipstr-" + strconv.Itoa(group) + "-")
-					check(err)
+					if rerr = send(); rerr != nil {
+						return
+					}
 				}
 			}
 			if err == io.EOF {
 				break
 			}
-			check(err)
+			if err != nil {
+				rerr = shared.InputError(fmt.Errorf("error reading regions %s: %w", regions, err))
+				return
+			}
 		}
 		if k > 0 {
-			w.Close()
-			ch <- w.Name()
+			rerr = send()
 		}
-		close(ch)
 	}()
-	return ch
+	return ch, func() error { return rerr }, nil
 }
 
+// wl writes chunk outputs in the order of the regions.
 type wl struct {
 	mu *sync.Mutex
 	io.Writer
-	i int
+	// next is the index of the next chunk to write and pending holds completed chunks that are waiting on earlier ones.
+	next    int
+	pending map[int]string
+	// f is nil if filtering is disabled.
+	f *filterer
 }
 
-func HipStr(args *hargs, wtr io.Writer) {
-	if _, err := exec.LookPath("HipSTR"); err != nil {
-		panic("error can't find hipstr executable")
-	}
-	var wg sync.WaitGroup
-
-	out := wl{mu: &sync.Mutex{}, Writer: wtr, i: 0}
-
-	ch := makeRegions(args.Regions)
-
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		wg.Add(1)
-		go func() {
-			for r := range ch {
-				gz, path := worker(hargs{Fasta: args.Fasta, Regions: r, Bams: args.Bams}, true)
-				out.mu.Lock()
-				if out.i == 0 {
-					_, err := io.Copy(out, gz)
-					check(err)
-					out.i++
-					out.mu.Unlock()
-					gz.Close()
-					os.Remove(path)
-					continue
-				}
-				for {
-					// only write lines that don't start with '#'
-					line, err := gz.ReadString('\n')
-					if len(line) != 0 {
-						if line[0] != '#' {
-							out.Write([]byte(line))
-							_, err := io.Copy(out, gz)
-							check(err)
-							break
-						}
+// done records that chunk i is complete in path and writes any chunks that are now in order.
+func (out *wl) done(i int, path string) error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.pending[i] = path
+	for {
+		p, ok := out.pending[out.next]
+		if !ok {
+			return nil
+		}
+		delete(out.pending, out.next)
+		if err := out.write(p); err != nil {
+			return err
+		}
+		out.next++
+	}
+}
 
+// write copies the VCF at path to the output, skipping the header after the first
+// and applying the filters if they are set.
+func (out *wl) write(path string) error {
+	gz, err := xopen.Ropen(path)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	for {
+		line, err := gz.ReadString('\n')
+		if len(line) != 0 {
+			if line[0] == '#' {
+				if out.next == 0 {
+					if out.f != nil && strings.HasPrefix(line, "#CHROM") {
+						line = out.f.header() + line
 					}
-					if err == io.EOF {
-						break
+					if _, err := io.WriteString(out, line); err != nil {
+						return err
 					}
-					check(err)
 				}
+			} else {
+				if out.f != nil {
+					line = out.f.line(strings.TrimRight(line, "\r\n")) + "\n"
+				}
+				if _, err := io.WriteString(out, line); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HipStr calls STRs in chunks of the regions in parallel and writes them to wtr in the order of the regions.
+func HipStr(args *hargs, wtr io.Writer) error {
+	if _, err := exec.LookPath("HipSTR"); err != nil {
+		return shared.DependencyError(fmt.Errorf("error can't find hipstr executable"))
+	}
+	out := &wl{mu: &sync.Mutex{}, Writer: wtr, pending: make(map[int]string)}
+	if !args.NoFilter {
+		out.f = &filterer{filterArgs: args.filterArgs}
+	}
+	wd, err := openWorkDir(args.WorkDir, manifestHeader(args), ".vcf.gz")
+	if err != nil {
+		return err
+	}
+	bamList, err := writeBamList(args.Bams)
+	if err != nil {
+		wd.close(false)
+		return err
+	}
+	defer os.Remove(bamList)
 
-				out.i++
-				log.Println("at:", out.i)
-				out.mu.Unlock()
-				gz.Close()
-				os.Remove(path)
+	ch, regionErr, err := makeRegions(args.Regions, wd)
+	if err != nil {
+		wd.close(false)
+		return err
+	}
+	jobs := make(chan shared.Job)
+	var werr error
+	go func() {
+		defer close(jobs)
+		for r := range ch {
+			if wd.isDone(r.i) {
+				if err := out.done(r.i, wd.vcf(r.i)); err != nil && werr == nil {
+					werr = err
+				}
+				continue
 			}
-			wg.Done()
-		}()
+			jobs <- job(args, bamList, r, wd, out)
+		}
+	}()
+	err = shared.Run(context.Background(), runtime.GOMAXPROCS(0), jobs)
+	if err == nil {
+		err = regionErr()
+	}
+	if err == nil {
+		err = werr
+	}
+	if err == nil && len(out.pending) > 0 {
+		err = fmt.Errorf("%d chunks were not written", len(out.pending))
+	}
+	wd.close(err == nil)
+	if err != nil {
+		return err
+	}
+	shared.Slogger.Printf("wrote %d chunks of STR calls", out.next)
+	if out.f != nil {
+		out.f.report()
 	}
-	wg.Wait()
+	return nil
 }
@@ -0,0 +1,138 @@
+package hipstr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeHipSTR writes a VCF with one call per region and sleeps longer for earlier chunks
+// so that chunks complete out of order.
+const fakeHipSTR = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case $1 in
+		--regions) regions=$2; shift;;
+		--str-vcf) out=$2; shift;;
+		--bam-files) bams=$2; shift;;
+	esac
+	shift
+done
+test -s "$bams" || exit 1
+if [ -n "$FAIL_CHUNK" ] && grep -q "	$FAIL_CHUNK	" $regions; then sleep 0.6; exit 2; fi
+echo "$regions" >> ${RUN_LOG:-/dev/null}
+first=$(head -1 $regions | cut -f 2)
+if [ $first -lt 100 ]; then sleep 0.3; fi
+{
+printf '##fileformat=VCFv4.2\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\ts1\n'
+awk 'BEGIN{OFS="\t"} {print $1,$2,"STR"NR,"A",".",".","PASS",".","GT:Q","0|0:0.99"}' $regions
+} > $out
+`
+
+func TestHipStrOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-hipstr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "HipSTR"), []byte(fakeHipSTR), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var bed bytes.Buffer
+	n := 3*variantsPerRegion + 7
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&bed, "chr1\t%d\t%d\n", i*10, i*10+5)
+	}
+	regions := filepath.Join(dir, "regions.bed")
+	if err := ioutil.WriteFile(regions, bed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := HipStr(&hargs{Regions: regions, Fasta: "ref.fa", Bams: []string{"a.bam", "b.bam"}, filterArgs: defaultFilterArgs()}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var pos []string
+	var headers int
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(line, "#CHROM") {
+			headers++
+		}
+		if line[0] != '#' {
+			pos = append(pos, strings.Split(line, "\t")[1])
+		}
+	}
+	if headers != 1 {
+		t.Errorf("expected a single header, got %d", headers)
+	}
+	if len(pos) != n {
+		t.Fatalf("expected %d calls, got %d", n, len(pos))
+	}
+	for i, p := range pos {
+		if p != fmt.Sprint(i*10) {
+			t.Fatalf("out of order at %d: %s", i, p)
+		}
+	}
+}
+
+func TestHipStrResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-hipstr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "HipSTR"), []byte(fakeHipSTR), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	runLog := filepath.Join(dir, "runs.log")
+	defer os.Unsetenv("RUN_LOG")
+	os.Setenv("RUN_LOG", runLog)
+	defer os.Unsetenv("FAIL_CHUNK")
+
+	var bed bytes.Buffer
+	n := 3 * variantsPerRegion
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&bed, "chr1\t%d\t%d\n", i*10, i*10+5)
+	}
+	regions := filepath.Join(dir, "regions.bed")
+	if err := ioutil.WriteFile(regions, bed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(dir, "work")
+	args := &hargs{Regions: regions, Fasta: "ref.fa", Bams: []string{"a.bam"}, WorkDir: work, Retries: 1, filterArgs: defaultFilterArgs()}
+
+	// the last chunk always fails (slowly, so the others finish) and the run stops but completed chunks are kept.
+	os.Setenv("FAIL_CHUNK", fmt.Sprint(2*variantsPerRegion*10))
+	if err := HipStr(args, ioutil.Discard); err == nil {
+		t.Fatal("expected an error from the failing chunk")
+	}
+	if _, err := os.Stat(filepath.Join(work, manifestName)); err != nil {
+		t.Fatalf("expected manifest to be kept: %s", err)
+	}
+	os.Remove(runLog)
+
+	os.Setenv("FAIL_CHUNK", "")
+	var out bytes.Buffer
+	if err := HipStr(args, &out); err != nil {
+		t.Fatal(err)
+	}
+	runs, _ := ioutil.ReadFile(runLog)
+	if c := strings.Count(string(runs), "\n"); c != 1 {
+		t.Errorf("expected only the failed chunk to be re-run, got %d runs", c)
+	}
+	if c := strings.Count(out.String(), "\tSTR"); c != n {
+		t.Errorf("expected %d calls, got %d", n, c)
+	}
+	if _, err := os.Stat(work); !os.IsNotExist(err) {
+		t.Errorf("expected work directory to be removed after success")
+	}
+}
@@ -0,0 +1,130 @@
+package hipstr
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/xopen"
+)
+
+// workDir holds the region chunks, their HipSTR output and a manifest of completed chunks
+// so that a run can be resumed.
+type workDir struct {
+	dir string
+	// ext is the extension of the output of each chunk.
+	ext string
+	// temporary is true if the directory was not requested and is always removed.
+	temporary bool
+	mu        sync.Mutex
+	manifest  *os.File
+	done      map[int]bool
+}
+
+const manifestName = "manifest.tsv"
+
+// manifestHeader identifies the inputs so that a work directory isn't reused for a different run.
+func manifestHeader(args *hargs) string {
+	return fmt.Sprintf("#smoove-hipstr\tregions=%s\tfasta=%s\tchunk=%d\tbams=%s", args.Regions, args.Fasta, variantsPerRegion, strings.Join(args.Bams, ","))
+}
+
+// openWorkDir creates (or re-opens) the work directory and reads the chunks that are already complete.
+// header identifies the inputs and must match if the directory is re-used. if dir is empty, a temporary
+// directory is used.
+func openWorkDir(dir string, header string, ext string) (*workDir, error) {
+	w := &workDir{dir: dir, ext: ext, done: make(map[int]bool)}
+	if dir == "" {
+		var err error
+		if w.dir, err = ioutil.TempDir("", "smoove-hipstr-"); err != nil {
+			return nil, err
+		}
+		shared.RemoveOnExit(w.dir)
+		w.temporary = true
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(w.dir, manifestName)
+	if xopen.Exists(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(f)
+		for i := 0; s.Scan(); i++ {
+			line := s.Text()
+			if i == 0 {
+				if line != header {
+					f.Close()
+					return nil, shared.Inputf("work directory %s is from a run with different inputs. remove it or use another --workdir", w.dir)
+				}
+				continue
+			}
+			// a partially written last line is ignored and the chunk is re-run.
+			toks := strings.Split(line, "\t")
+			if len(toks) != 2 || toks[1] != "done" {
+				continue
+			}
+			if k, err := strconv.Atoi(toks[0]); err == nil && xopen.Exists(w.vcf(k)) {
+				w.done[k] = true
+			}
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		if len(w.done) > 0 {
+			shared.Slogger.Printf("resuming from %s with %d completed chunks", w.dir, len(w.done))
+		}
+	}
+	var err error
+	if w.manifest, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return nil, err
+	}
+	if st, err := w.manifest.Stat(); err == nil && st.Size() == 0 {
+		if _, err := w.manifest.WriteString(header + "\n"); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *workDir) bed(i int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("chunk-%06d.bed", i))
+}
+
+func (w *workDir) vcf(i int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("chunk-%06d%s", i, w.ext))
+}
+
+func (w *workDir) isDone(i int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.done[i]
+}
+
+// markDone records chunk i in the manifest and syncs it so the record survives a crash.
+func (w *workDir) markDone(i int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done[i] = true
+	if _, err := fmt.Fprintf(w.manifest, "%d\tdone\n", i); err != nil {
+		return err
+	}
+	return w.manifest.Sync()
+}
+
+// close closes the manifest and removes the directory if the run succeeded or it was temporary.
+func (w *workDir) close(success bool) {
+	w.manifest.Close()
+	if success || w.temporary {
+		os.RemoveAll(w.dir)
+	} else {
+		shared.Slogger.Printf("completed chunks are in %s. re-run the same command to resume", w.dir)
+	}
+}
@@ -2,13 +2,11 @@ package lumpy
 
 import (
 	"bytes"
-	"io"
+	"fmt"
 	"log"
-	"os"
-	"time"
 
-	"github.com/biogo/hts/bam"
 	"github.com/biogo/hts/sam"
+	"github.com/pkg/errors"
 )
 
 func isBad(counts []int8) bool {
@@ -52,11 +50,11 @@ func countBases(cigs []sam.Cigar, L int, rec *sam.Record) []int8 {
 			if op.Type() == sam.CigarMatch || op.Type() == sam.CigarInsertion {
 				for i := 0; i < op.Len(); i++ {
 					if off+i < 0 || off+i >= len(counts) {
-						b, e := rec.MarshalSAM(0)
-						if e != nil {
-							log.Fatal(e)
+						if b, e := rec.MarshalSAM(0); e == nil {
+							log.Println("bad length in sam record:" + string(b) + "\nskipping")
+						} else {
+							log.Printf("bad length in sam record %s. skipping", rec.Name)
 						}
-						log.Println("bad length in sam record:" + string(b) + "\nskipping")
 						return counts
 					}
 					counts[off+i]++
@@ -72,11 +70,11 @@ func countBases(cigs []sam.Cigar, L int, rec *sam.Record) []int8 {
 	return counts
 }
 
-func getCigars(rec *sam.Record, maxL *int) []sam.Cigar {
+func getCigars(rec *sam.Record, maxL *int) ([]sam.Cigar, error) {
 	c := rec.Cigar
 	tags, ok := rec.Tag([]byte{'S', 'A'})
 	if !ok {
-		panic("no sa tag")
+		return nil, fmt.Errorf("no SA tag for split read %s", rec.Name)
 	}
 	strand := byte('+')
 	if rec.Flags&sam.Reverse != 0 {
@@ -94,13 +92,16 @@ func getCigars(rec *sam.Record, maxL *int) []sam.Cigar {
 
 	for _, part := range bytes.Split(b, []byte{';'}) {
 		toks := bytes.Split(part, []byte{','})
+		if len(toks) < 4 || len(toks[2]) == 0 {
+			return nil, fmt.Errorf("bad SA tag for split read %s: %s", rec.Name, part)
+		}
 		cig, err := sam.ParseCigar(toks[3])
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad cigar in SA tag for split read %s", rec.Name)
+		}
 		if toks[2][0] != strand {
 			reverse(cig)
 		}
-		if err != nil {
-			panic(err)
-		}
 		ref, read := cig.Lengths()
 		if read > *maxL {
 			*maxL = read
@@ -110,7 +111,7 @@ func getCigars(rec *sam.Record, maxL *int) []sam.Cigar {
 		}
 		cigs = append(cigs, cig)
 	}
-	return cigs
+	return cigs, nil
 }
 
 // a bad splitter has soft clips that don't consume the entire read
@@ -123,47 +124,12 @@ func getCigars(rec *sam.Record, maxL *int) []sam.Cigar {
 // 40 conflicting bases. In the bad example above, there are
 // 130 conflicting bases. This adjust for strand and allows
 // multiple splitters (even though lumpy does not).
-func badSplitter(rec *sam.Record) bool {
+func badSplitter(rec *sam.Record) (bool, error) {
 	var maxL int
-	cigs := getCigars(rec, &maxL)
-	counts := countBases(cigs, maxL, rec)
-	return isBad(counts)
-}
-
-func main() {
-	// main function for testing only. called from lumpy_filter
-	bampath := os.Args[1]
-	removed := 0
-	kept := 0
-	f, err := os.Open(bampath)
+	cigs, err := getCigars(rec, &maxL)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
-	br, err := bam.NewReader(f, 2)
-	t := time.Now()
-
-	for {
-		rec, err := br.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
-		if badSplitter(rec) {
-			removed++
-			continue
-		}
-
-		kept++
-		/*
-			if err := bw.Write(rec); err != nil {
-				panic(err)
-			}
-		*/
-	}
-	tot := removed + kept
-	log.Printf("removed %d (%.1f%%) of %d sparse splitters in %.0f seconds", removed, 100*float64(removed)/float64(tot), tot, time.Since(t).Seconds())
-
-	br.Close()
+	counts := countBases(cigs, maxL, rec)
+	return isBad(counts), nil
 }
@@ -44,3 +44,17 @@ func (s *BadSplitTest) TestNotMatchingCounts(c *C) {
 	}
 	c.Assert(isBad(cnts), Equals, true)
 }
+
+func (s *BadSplitTest) TestBadSA(c *C) {
+	cig, err := sam.ParseCigar([]byte("100M50S"))
+	c.Assert(err, IsNil)
+	rec := &sam.Record{Name: "r", Cigar: cig}
+	_, err = badSplitter(rec)
+	c.Assert(err, NotNil)
+
+	aux, err := sam.NewAux(sam.NewTag("SA"), "1,500,+,100S50Q,60,0;")
+	c.Assert(err, IsNil)
+	rec.AuxFields = append(rec.AuxFields, aux)
+	_, err = badSplitter(rec)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,177 @@
+package lumpy
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/faidx"
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/xopen"
+	"github.com/pkg/errors"
+)
+
+// bedpe is a file of breakpoint evidence passed to lumpy with -bedpe.
+type bedpe struct {
+	path   string
+	weight int
+	// cnv is true for evidence converted from a CNV file (see cnvBedpe).
+	cnv bool
+}
+
+// arg returns the lumpy -bedpe argument for sample.
+func (b bedpe) arg(sample string) string {
+	return fmt.Sprintf("-bedpe bedpe_file:%s,id:%s,weight:%d ", b.path, sample, b.weight)
+}
+
+var bedpeTypes = map[string]bool{"DELETION": true, "DUPLICATION": true, "INVERSION": true, "TRANSLOCATION": true}
+
+// validateBedpe checks that path is BEDPE that lumpy can use: 2 intervals on contigs in the reference,
+// a strand for each end and a TYPE: (DELETION, DUPLICATION, INVERSION or TRANSLOCATION) in a later column.
+func validateBedpe(path string, contigs map[string]bool) (int, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return 0, shared.InputError(err)
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 65536), 1<<24)
+	for i := 1; scanner.Scan(); i++ {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		if err := checkBedpeLine(strings.Split(line, "\t"), contigs); err != nil {
+			return 0, shared.Inputf("error on line %d of BEDPE %s: %s", i, path, err)
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, shared.InputError(err)
+	}
+	return n, nil
+}
+
+func checkBedpeLine(toks []string, contigs map[string]bool) error {
+	if len(toks) < 11 {
+		return fmt.Errorf("expected at least 11 tab-delimited columns, got %d", len(toks))
+	}
+	for _, c := range []int{0, 3} {
+		if !contigs[toks[c]] {
+			return fmt.Errorf("chromosome %s is not in the reference", toks[c])
+		}
+		start, err := strconv.Atoi(toks[c+1])
+		if err != nil {
+			return err
+		}
+		end, err := strconv.Atoi(toks[c+2])
+		if err != nil {
+			return err
+		}
+		if start < 0 || end <= start {
+			return fmt.Errorf("bad interval %s:%s-%s", toks[c], toks[c+1], toks[c+2])
+		}
+	}
+	for _, s := range toks[8:10] {
+		if s != "+" && s != "-" {
+			return fmt.Errorf("strand must be + or -, got %s", s)
+		}
+	}
+	for _, t := range toks[10:] {
+		if strings.HasPrefix(t, "TYPE:") {
+			if !bedpeTypes[t[len("TYPE:"):]] {
+				return fmt.Errorf("unknown %s. expected DELETION, DUPLICATION, INVERSION or TRANSLOCATION", t)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no TYPE: column")
+}
+
+// parseBedpeArgs parses sample:path[:weight] arguments. The sample may be left off if there is a
+// single sample and the weight defaults to 1.
+func parseBedpeArgs(args []string, samples []string) (map[string][]bedpe, error) {
+	m := make(map[string][]bedpe, len(args))
+	for _, a := range args {
+		sample, path := "", a
+		if i := strings.Index(a, ":"); i > 0 && hasSample(samples, a[:i]) {
+			sample, path = a[:i], a[i+1:]
+		} else if len(samples) == 1 {
+			sample = samples[0]
+		} else {
+			return nil, shared.Inputf("--bedpe entry %s must be sample:path[:weight] where sample is one of %s", a, strings.Join(samples, ","))
+		}
+		b := bedpe{path: path, weight: 1}
+		if i := strings.LastIndex(path, ":"); i > 0 {
+			if w, err := strconv.Atoi(path[i+1:]); err == nil {
+				if w < 1 {
+					return nil, shared.Inputf("--bedpe weight for %s must be at least 1", path[:i])
+				}
+				b.path, b.weight = path[:i], w
+			}
+		}
+		if !xopen.Exists(b.path) {
+			return nil, shared.Inputf("BEDPE %s for %s not found", b.path, sample)
+		}
+		m[sample] = append(m[sample], b)
+	}
+	return m, nil
+}
+
+// referenceContigs returns the set of contigs in the fasta index of reference.
+func referenceContigs(reference string) (map[string]bool, error) {
+	fa, err := faidx.New(reference)
+	if err != nil {
+		return nil, shared.InputError(errors.Wrapf(err, "error opening fasta file: %s", reference))
+	}
+	contigs := make(map[string]bool, len(fa.Index))
+	for name := range fa.Index {
+		contigs[name] = true
+	}
+	return contigs, nil
+}
+
+// addBedpes validates the BEDPE files given as sample:path[:weight] in args against the contigs
+// in reference and adds them to the evidence for each filter.
+func addBedpes(filters []filter, args []string, reference string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	bedpes, err := parseBedpeArgs(args, sampleNames(filters))
+	if err != nil {
+		return err
+	}
+	contigs, err := referenceContigs(reference)
+	if err != nil {
+		return err
+	}
+	for i, f := range filters {
+		for _, b := range bedpes[f.sample] {
+			n, err := validateBedpe(b.path, contigs)
+			if err != nil {
+				return err
+			}
+			shared.Slogger.With("sample", f.sample, "stage", "bedpe").Printf("using %d breakpoints from %s with weight %d", n, b.path, b.weight)
+			filters[i].bedpes = append(filters[i].bedpes, b)
+		}
+	}
+	return nil
+}
+
+// evidenceHeader returns VCF header lines describing the CNV and BEDPE evidence given to lumpy.
+func evidenceHeader(filters []filter, cnvWeight int) []string {
+	var lines []string
+	for _, f := range filters {
+		if f.cnv != "" {
+			lines = append(lines, fmt.Sprintf("##smoove_cnv=%s:%s:%d", f.sample, f.cnv, cnvWeight))
+		}
+		for _, b := range f.bedpes {
+			if !b.cnv {
+				lines = append(lines, fmt.Sprintf("##smoove_bedpe=%s:%s:%d", f.sample, b.path, b.weight))
+			}
+		}
+	}
+	return lines
+}
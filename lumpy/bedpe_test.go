@@ -0,0 +1,61 @@
+package lumpy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBedpe(t *testing.T) {
+	contigs := map[string]bool{"1": true, "2": true}
+	ok := strings.Split("1\t100\t200\t2\t500\t600\tb1\t.\t+\t-\tTYPE:TRANSLOCATION", "\t")
+	if err := checkBedpeLine(ok, contigs); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, bad := range []string{
+		"1\t100\t200\t2\t500\t600\tb1\t.\t+\t-",
+		"1\t100\t200\tX\t500\t600\tb1\t.\t+\t-\tTYPE:TRANSLOCATION",
+		"1\t200\t100\t2\t500\t600\tb1\t.\t+\t-\tTYPE:TRANSLOCATION",
+		"1\t100\t200\t2\t500\t600\tb1\t.\t.\t-\tTYPE:TRANSLOCATION",
+		"1\t100\t200\t2\t500\t600\tb1\t.\t+\t-\tTYPE:BND",
+		"1\t100\t200\t2\t500\t600\tb1\t.\t+\t-\tx",
+	} {
+		if err := checkBedpeLine(strings.Split(bad, "\t"), contigs); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "smoove-bedpe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lr.bedpe")
+	ioutil.WriteFile(path, []byte(strings.Join(ok, "\t")+"\n"), 0644)
+
+	m, err := parseBedpeArgs([]string{"b:" + path + ":3", "a:" + path}, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["a"]) != 1 || m["a"][0].weight != 1 || len(m["b"]) != 1 || m["b"][0] != (bedpe{path: path, weight: 3}) {
+		t.Errorf("unexpected parse: %v", m)
+	}
+	if _, err := parseBedpeArgs([]string{path + ":0"}, []string{"a"}); err == nil {
+		t.Errorf("expected an error for a weight of 0")
+	}
+
+	filters := []filter{{sample: "a", cnv: "a.bed", bedpes: []bedpe{{path: "a.del.bedpe", weight: 2, cnv: true}, m["a"][0]}}}
+	h := evidenceHeader(filters, 2)
+	if len(h) != 2 || h[0] != "##smoove_cnv=a:a.bed:2" || h[1] != "##smoove_bedpe=a:"+path+":1" {
+		t.Errorf("unexpected header: %v", h)
+	}
+	cmd, err := lumpy_cmd([]cs{cs_from_filter(filters[0], dir)}, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cmd, "-bedpe bedpe_file:a.del.bedpe,id:a,weight:2 -bedpe bedpe_file:"+path+",id:a,weight:1") {
+		t.Errorf("missing -bedpe in %s", cmd)
+	}
+}
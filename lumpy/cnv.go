@@ -0,0 +1,285 @@
+package lumpy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/xopen"
+)
+
+// cnvSlop is added on each side of the start and end of a CNV as read-depth breakpoints are imprecise.
+const cnvSlop = 500
+
+// cnv is a deletion or duplication from a read-depth caller.
+type cnv struct {
+	chrom      string
+	start, end int
+	dup        bool
+}
+
+// cnvType returns whether t (from the 4th column of a BED or the ALT of a VCF) is a deletion or
+// a duplication. ok is false for a copy-number of 2 or anything that isn't a CNV.
+func cnvType(t string) (dup bool, ok bool) {
+	t = strings.Trim(strings.ToLower(t), "<>")
+	switch {
+	case t == "del" || t == "deletion" || t == "loss" || strings.HasPrefix(t, "del:"):
+		return false, true
+	case t == "dup" || t == "duplication" || t == "gain" || strings.HasPrefix(t, "dup:"):
+		return true, true
+	}
+	t = strings.TrimPrefix(strings.TrimPrefix(t, "cn="), "cn")
+	if cn, err := strconv.ParseFloat(t, 64); err == nil && cn != 2 {
+		return cn > 2, true
+	}
+	return false, false
+}
+
+// parseCNVBed parses a line with chrom, start, end and the type (e.g. DEL, DUP or a copy-number).
+func parseCNVBed(toks []string) (cnv, bool, error) {
+	if len(toks) < 4 {
+		return cnv{}, false, fmt.Errorf("expected chrom, start, end and type (e.g. DEL, DUP or a copy-number)")
+	}
+	start, err := strconv.Atoi(toks[1])
+	if err != nil {
+		return cnv{}, false, err
+	}
+	end, err := strconv.Atoi(toks[2])
+	if err != nil {
+		return cnv{}, false, err
+	}
+	dup, ok := cnvType(toks[3])
+	return cnv{chrom: toks[0], start: start, end: end, dup: dup}, ok, nil
+}
+
+// parseCNVVCF parses a variant with an SVTYPE of DEL or DUP or an ALT of <DEL>, <DUP> or <CN#>.
+// The end is from END or SVLEN.
+func parseCNVVCF(toks []string) (cnv, bool, error) {
+	if len(toks) < 8 {
+		return cnv{}, false, fmt.Errorf("expected at least 8 columns")
+	}
+	pos, err := strconv.Atoi(toks[1])
+	if err != nil {
+		return cnv{}, false, err
+	}
+	dup, ok := cnvType(toks[4])
+	end := -1
+	for _, kv := range strings.Split(toks[7], ";") {
+		switch {
+		case strings.HasPrefix(kv, "SVTYPE="):
+			if d, o := cnvType(kv[len("SVTYPE="):]); o {
+				dup, ok = d, o
+			}
+		case strings.HasPrefix(kv, "END="):
+			if end, err = strconv.Atoi(kv[len("END="):]); err != nil {
+				return cnv{}, false, err
+			}
+		case strings.HasPrefix(kv, "SVLEN=") && end == -1:
+			l, err := strconv.Atoi(strings.Split(kv[len("SVLEN="):], ",")[0])
+			if err != nil {
+				return cnv{}, false, err
+			}
+			if l < 0 {
+				l = -l
+			}
+			end = pos + l
+		}
+	}
+	if end == -1 {
+		return cnv{}, false, fmt.Errorf("no END or SVLEN")
+	}
+	return cnv{chrom: toks[0], start: pos, end: end, dup: dup}, ok, nil
+}
+
+// readCNVs reads the deletions and duplications from a BED or VCF. Other variants and copy-neutral
+// regions are skipped.
+func readCNVs(path string, contigs map[string]bool) ([]cnv, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	defer f.Close()
+	vcf := strings.HasSuffix(path, ".vcf") || strings.HasSuffix(path, ".vcf.gz")
+	var cnvs []cnv
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 65536), 1<<24)
+	for i := 1; scanner.Scan(); i++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "##fileformat=VCF") {
+			vcf = true
+		}
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		var c cnv
+		var ok bool
+		if vcf {
+			c, ok, err = parseCNVVCF(strings.Split(line, "\t"))
+		} else {
+			c, ok, err = parseCNVBed(strings.Fields(line))
+		}
+		if err != nil {
+			return nil, shared.Inputf("error on line %d of CNV file %s: %s", i, path, err)
+		}
+		if !ok {
+			continue
+		}
+		if c.end <= c.start {
+			return nil, shared.Inputf("end is not after start on line %d of CNV file %s", i, path)
+		}
+		if !contigs[c.chrom] {
+			return nil, shared.Inputf("chromosome %s on line %d of CNV file %s is not in the reference", c.chrom, i, path)
+		}
+		cnvs = append(cnvs, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, shared.InputError(err)
+	}
+	return cnvs, nil
+}
+
+// writeBedpe writes a line of lumpy BEDPE evidence for c. The strands and TYPE are as from
+// cnvanator_to_bedpes.py in lumpy.
+func (c cnv) writeBedpe(w *bufio.Writer, id string) {
+	s1, s2, t := "+", "-", "TYPE:DELETION"
+	if c.dup {
+		s1, s2, t = "-", "+", "TYPE:DUPLICATION"
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%d\t%s\t.\t%s\t%s\t%s\n", c.chrom, max(0, c.start-cnvSlop), c.start+cnvSlop,
+		c.chrom, max(0, c.end-cnvSlop), c.end+cnvSlop, id, s1, s2, t)
+}
+
+// cnvBedpe converts the CNVs for sample in path to lumpy BEDPE evidence in {outdir}/{sample}.del.bedpe
+// and {outdir}/{sample}.dup.bedpe. It returns the paths of the files with at least one CNV.
+func cnvBedpe(path, outdir, sample string, contigs map[string]bool) (del, dup string, err error) {
+	cnvs, err := readCNVs(path, contigs)
+	if err != nil {
+		return "", "", err
+	}
+	kinds := [2]string{"del", "dup"}
+	var paths [2]string
+	paths[0], paths[1] = cnvPaths(outdir, sample)
+	var counts [2]int
+	for k, kind := range kinds {
+		p := paths[k]
+		f, err := os.Create(p)
+		if err != nil {
+			return "", "", shared.InputError(err)
+		}
+		w := bufio.NewWriter(f)
+		for _, c := range cnvs {
+			if c.dup == (k == 1) {
+				counts[k]++
+				c.writeBedpe(w, fmt.Sprintf("%s_%s_%d", sample, kind, counts[k]))
+			}
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return "", "", err
+		}
+		if err := f.Close(); err != nil {
+			return "", "", err
+		}
+		if counts[k] == 0 {
+			os.Remove(p)
+			paths[k] = ""
+		}
+	}
+	shared.Slogger.With("sample", sample, "stage", "cnv").Printf("using %d deletions and %d duplications from %s as read-depth evidence", counts[0], counts[1], path)
+	return paths[0], paths[1], nil
+}
+
+// cnvPaths returns the paths of the deletion and duplication BEDPEs for sample.
+func cnvPaths(outdir, sample string) (del, dup string) {
+	return fmt.Sprintf("%s/%s.del.bedpe", outdir, sample), fmt.Sprintf("%s/%s.dup.bedpe", outdir, sample)
+}
+
+// cnvWeight returns the weight for each CNV: weight if it was set or else the larger of the lumpy
+// minimum sample weight and minimum weight so that a CNV without split or discordant reads is called.
+func cnvWeight(weight, msw, mw int) int {
+	min := msw
+	if mw > min {
+		min = mw
+	}
+	if weight == 0 {
+		return min
+	}
+	if weight < min {
+		shared.Slogger.With("stage", "cnv").Warnf("--cnv-weight %d is below the minimum weight for a call (%d) so CNVs are only called with split or discordant reads", weight, min)
+	}
+	return weight
+}
+
+// addCNVs converts the CNV files given as sample:path in args to BEDPE evidence for each filter.
+// Each CNV must be on a contig in reference.
+func addCNVs(filters []filter, args []string, outdir, reference string, weight int) error {
+	if len(args) == 0 {
+		return nil
+	}
+	cnvs, err := parseCNVArgs(args, sampleNames(filters))
+	if err != nil {
+		return err
+	}
+	contigs, err := referenceContigs(reference)
+	if err != nil {
+		return err
+	}
+	for i, f := range filters {
+		if path, ok := cnvs[f.sample]; ok {
+			del, dup, err := cnvBedpe(path, outdir, f.sample, contigs)
+			if err != nil {
+				return err
+			}
+			filters[i].cnv = path
+			for _, p := range []string{del, dup} {
+				if p != "" {
+					filters[i].bedpes = append(filters[i].bedpes, bedpe{path: p, weight: weight, cnv: true})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func sampleNames(filters []filter) []string {
+	samples := make([]string, len(filters))
+	for i, f := range filters {
+		samples[i] = f.sample
+	}
+	return samples
+}
+
+// parseCNVArgs parses sample:path arguments. If there is a single sample, the sample may be left off.
+func parseCNVArgs(args []string, samples []string) (map[string]string, error) {
+	m := make(map[string]string, len(args))
+	for _, a := range args {
+		sample, path := "", a
+		if i := strings.Index(a, ":"); i > 0 && hasSample(samples, a[:i]) {
+			sample, path = a[:i], a[i+1:]
+		} else if len(samples) == 1 {
+			sample = samples[0]
+		} else {
+			return nil, shared.Inputf("--cnv entry %s must be sample:path where sample is one of %s", a, strings.Join(samples, ","))
+		}
+		if _, ok := m[sample]; ok {
+			return nil, shared.Inputf("more than one --cnv given for %s", sample)
+		}
+		if !xopen.Exists(path) {
+			return nil, shared.Inputf("CNV file %s for %s not found", path, sample)
+		}
+		m[sample] = path
+	}
+	return m, nil
+}
+
+func hasSample(samples []string, s string) bool {
+	for _, sm := range samples {
+		if sm == s {
+			return true
+		}
+	}
+	return false
+}
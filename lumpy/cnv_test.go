@@ -0,0 +1,79 @@
+package lumpy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCNVType(t *testing.T) {
+	for in, want := range map[string][2]bool{
+		"DEL": {false, true}, "<DUP>": {true, true}, "loss": {false, true}, "DUP:TANDEM": {true, true},
+		"CN=1": {false, true}, "<CN3>": {true, true}, "0": {false, true}, "2": {false, false}, "INV": {false, false},
+	} {
+		dup, ok := cnvType(in)
+		if dup != want[0] || ok != want[1] {
+			t.Errorf("%s: got %v %v", in, dup, ok)
+		}
+	}
+}
+
+func TestCNVWeight(t *testing.T) {
+	for _, c := range [][4]int{{0, 4, 4, 4}, {0, 3, 6, 6}, {2, 4, 4, 2}, {8, 4, 4, 8}} {
+		if w := cnvWeight(c[0], c[1], c[2]); w != c[3] {
+			t.Errorf("cnvWeight(%d, %d, %d): expected %d, got %d", c[0], c[1], c[2], c[3], w)
+		}
+	}
+}
+
+func TestCNVBedpe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-cnv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bed := filepath.Join(dir, "s.bed")
+	ioutil.WriteFile(bed, []byte("track name=cnv\n1\t10000\t20000\tDEL\n1\t30000\t40000\t2\n2\t100\t5000\t3\n"), 0644)
+	contigs := map[string]bool{"1": true, "2": true}
+	del, dup, err := cnvBedpe(bed, dir, "s", contigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(del)
+	if string(b) != "1\t9500\t10500\t1\t19500\t20500\ts_del_1\t.\t+\t-\tTYPE:DELETION\n" {
+		t.Errorf("unexpected deletion bedpe: %q", b)
+	}
+	b, _ = ioutil.ReadFile(dup)
+	if string(b) != "2\t0\t600\t2\t4500\t5500\ts_dup_1\t.\t-\t+\tTYPE:DUPLICATION\n" {
+		t.Errorf("unexpected duplication bedpe: %q", b)
+	}
+
+	vcf := filepath.Join(dir, "s.vcf")
+	ioutil.WriteFile(vcf, []byte("##fileformat=VCFv4.2\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n1\t5000\t.\tN\t<DEL>\t.\tPASS\tSVTYPE=DEL;SVLEN=-3000\n"), 0644)
+	del, dup, err = cnvBedpe(vcf, dir, "s", contigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dup != "" {
+		t.Errorf("expected no duplications, got %s", dup)
+	}
+	b, _ = ioutil.ReadFile(del)
+	if !strings.HasPrefix(string(b), "1\t4500\t5500\t1\t7500\t8500\t") {
+		t.Errorf("unexpected deletion bedpe from vcf: %q", b)
+	}
+
+	if _, _, err := cnvBedpe(bed, dir, "s", map[string]bool{"1": true}); err == nil || !strings.Contains(err.Error(), "chromosome 2") {
+		t.Errorf("expected an error for a chromosome that is not in the reference, got %v", err)
+	}
+
+	if _, err := parseCNVArgs([]string{bed}, []string{"a", "b"}); err == nil {
+		t.Errorf("expected an error for a CNV file without a sample with 2 samples")
+	}
+	m, err := parseCNVArgs([]string{"b:" + bed}, []string{"a", "b"})
+	if err != nil || m["b"] != bed {
+		t.Errorf("unexpected parse of sample:path: %v %v", m, err)
+	}
+}
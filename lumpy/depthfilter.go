@@ -18,8 +18,10 @@ import (
 	"github.com/biogo/hts/sam"
 	"github.com/biogo/store/interval"
 	"github.com/brentp/goleft/depth"
+	"github.com/brentp/smoove"
 	"github.com/brentp/smoove/shared"
 	"github.com/kyroy/kdtree"
+	"github.com/pkg/errors"
 	"github.com/valyala/fasttemplate"
 )
 
@@ -194,10 +196,50 @@ type readCount struct {
 	after  int
 }
 
+const mosdepthScript = `
+export MOSDEPTH_Q0=OK
+export MOSDEPTH_Q1=HIGH
+set -euo pipefail
+samtools index -c {{bam}}
+mosdepth -f {{fasta}} --fast-mode -n --quantize {{md1}}: {{prefix}} {{bam}}
+rm -f {{prefix}}.mosdepth*.dist.txt
+rm {{prefix}}.quantized.bed.gz.csi
+`
+
+// mosdepth_cmd returns the script that writes regions of fbam with depth above maxdepth
+// to {prefix}.quantized.bed.gz.
+func mosdepth_cmd(fbam, fasta, prefix string, maxdepth int) string {
+	vars := map[string]interface{}{
+		"md1":    strconv.Itoa(maxdepth + 1),
+		"prefix": prefix,
+		"bam":    fbam,
+		"fasta":  fasta,
+	}
+	return fasttemplate.New(mosdepthScript, "{{", "}}").ExecuteString(vars)
+}
+
+// flipProgram is the @PG ID that records that the strands of a discordant bam were flipped as
+// remove_sketchy filters it in place and the same bam is reused by a re-run.
+const flipProgram = "smoove-rf-flip"
+
+// flipHeader returns the header for a bam whose strands are to be flipped and whether they still need to be.
+// If h has no flipProgram then it is added to a copy of h.
+func flipHeader(h *sam.Header) (*sam.Header, bool, error) {
+	for _, p := range h.Progs() {
+		if p.UID() == flipProgram {
+			return h, false, nil
+		}
+	}
+	h = h.Clone()
+	return h, true, h.AddProgram(sam.NewProgram(flipProgram, "smoove", "flip strands of rf discordant reads", "", smoove.Version))
+}
+
 // run mosdepth to find high coverage regions
 // read the bed file into an interval tree, iterate over the file,
 // and only output reads that do not overlap high coverage intervals.
-func remove_sketchy(fbam string, maxdepth int, fasta string, fexclude string, filter_chroms []string, extraFilters bool) readCount {
+// remove_sketchy filters the alignments in fbam. If flip is true, the strands of each read and its mate
+// are swapped so that lumpy sees reads from an rf (mate-pair) library as fr.
+func remove_sketchy(log *shared.Logger, fbam string, maxdepth int, fasta string, fexclude string, filter_chroms []string, extraFilters bool, flip bool) (readCount, error) {
 	t0 := time.Now()
 
 	var t map[string]*interval.IntTree
@@ -205,31 +247,17 @@ func remove_sketchy(fbam string, maxdepth int, fasta string, fexclude string, fi
 	if _, err := exec.LookPath("mosdepth"); err == nil && extraFilters {
 
 		f, err := ioutil.TempFile("", "smoove-mosdepth-")
-		check(err)
+		if err != nil {
+			return readCount{}, err
+		}
 		defer f.Close()
 		defer os.Remove(f.Name())
-		cmd := `
-export MOSDEPTH_Q0=OK
-export MOSDEPTH_Q1=HIGH
-set -euo pipefail
-samtools index -c {{bam}}
-mosdepth -f {{fasta}} --fast-mode -n --quantize {{md1}}: {{prefix}} {{bam}}
-rm -f {{prefix}}.mosdepth*.dist.txt
-rm {{prefix}}.quantized.bed.gz.csi
-`
-		vars := map[string]interface{}{
-			"md1":    strconv.Itoa(maxdepth + 1),
-			"prefix": f.Name(),
-			"bam":    fbam,
-			"fasta":  fasta,
+		s := mosdepth_cmd(fbam, fasta, f.Name(), maxdepth)
+		p := shared.Command("bash", "-c", s)
+		shared.LogOutput(p, log.With("stage", "mosdepth", "tool", "mosdepth"))
+		if err := shared.RunCmd(p); err != nil {
+			return readCount{}, shared.ToolError("mosdepth for "+fbam, err)
 		}
-
-		c := fasttemplate.New(cmd, "{{", "}}")
-		s := c.ExecuteString(vars)
-		p := exec.Command("bash", "-c", s)
-		p.Stderr = os.Stderr
-		p.Stdout = os.Stderr
-		check(p.Run())
 		defer os.Remove(f.Name() + ".quantized.bed.gz")
 		defer os.Remove(fbam + ".bai")
 
@@ -239,13 +267,34 @@ rm {{prefix}}.quantized.bed.gz.csi
 	}
 
 	fbr, err := os.Open(fbam)
-	check(err)
+	if err != nil {
+		return readCount{}, err
+	}
+	defer fbr.Close()
 	br, err := bam.NewReader(fbr, 1)
-	check(err)
+	if err != nil {
+		return readCount{}, errors.Wrapf(err, "error reading %s", fbam)
+	}
 
 	fbw, err := ioutil.TempFile("", "smoove-mosdepth-bam")
-	check(err)
-	bw, err := bam.NewWriterLevel(fbw, br.Header(), 1, 1)
+	if err != nil {
+		return readCount{}, err
+	}
+	defer os.Remove(fbw.Name())
+	defer fbw.Close()
+	h := br.Header()
+	if flip {
+		if h, flip, err = flipHeader(h); err != nil {
+			return readCount{}, errors.Wrapf(err, "error adding @PG to %s", fbam)
+		}
+		if !flip {
+			log.Printf("not flipping the strands in %s as they were flipped by an earlier run", fbam)
+		}
+	}
+	bw, err := bam.NewWriterLevel(fbw, h, 1, 1)
+	if err != nil {
+		return readCount{}, err
+	}
 
 	// we know they are in order so avoid some lookups when filtering from remove chroms
 	var last string
@@ -308,59 +357,79 @@ rm {{prefix}}.quantized.bed.gz.csi
 				removed++
 				continue
 			}
+			if flip {
+				rec.Flags ^= sam.Reverse | sam.MateReverse
+			}
 			if !extraFilters {
-				check(bw.Write(rec))
+				if err := bw.Write(rec); err != nil {
+					return readCount{}, err
+				}
 				continue
 			}
 			if sketchyInterchromosomalOrSplit(rec) {
 				badInter++
 				continue
 			}
-			if isSplit && badSplitter(rec) {
-				badInter++
-				continue
+			if isSplit {
+				bad, err := badSplitter(rec)
+				if err != nil {
+					return readCount{}, shared.InputError(errors.Wrapf(err, "error checking split reads in %s", fbam))
+				}
+				if bad {
+					badInter++
+					continue
+				}
+			}
+			if err := bw.Write(rec); err != nil {
+				return readCount{}, err
 			}
-			check(bw.Write(rec))
 
 		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return readCount{}, errors.Wrapf(err, "error reading %s", fbam)
 		}
 	}
-	check(bw.Close())
-	check(br.Close())
+	if err := bw.Close(); err != nil {
+		return readCount{}, err
+	}
+	br.Close()
 	fbw.Close()
 	fbr.Close()
 	if err := os.Rename(fbw.Name(), fbam); err != nil {
 		// rename won't work cross-device so we have to copy
-		check(cp(fbam, fbw.Name()))
-		os.Remove(fbw.Name())
+		if err := cp(fbam, fbw.Name()); err != nil {
+			return readCount{}, err
+		}
 	}
 	pct := float64(removed) / float64(tot) * 100
-	shared.Slogger.Printf("removed %d alignments out of %d (%.2f%%) with low mapq, depth > %d, or from excluded chroms from %s in %.0f seconds\n",
+	log.Printf("removed %d alignments out of %d (%.2f%%) with low mapq, depth > %d, or from excluded chroms from %s in %.0f seconds\n",
 		removed, tot, pct, maxdepth, filepath.Base(fbam), time.Now().Sub(t0).Seconds())
-	//shared.Slogger.Printf("of those, %d were removed due to low mapping quality\n", lowMQ)
+	//log.Printf("of those, %d were removed due to low mapping quality\n", lowMQ)
 
 	pct = float64(badInter) / float64(tot) * 100
-	shared.Slogger.Printf("removed %d alignments out of %d (%.2f%%) that were bad interchromosomals or flanked-splitters from %s\n",
+	log.Printf("removed %d alignments out of %d (%.2f%%) that were bad interchromosomals or flanked-splitters from %s\n",
 		badInter, tot, pct, filepath.Base(fbam))
 
 	result := readCount{before: tot}
-	result.after = singletonfilter(fbam, isSplit, tot)
-	return result
+	done := shared.BeginStage("singleton_filter")
+	result.after, err = singletonfilter(log, fbam, isSplit, tot)
+	done()
+	return result, err
 }
 
 type sampleBam struct {
 	sample      string
 	bam         string
 	splitOrDisc string
+	flip        bool
 }
 
-func mapToCounts(sm *sync.Map) map[string][4]int {
+func mapToCounts(sm *sync.Map) (map[string][4]int, error) {
 	result := make(map[string][4]int)
+	var err error
 	sm.Range(func(key, value interface{}) bool {
 		k := key.(sampleBam)
 		v := value.(readCount)
@@ -372,35 +441,45 @@ func mapToCounts(sm *sync.Map) map[string][4]int {
 			tmp[1] = v.before
 			tmp[3] = v.after
 		} else {
-			panic("unknown type:" + k.splitOrDisc)
+			err = errors.Errorf("unknown type: %s", k.splitOrDisc)
+			return false
 		}
 		result[k.sample] = tmp
 
 		return true
 	})
 
-	return result
+	return result, err
 }
 
-func remove_sketchy_all(bams []filter, maxdepth int, fasta string, fexclude string, filter_chroms []string, extraFilters bool) map[string][4]int {
+func remove_sketchy_all(bams []filter, maxdepth int, fasta string, fexclude string, filter_chroms []string, extraFilters bool) (map[string][4]int, error) {
 
 	if _, err := exec.LookPath("mosdepth"); err != nil {
-		shared.Slogger.Print("mosdepth executable not found, proceeding without removing high-coverage regions.")
+		shared.Slogger.Warnf("mosdepth executable not found, proceeding without removing high-coverage regions.")
 	}
+	defer shared.BeginStage("filter")()
 
 	pch := make(chan sampleBam, runtime.GOMAXPROCS(0))
 	var wg sync.WaitGroup
 	var sm = &sync.Map{}
+	var once sync.Once
+	var first error
 
 	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
 		wg.Add(1)
 		go func() {
 			for bamp := range pch {
-				counts := remove_sketchy(bamp.bam, maxdepth, fasta, fexclude, filter_chroms, extraFilters)
-				proc := exec.Command("samtools", "index", "-c", bamp.bam)
-				proc.Stderr = os.Stderr
-				proc.Stdout = os.Stdout
-				check(proc.Run())
+				log := shared.Slogger.With("sample", bamp.sample, "stage", "filter", "reads", bamp.splitOrDisc)
+				counts, err := remove_sketchy(log, bamp.bam, maxdepth, fasta, fexclude, filter_chroms, extraFilters, bamp.flip)
+				if err == nil {
+					proc := shared.Command("samtools", "index", "-c", bamp.bam)
+					shared.LogOutput(proc, log.Tool("samtools"))
+					err = shared.ToolError("samtools index for "+bamp.bam, shared.RunCmd(proc))
+				}
+				if err != nil {
+					once.Do(func() { first = err })
+					continue
+				}
 				sm.Store(bamp, counts)
 			}
 			wg.Done()
@@ -408,7 +487,7 @@ func remove_sketchy_all(bams []filter, maxdepth int, fasta string, fexclude stri
 	}
 
 	for _, b := range bams {
-		pch <- sampleBam{bam: b.disc, sample: b.sample, splitOrDisc: "disc"}
+		pch <- sampleBam{bam: b.disc, sample: b.sample, splitOrDisc: "disc", flip: b.params.Orientation == "rf" && len(b.libs) == 0}
 	}
 	for _, b := range bams {
 		pch <- sampleBam{bam: b.split, sample: b.sample, splitOrDisc: "split"}
@@ -416,6 +495,9 @@ func remove_sketchy_all(bams []filter, maxdepth int, fasta string, fexclude stri
 	close(pch)
 
 	wg.Wait()
+	if first != nil {
+		return nil, first
+	}
 	return mapToCounts(sm)
 }
 
@@ -492,7 +574,7 @@ func tree_key_positions(rec *sam.Record) ([2]int, [2]float64) {
 	return tids, posns
 }
 
-func drop_orphans(br *bam.Reader, inters map[[2]int]*kdtree.KDTree, counts map[string]int, split bool) int {
+func drop_orphans(log *shared.Logger, br *bam.Reader, inters map[[2]int]*kdtree.KDTree, counts map[string]int, split bool) (int, error) {
 	n_dropped := 0
 	n_kept := 0
 	for {
@@ -543,13 +625,15 @@ func drop_orphans(br *bam.Reader, inters map[[2]int]*kdtree.KDTree, counts map[s
 		if err == io.EOF {
 			break
 		}
-		check(err)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	shared.Slogger.Printf("kept %d putative orphans", n_kept)
-	return n_dropped
+	log.Printf("kept %d putative orphans", n_kept)
+	return n_dropped, nil
 }
-func singletonfilter(fbam string, split bool, originalCount int) int {
+func singletonfilter(log *shared.Logger, fbam string, split bool, originalCount int) (int, error) {
 
 	t0 := time.Now()
 
@@ -557,10 +641,15 @@ func singletonfilter(fbam string, split bool, originalCount int) int {
 	inters := make(map[[2]int]*kdtree.KDTree, 20)
 
 	f, err := os.Open(fbam)
-	check(err)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
 
 	br, err := bam.NewReader(f, 1)
-	check(err)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading %s", fbam)
+	}
 
 	counts := make(map[string]int, 100)
 
@@ -605,28 +694,43 @@ func singletonfilter(fbam string, split bool, originalCount int) int {
 		if err == io.EOF {
 			break
 		}
-		check(err)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error reading %s", fbam)
+		}
 	}
 
 	f.Seek(0, os.SEEK_SET)
 	br, err = bam.NewReader(f, 1)
-	check(err)
+	if err != nil {
+		return 0, err
+	}
 	td := time.Now()
-	ndropped := drop_orphans(br, inters, counts, split)
+	ndropped, err := drop_orphans(log, br, inters, counts, split)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading %s", fbam)
+	}
 	label := "discordant"
 	if split {
 		label = "split"
 	}
-	shared.Slogger.Printf("removed %d %s orphans in %.0f seconds", ndropped, label, time.Now().Sub(td).Seconds())
+	log.Printf("removed %d %s orphans in %.0f seconds", ndropped, label, time.Now().Sub(td).Seconds())
 
 	f.Seek(0, os.SEEK_SET)
 	br, err = bam.NewReader(f, 1)
-	check(err)
+	if err != nil {
+		return 0, err
+	}
 
 	fw, err := os.Create(fbam + ".tmp.bam")
-	check(err)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(fw.Name())
+	defer fw.Close()
 	bw, err := bam.NewWriterLevel(fw, br.Header(), 1, 1)
-	check(err)
+	if err != nil {
+		return 0, err
+	}
 
 	tot, removed := 0, 0
 	nwritten := 0
@@ -643,28 +747,36 @@ func singletonfilter(fbam string, split bool, originalCount int) int {
 				removed++
 				continue
 			}
-			check(bw.Write(rec))
+			if err := bw.Write(rec); err != nil {
+				return 0, err
+			}
 			nwritten++
 		}
 
 		if err == io.EOF {
 			break
 		}
-		check(err)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error reading %s", fbam)
+		}
 	}
-	check(bw.Close())
-	check(br.Close())
+	if err := bw.Close(); err != nil {
+		return 0, err
+	}
+	br.Close()
 	_ = f.Close()
 	_ = fw.Close()
 
-	check(os.Rename(fw.Name(), f.Name()))
+	if err := os.Rename(fw.Name(), f.Name()); err != nil {
+		return 0, err
+	}
 	pct := 100 * float64(removed) / float64(tot)
 	var additional string
 	if !split {
 		additional = "and isolated interchromosomals "
 	}
-	shared.Slogger.Printf("removed %d singletons %sof %d reads (%.2f%%) from %s in %.0f seconds", removed, additional, tot, pct, filepath.Base(f.Name()), time.Now().Sub(t0).Seconds())
+	log.Printf("removed %d singletons %sof %d reads (%.2f%%) from %s in %.0f seconds", removed, additional, tot, pct, filepath.Base(f.Name()), time.Now().Sub(t0).Seconds())
 	pct = 100 * float64(nwritten) / float64(originalCount)
-	shared.Slogger.Printf("%d reads (%.2f%%) of the original %d remain from %s", nwritten, pct, originalCount, filepath.Base(f.Name()))
-	return nwritten
+	log.Printf("%d reads (%.2f%%) of the original %d remain from %s", nwritten, pct, originalCount, filepath.Base(f.Name()))
+	return nwritten, nil
 }
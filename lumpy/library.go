@@ -0,0 +1,184 @@
+package lumpy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/covstats"
+	"github.com/brentp/smoove/shared"
+	"github.com/pkg/errors"
+)
+
+// library is one of the libraries (@RG LB) of a sample with more than one. Each gets its own insert
+// size distribution and discordant reads for lumpy.
+type library struct {
+	name string
+	// rgs are the IDs of the read-groups in the library.
+	rgs    []string
+	disc   string
+	histo  string
+	stats  covstats.Stats
+	params libParams
+}
+
+var unsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// libraries returns the libraries in bam if there is more than 1. The discordant reads and histogram
+// for each library go to {outdir}/{sample}.{library}.disc.bam and .histo.
+func libraries(bam, reference, outdir, sample string) ([]library, error) {
+	byLB, err := shared.Libraries(bam, reference)
+	if err != nil {
+		return nil, shared.InputError(errors.Wrapf(err, "error reading header of %s", bam))
+	}
+	if len(byLB) < 2 {
+		return nil, nil
+	}
+	libs := make([]library, 0, len(byLB))
+	seen := make(map[string]string, len(byLB))
+	for lb, rgs := range byLB {
+		if lb == "" {
+			return nil, shared.Inputf("%s has read-groups with and without LB (%v). set the LB for all or none of them", bam, rgs)
+		}
+		name := unsafe.ReplaceAllString(lb, "_")
+		if other, ok := seen[name]; ok {
+			return nil, shared.Inputf("libraries %s and %s in %s have the same name in a file path", lb, other, bam)
+		}
+		seen[name] = lb
+		prefix := fmt.Sprintf("%s/%s.%s", outdir, sample, name)
+		libs = append(libs, library{name: lb, rgs: rgs, disc: prefix + ".disc.bam", histo: prefix + ".histo"})
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs, nil
+}
+
+// libraryStats calculates the insert size distribution of each library in f from the reads with
+// samtools view -l.
+func libraryStats(f filter, fasta string, args []string) error {
+	for i, lib := range f.libs {
+		br, err := shared.OpenLibrary(f.bam, 2, fasta, lib.name, args...)
+		if err != nil {
+			return shared.InputError(errors.Wrapf(err, "error reading library %s from %s", lib.name, f.bam))
+		}
+		f.libs[i].stats = covstats.BamStats(br.Reader, 1250000, 100000)
+		br.Close()
+		if f.libs[i].stats.MaxReadLength == 0 {
+			if br, err = shared.OpenLibrary(f.bam, 2, fasta, lib.name, args...); err != nil {
+				return shared.InputError(errors.Wrapf(err, "error reading library %s from %s", lib.name, f.bam))
+			}
+			f.libs[i].stats = covstats.BamStats(br.Reader, 1250000, 0)
+			br.Close()
+		}
+		if err := writeHist(lib.histo, f.libs[i].stats.H); err != nil {
+			return err
+		}
+		st := f.libs[i].stats
+		shared.Slogger.With("sample", f.sample, "stage", "bam_stats").Debugf("library %s insert mean: %.1f sd: %.1f read length: %d", lib.name, st.TemplateMean, st.TemplateSD, st.MaxReadLength)
+	}
+	return nil
+}
+
+// splitLibraries writes the discordant reads of f to a bam for each library using the RG of each
+// read. Reads from an rf library have their strands flipped (see remove_sketchy).
+func splitLibraries(f filter) error {
+	log := shared.Slogger.With("sample", f.sample, "stage", "split_libraries")
+	fbr, err := os.Open(f.disc)
+	if err != nil {
+		return err
+	}
+	defer fbr.Close()
+	br, err := bam.NewReader(fbr, 1)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", f.disc)
+	}
+	defer br.Close()
+
+	lib := make(map[string]int)
+	for i, l := range f.libs {
+		for _, rg := range l.rgs {
+			lib[rg] = i
+		}
+	}
+	files := make([]*os.File, len(f.libs))
+	writers := make([]*bam.Writer, len(f.libs))
+	for i, l := range f.libs {
+		if files[i], err = os.Create(l.disc); err != nil {
+			return err
+		}
+		defer files[i].Close()
+		if writers[i], err = bam.NewWriterLevel(files[i], br.Header(), 1, 1); err != nil {
+			return err
+		}
+	}
+
+	rgTag := sam.NewTag("RG")
+	counts := make([]int, len(f.libs))
+	unknown := 0
+	for {
+		rec, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s", f.disc)
+		}
+		var rg string
+		if aux := rec.AuxFields.Get(rgTag); aux != nil {
+			rg, _ = aux.Value().(string)
+		}
+		i, ok := lib[rg]
+		if !ok {
+			unknown++
+			continue
+		}
+		if f.libs[i].params.Orientation == "rf" {
+			rec.Flags ^= sam.Reverse | sam.MateReverse
+		}
+		if err := writers[i].Write(rec); err != nil {
+			return err
+		}
+		counts[i]++
+	}
+	for i, w := range writers {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := files[i].Close(); err != nil {
+			return err
+		}
+		log.Printf("wrote %d discordant reads from library %s to %s", counts[i], f.libs[i].name, f.libs[i].disc)
+	}
+	if unknown > 0 {
+		log.Warnf("skipped %d discordant reads without a read-group from a library", unknown)
+	}
+	return nil
+}
+
+// splitAll splits the discordant reads of each sample with more than one library and indexes them.
+func splitAll(filters []filter) error {
+	var done func()
+	for _, f := range filters {
+		if len(f.libs) == 0 {
+			continue
+		}
+		if done == nil {
+			done = shared.BeginStage("split_libraries")
+			defer done()
+		}
+		if err := splitLibraries(f); err != nil {
+			return err
+		}
+		for _, l := range f.libs {
+			proc := shared.Command("samtools", "index", "-c", l.disc)
+			shared.LogOutput(proc, shared.Slogger.With("sample", f.sample, "stage", "split_libraries", "tool", "samtools"))
+			if err := shared.RunCmd(proc); err != nil {
+				return shared.ToolError("samtools index for "+l.disc, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package lumpy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+)
+
+// writeLibraryBam writes a bam with read-groups r1 and r2 in library pe and r3 in library mp:1.
+func writeLibraryBam(t *testing.T, path string) {
+	ref, err := sam.NewReference("1", "", "", 100000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rg := range [][2]string{{"r1", "pe"}, {"r2", "pe"}, {"r3", "mp:1"}} {
+		r, err := sam.NewReadGroup(rg[0], "", "", rg[1], "", "", "", "s", "", "", time.Time{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.AddReadGroup(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := bam.NewWriter(f, h, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4)}
+	for i, rg := range []string{"r1", "r3", "r2", "r3"} {
+		aux, _ := sam.NewAux(sam.NewTag("RG"), rg)
+		rec, err := sam.NewRecord("q", ref, ref, 100*(i+1), 5000, 5000, 60, cigar, []byte("ACGT"), nil, []sam.Aux{aux})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Flags = sam.Paired | sam.Read1 | sam.MateReverse
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLibraries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-libraries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s.bam")
+	writeLibraryBam(t, path)
+
+	libs, err := libraries(path, "", dir, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(libs) != 2 || libs[0].name != "mp:1" || libs[1].name != "pe" || len(libs[1].rgs) != 2 {
+		t.Fatalf("unexpected libraries: %+v", libs)
+	}
+	if libs[0].disc != filepath.Join(dir, "s.mp_1.disc.bam") {
+		t.Errorf("unexpected path: %s", libs[0].disc)
+	}
+
+	c := &lumpyConfig{}
+	if err := c.add("s:mp:1", []string{"orientation=rf", "discordant_z=5"}); err != nil {
+		t.Fatal(err)
+	}
+	f := filter{sample: "s", disc: path, libs: libs}
+	filters := []filter{f}
+	if err := applyConfig(filters, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := splitLibraries(filters[0]); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{2, 2} {
+		br, err := bam.NewReader(mustOpen(t, libs[i].disc), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for {
+			rec, err := br.Read()
+			if err != nil {
+				break
+			}
+			n++
+			if reversed := rec.Flags&sam.Reverse != 0; reversed != (i == 0) {
+				t.Errorf("expected reads from %s to be flipped only if rf", libs[i].name)
+			}
+		}
+		if n != want {
+			t.Errorf("expected %d reads in %s, got %d", want, libs[i].disc, n)
+		}
+	}
+
+	cmd, err := lumpy_cmd([]cs{cs_from_filter(filters[0], dir)}, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(cmd, "-pe id:s,") != 2 || strings.Count(cmd, "-sr id:s,") != 1 || !strings.Contains(cmd, "s.mp_1.histo") || !strings.Contains(cmd, "discordant_z:5,") {
+		t.Errorf("expected a -pe for each library in %s", cmd)
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
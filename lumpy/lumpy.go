@@ -3,10 +3,10 @@ package lumpy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,7 +20,6 @@ import (
 	"github.com/biogo/hts/bgzf"
 	"github.com/biogo/hts/fai"
 	"github.com/brentp/faidx"
-	"github.com/brentp/go-athenaeum/shpool"
 	"github.com/brentp/goleft/covstats"
 	"github.com/brentp/goleft/indexcov"
 	"github.com/brentp/smoove"
@@ -42,6 +41,11 @@ type cliargs struct {
 	Genotype       bool     `arg:"help:stream output to svtyper for genotyping"`
 	DupHold        bool     `arg:"-d,help:run duphold on output. only works with --genotype"`
 	RemovePr       bool     `arg:"-x,help:remove PRPOS and PREND tags from INFO (only used with --gentoype)."`
+	CNV            string   `arg:"--cnv,help:comma-delimited list of BED or VCF of deletions and duplications from a read-depth CNV caller as sample:path (the sample can be left off with a single bam)."`
+	CNVWeight      int      `arg:"--cnv-weight,help:weight given by lumpy to each CNV relative to a discordant or split read. default is the minimum weight for a call (--support or msw and mw from --lumpy-config) so a CNV alone can be called."`
+	Bedpe          string   `arg:"--bedpe,help:comma-delimited list of BEDPE breakpoint evidence (e.g. from long reads or a previous callset) as sample:path[:weight] for lumpy. the weight defaults to 1."`
+	LumpyConfig    string   `arg:"--lumpy-config,help:file of lumpy evidence parameters (e.g. discordant_z or orientation=rf for mate-pair libraries) for all (*) or some samples. see the README."`
+	DryRun         bool     `arg:"--dry-run,help:print the commands that would be run and exit without running them."`
 	Bams           []string `arg:"positional,required,help:path to bam(s) to call."`
 }
 
@@ -49,12 +53,6 @@ func (c cliargs) Description() string {
 	return "this runs lumpy ands sends output to {outdir}/{name}-smoove.vcf.gz if --genotype is requested, the output goes to {outdir}/{name}-smoove.genotyped.vcf.gz"
 }
 
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
-}
-
 type filter struct {
 	bam     string
 	split   string
@@ -62,49 +60,83 @@ type filter struct {
 	command string
 	sample  string
 	stats   covstats.Stats
+	// linkFrom is the prefix of existing split and disc bams next to the input that are linked into outdir.
+	linkFrom string
+	// cnv is the CNV file given for the sample (if any).
+	cnv string
+	// bedpes are passed to lumpy as evidence for the sample.
+	bedpes []bedpe
+	params libParams
+	// libs are the libraries of a sample with more than one.
+	libs []library
+}
+
+// link symlinks the split and disc bams from next to the input into outdir.
+func (f filter) link() error {
+	if err := os.Symlink(f.linkFrom+".split.bam", f.split); err != nil {
+		return err
+	}
+	return os.Symlink(f.linkFrom+".disc.bam", f.disc)
 }
 
 func (f filter) histpath(outdir string) string {
 	return fmt.Sprintf("%s/%s.histo", outdir, f.sample)
 }
 
-func (fi filter) write_hist(outdir string) {
-	f, err := os.Create(fi.histpath(outdir))
-	check(err)
-	for i, v := range fi.stats.H {
+func (fi filter) write_hist(outdir string) error {
+	return writeHist(fi.histpath(outdir), fi.stats.H)
+}
+
+func writeHist(path string, H []float64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	for i, v := range H {
 		fmt.Fprintf(f, "%d\t%.12f\n", i, v)
 	}
-	f.Close()
+	return f.Close()
 }
 
-func lumpy_filter_cmd(bam string, outdir string, reference string) filter {
+func lumpy_filter_cmd(bam string, outdir string, reference string) (filter, error) {
 	// check if .split.bam and .disc.bam exist. if they do, then use.
-	sm, err := indexcov.GetShortName(bam, strings.HasSuffix(bam, ".cram"))
-	check(err)
+	format, err := shared.DetectFormat(bam)
+	if err != nil {
+		return filter{}, shared.InputError(err)
+	}
+	sm, err := indexcov.GetShortName(bam, format != shared.BAM)
+	if err != nil {
+		return filter{}, shared.InputError(errors.Wrapf(err, "error getting sample name from %s", bam))
+	}
 	prefix := fmt.Sprintf("%s/%s", outdir, sm)
+	libs, err := libraries(bam, reference, outdir, sm)
+	if err != nil {
+		return filter{}, err
+	}
+	f := filter{bam: bam, split: prefix + ".split.bam", disc: prefix + ".disc.bam", sample: sm, libs: libs}
 
 	if xopen.Exists(prefix+".split.bam") && xopen.Exists(prefix+".disc.bam") {
-		return filter{bam: bam, split: prefix + ".split.bam", disc: prefix + ".disc.bam", sample: sm}
+		return f, nil
 	}
 
 	// symlink to out dir.
 	olddir := filepath.Dir(bam)
 	if xopen.Exists(fmt.Sprintf("%s/%s.split.bam", olddir, sm)) && xopen.Exists(fmt.Sprintf("%s/%s.disc.bam", olddir, sm)) {
-		check(os.Symlink(fmt.Sprintf("%s/%s.split.bam", olddir, sm), fmt.Sprintf("%s/%s.split.bam", outdir, sm)))
-		check(os.Symlink(fmt.Sprintf("%s/%s.disc.bam", olddir, sm), fmt.Sprintf("%s/%s.disc.bam", outdir, sm)))
-		return filter{bam: bam, split: prefix + ".split.bam", disc: prefix + ".disc.bam", sample: sm}
+		f.linkFrom = fmt.Sprintf("%s/%s", olddir, sm)
+		return f, nil
 	}
 
-	f := filter{bam: bam, split: prefix + ".split.bam", disc: prefix + ".disc.bam", sample: sm}
 	// use .tmp.bam in case of error while running lumpy filter.
 	f.command = fmt.Sprintf("set -eu; lumpy_filter -f %s %s %s.tmp.bam %s.tmp.bam %d && mv %s.tmp.bam %s && mv %s.tmp.bam %s", reference, bam, f.split, f.disc, 2, f.split, f.split, f.disc, f.disc)
 	f.command += fmt.Sprintf(" && cp %s %s.orig.bam && cp %s %s.orig.bam", f.split, f.split, f.disc, f.disc)
-	return f
+	return f, nil
 }
 
 type cmdCounts struct {
 	cmd       *exec.Cmd
 	mapCounts map[string][4]int
+	// header has lines for the VCF header describing the evidence given to lumpy.
+	header []string
 }
 
 func getMaxDepth() int {
@@ -121,67 +153,154 @@ func getMaxDepth() int {
 	return n
 }
 
-func Lumpy(project, reference string, outdir string, bam_paths []string, pool *shpool.Pool, exclude_bed string, filter_chroms []string, extraFilters bool, minWeight int) cmdCounts {
-	if pool == nil {
-		pool = shpool.New(runtime.GOMAXPROCS(0), nil, &shpool.Options{LogPrefix: shared.Prefix})
-	}
+// Evidence is read-depth or other evidence given to lumpy in addition to the split and discordant reads.
+type Evidence struct {
+	// CNV are BED or VCF files of CNVs as sample:path (or just path with a single sample).
+	CNV []string
+	// CNVWeight is the weight of each CNV relative to a single split or discordant read. 0 uses the
+	// minimum weight for a call so that a CNV alone can be called.
+	CNVWeight int
+	// Bedpe are BEDPE files of breakpoints as sample:path[:weight].
+	Bedpe []string
+	// Config is the path to a file of lumpy parameters (see readLumpyConfig).
+	Config string
+}
+
+// Lumpy runs lumpy_filter and the extra filters on each bam and returns the (unstarted) lumpy command.
+func Lumpy(project, reference string, outdir string, bam_paths []string, exclude_bed string, filter_chroms []string, extraFilters bool, minWeight int, ev Evidence) (cmdCounts, error) {
 	if !xopen.Exists(outdir) {
-		os.MkdirAll(outdir, 0755)
+		if err := os.MkdirAll(outdir, 0755); err != nil {
+			return cmdCounts{}, shared.InputError(err)
+		}
 	}
 	filters := make([]filter, len(bam_paths))
+	jobs := make([]shared.Job, 0, len(bam_paths))
 	for i, p := range bam_paths {
-		filter := lumpy_filter_cmd(p, outdir, reference)
+		filter, err := lumpy_filter_cmd(p, outdir, reference)
+		if err != nil {
+			return cmdCounts{}, err
+		}
+		if filter.linkFrom != "" {
+			if err := filter.link(); err != nil {
+				return cmdCounts{}, err
+			}
+		}
 		if filter.command != "" {
-			pool.Add(shpool.Process{Command: filter.command, CPUs: 1, Prefix: "lumpy-filter"})
+			tmps := []string{filter.split + ".tmp.bam", filter.disc + ".tmp.bam"}
+			shared.RemoveOnExit(tmps...)
+			jobs = append(jobs, shared.Job{Name: p,
+				Cmds:    [][]string{{"bash", "-c", filter.command}},
+				Log:     shared.Slogger.With("sample", filter.sample, "stage", "lumpy_filter", "tool", "lumpy_filter"),
+				Done:    func() error { shared.Keep(tmps...); return nil },
+				Cleanup: func() { os.Remove(tmps[0]); os.Remove(tmps[1]) },
+			})
 		}
+		filter.params = defaultParams
 		filters[i] = filter
 	}
-	bam_stats(filters, reference, outdir)
-	if err := pool.Wait(); err != nil {
-		panic(err)
+	cfg, err := readLumpyConfig(ev.Config)
+	if err != nil {
+		return cmdCounts{}, err
+	}
+	if err := applyConfig(filters, cfg); err != nil {
+		return cmdCounts{}, err
+	}
+	msw, mw := cfg.weights(minWeight)
+	weight := cnvWeight(ev.CNVWeight, msw, mw)
+	if err := addCNVs(filters, ev.CNV, outdir, reference, weight); err != nil {
+		return cmdCounts{}, err
+	}
+	if err := addBedpes(filters, ev.Bedpe, reference); err != nil {
+		return cmdCounts{}, err
+	}
+	// lumpy_filter runs while the stats are calculated from the original bams.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ferr := make(chan error, 1)
+	go func() { ferr <- shared.Run(ctx, runtime.GOMAXPROCS(0), shared.Jobs(jobs...)) }()
+	if err := bam_stats(filters, reference, outdir); err != nil {
+		cancel()
+		<-ferr
+		return cmdCounts{}, err
+	}
+	if err := <-ferr; err != nil {
+		return cmdCounts{}, err
 	}
 
 	var maxDepth = getMaxDepth()
 
-	mapCounts := remove_sketchy_all(filters, maxDepth, reference, exclude_bed, filter_chroms, extraFilters)
-	shared.Slogger.Print("starting lumpy")
-	p := run_lumpy(filters, reference, outdir, false, project, minWeight)
-	return cmdCounts{cmd: p, mapCounts: mapCounts}
+	mapCounts, err := remove_sketchy_all(filters, maxDepth, reference, exclude_bed, filter_chroms, extraFilters)
+	if err != nil {
+		return cmdCounts{}, err
+	}
+	if err := splitAll(filters); err != nil {
+		return cmdCounts{}, err
+	}
+	shared.Slogger.With("sample", project, "stage", "lumpy").Printf("starting lumpy")
+	p, err := run_lumpy(filters, reference, outdir, project, msw, mw)
+	header := paramsHeader(filters, msw, mw)
+	return cmdCounts{cmd: p, mapCounts: mapCounts, header: append(header, evidenceHeader(filters, weight)...)}, err
 }
 
-func run_lumpy(bams []filter, fa string, outdir string, has_cnvnator bool, name string, minWeight int) *exec.Cmd {
+func run_lumpy(bams []filter, fa string, outdir string, name string, msw, mw int) (*exec.Cmd, error) {
 	if _, err := exec.LookPath("lumpy"); err != nil {
-		shared.Slogger.Fatal("lumpy not found on path")
+		return nil, shared.DependencyError(errors.New("lumpy not found on path"))
 	}
 
-	lumpy_tmpl := fmt.Sprintf("set -euo pipefail; lumpy -msw %d -mw %d -t $(mktemp) -tt 0 -P ", minWeight, minWeight)
-	pe_tmpl := "-pe id:{{.Sample}},bam_file:{{.DiscPath}},histo_file:{{.HistPath}},mean:{{.Mean}},stdev:{{.Std}},read_length:{{.ReadLength}},min_non_overlap:{{.ReadLength}},discordant_z:2.75,back_distance:30,weight:1,min_mapping_threshold:" + strconv.Itoa(int(MinMapQuality)) + " "
-	sr_tmpl := "-sr id:{{.Sample}},bam_file:{{.SplitPath}},back_distance:10,weight:1,min_mapping_threshold:" + strconv.Itoa(int(MinMapQuality)) + " "
+	samples := make([]cs, len(bams))
+	for i, sample := range bams {
+		samples[i] = cs_from_filter(sample, outdir)
+	}
+	cmdStr, err := lumpy_cmd(samples, msw, mw)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(outdir + "/" + name + "-lumpy-cmd.sh")
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	shared.Slogger.Printf("wrote lumpy command to %s", f.Name())
+	f.WriteString(cmdStr + "\n")
+	f.Close()
+
+	return shared.Command("bash", "-c", cmdStr), nil
+}
 
-	del_tmpl := "-bedpe bedpe_file:%s/%s.del.bedpe,id:%s,weight:2 "
-	dup_tmpl := "-bedpe bedpe_file:%s/%s.dup.bedpe,id:%s,weight:2 "
+// lumpy_cmd returns the bash script that runs lumpy on the filtered reads of each sample.
+func lumpy_cmd(samples []cs, msw, mw int) (string, error) {
+	lumpy_tmpl := fmt.Sprintf("set -euo pipefail; lumpy -msw %d -mw %d -t $(mktemp) -tt 0 -P ", msw, mw)
+	pe_tmpl := "-pe id:{{.Sample}},bam_file:{{.DiscPath}},histo_file:{{.HistPath}},mean:{{.Mean}},stdev:{{.Std}},read_length:{{.ReadLength}},min_non_overlap:{{.MinNonOverlap}},discordant_z:{{.Params.DiscordantZ}},back_distance:{{.Params.PEBackDistance}},weight:{{.Params.PEWeight}},min_mapping_threshold:" + strconv.Itoa(int(MinMapQuality)) + " "
+	sr_tmpl := "-sr id:{{.Sample}},bam_file:{{.SplitPath}},back_distance:{{.Params.SRBackDistance}},weight:{{.Params.SRWeight}},min_mapping_threshold:" + strconv.Itoa(int(MinMapQuality)) + " "
 
 	var buf bytes.Buffer
 
-	for _, sample := range bams {
-		S := cs_from_filter(sample, outdir)
-		t, err := template.New(sample.sample).Parse(pe_tmpl + sr_tmpl)
-		check(err)
-		check(t.Execute(&buf, S))
-		if has_cnvnator {
-			buf.Write([]byte(fmt.Sprintf(del_tmpl, outdir, sample.sample, sample.sample)))
-			buf.Write([]byte(fmt.Sprintf(dup_tmpl, outdir, sample.sample, sample.sample)))
+	pe, err := template.New("pe").Parse(pe_tmpl)
+	if err != nil {
+		return "", err
+	}
+	sr, err := template.New("sr").Parse(sr_tmpl)
+	if err != nil {
+		return "", err
+	}
+	for _, S := range samples {
+		// a sample with several libraries has a -pe for each with the same id.
+		libs := S.Libraries
+		if len(libs) == 0 {
+			libs = []cs{S}
+		}
+		for _, L := range libs {
+			if err := pe.Execute(&buf, L); err != nil {
+				return "", err
+			}
+		}
+		if err := sr.Execute(&buf, S); err != nil {
+			return "", err
+		}
+		for _, b := range S.Bedpes {
+			buf.WriteString(b.arg(S.Sample))
 		}
 	}
-
-	cmdStr := "set -euo pipefail\n" + lumpy_tmpl + buf.String()
-	f, err := os.Create(outdir + "/" + name + "-lumpy-cmd.sh")
-	check(err)
-	shared.Slogger.Write([]byte("wrote lumpy command to " + f.Name()))
-	f.WriteString(cmdStr + "\n")
-	f.Close()
-
-	return exec.Command("bash", "-c", cmdStr)
+	return "set -euo pipefail\n" + lumpy_tmpl + buf.String(), nil
 }
 
 type cs struct {
@@ -192,38 +311,101 @@ type cs struct {
 	Mean       string
 	Std        string
 	ReadLength string
+	Bedpes     []bedpe
+	// MinNonOverlap is the read length unless it is set in Params.
+	MinNonOverlap string
+	Params        libParams
+	// Libraries has the discordant reads and insert sizes of each library of a sample with more than one.
+	Libraries []cs
 }
 
 func cs_from_filter(f filter, outdir string) cs {
-	return cs{Sample: f.sample, DiscPath: f.disc, SplitPath: f.split, HistPath: f.histpath(outdir),
+	c := cs{Sample: f.sample, DiscPath: f.disc, SplitPath: f.split, HistPath: f.histpath(outdir),
 		Mean: fmt.Sprintf("%.2f", f.stats.TemplateMean), Std: fmt.Sprintf("%.2f", f.stats.TemplateSD),
-		ReadLength: strconv.Itoa(f.stats.MaxReadLength),
+		ReadLength: strconv.Itoa(f.stats.MaxReadLength), Bedpes: f.bedpes,
+	}
+	c.setParams(f.params)
+	for _, l := range f.libs {
+		lc := cs{Sample: f.sample, DiscPath: l.disc, HistPath: l.histo,
+			Mean: fmt.Sprintf("%.2f", l.stats.TemplateMean), Std: fmt.Sprintf("%.2f", l.stats.TemplateSD),
+			ReadLength: strconv.Itoa(l.stats.MaxReadLength)}
+		lc.setParams(l.params)
+		c.Libraries = append(c.Libraries, lc)
+	}
+	return c
+}
+
+func (c *cs) setParams(p libParams) {
+	c.Params = p
+	c.MinNonOverlap = c.ReadLength
+	if p.MinNonOverlap > 0 {
+		c.MinNonOverlap = strconv.Itoa(p.MinNonOverlap)
 	}
 }
 
-func bam_stats(bams []filter, fasta string, outdir string) {
-	shared.Slogger.Printf("calculating bam stats for %d bams\n", len(bams))
+// paramsHeader returns VCF header lines with the lumpy weights and the parameters for each sample.
+func paramsHeader(filters []filter, msw, mw int) []string {
+	lines := []string{fmt.Sprintf("##smoove_lumpy_weights=msw:%d,mw:%d", msw, mw)}
+	for _, f := range filters {
+		if len(f.libs) == 0 {
+			lines = append(lines, f.params.header(f.sample, "", strconv.Itoa(f.stats.MaxReadLength)))
+		}
+		for _, l := range f.libs {
+			lines = append(lines, l.params.header(f.sample, l.name, strconv.Itoa(l.stats.MaxReadLength)))
+		}
+	}
+	return lines
+}
+
+func bam_stats(bams []filter, fasta string, outdir string) error {
+	log := shared.Slogger.With("stage", "bam_stats")
+	defer shared.BeginStage("bam_stats")()
+	log.Printf("calculating bam stats for %d bams", len(bams))
 	var wg sync.WaitGroup
+	errs := make([]error, 2)
 
 	wg.Add(2)
 
 	f := func(mod int) {
+		// the pool lets a small CRAM be re-read for the second pass without decoding it again.
+		pool := shared.NewReaderPool(fasta)
 		for i, f := range bams {
 			if i%2 == mod {
 				continue
 			}
 			var args = []string{"--input-fmt-option", "required_fields=506"}
-			br, err := shared.NewReader(f.bam, 2, fasta, args...)
-			check(err)
-			bams[i].stats = covstats.BamStats(br, 1250000, 100000)
+			if len(f.libs) > 0 {
+				if err := libraryStats(f, fasta, args); err != nil {
+					errs[mod] = err
+					break
+				}
+				continue
+			}
+			br, err := pool.Open(f.bam, 2, args...)
+			if err != nil {
+				errs[mod] = shared.InputError(errors.Wrapf(err, "error reading %s", f.bam))
+				break
+			}
+			bams[i].stats = covstats.BamStats(br.Reader, 1250000, 100000)
 			if bams[i].stats.MaxReadLength == 0 {
 				br.Close()
-				br, err = shared.NewReader(f.bam, 2, fasta, args...)
-				check(err)
-				bams[i].stats = covstats.BamStats(br, 1250000, 0)
+				if br, err = pool.Open(f.bam, 2, args...); err != nil {
+					errs[mod] = shared.InputError(errors.Wrapf(err, "error reading %s", f.bam))
+					break
+				}
+				bams[i].stats = covstats.BamStats(br.Reader, 1250000, 0)
 			}
 			br.Close()
-			bams[i].write_hist(outdir)
+			if err := pool.Release(f.bam); err != nil {
+				errs[mod] = shared.ToolError("samtools", err)
+				break
+			}
+			if err := bams[i].write_hist(outdir); err != nil {
+				errs[mod] = err
+				break
+			}
+			st := bams[i].stats
+			log.With("sample", f.sample).Debugf("insert mean: %.1f sd: %.1f read length: %d", st.TemplateMean, st.TemplateSD, st.MaxReadLength)
 		}
 		wg.Done()
 	}
@@ -231,12 +413,20 @@ func bam_stats(bams []filter, fasta string, outdir string) {
 	go f(0)
 	go f(1)
 	wg.Wait()
-	shared.Slogger.Print("done calculating bam stats\n")
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("done calculating bam stats")
+	return nil
 }
 
-func writeContigs(b *bufio.Writer, fasta string) {
+func writeContigs(b *bufio.Writer, fasta string) error {
 	fa, err := faidx.New(fasta)
-	check(errors.Wrapf(err, "error opening fasta file: %s", fasta))
+	if err != nil {
+		return shared.InputError(errors.Wrapf(err, "error opening fasta file: %s", fasta))
+	}
 	ctgs := make([]fai.Record, 0, len(fa.Index))
 	for _, idx := range fa.Index {
 		ctgs = append(ctgs, idx)
@@ -245,17 +435,20 @@ func writeContigs(b *bufio.Writer, fasta string) {
 	for _, ctg := range ctgs {
 		fmt.Fprintf(b, "##contig=<ID=%s,length=%d>\n", ctg.Name, ctg.Length)
 	}
+	return nil
 }
 
-func fixStartEnd(line string) string {
+func fixStartEnd(line string) (string, error) {
 	sidx0 := strings.Index(line, "\t") + 1
 	sidx1 := sidx0 + strings.Index(line[sidx0:], "\t")
 	start, err := strconv.Atoi(line[sidx0:sidx1])
-	check(err)
+	if err != nil {
+		return line, errors.Wrapf(err, "bad position in line %s", line)
+	}
 
 	eidx0 := strings.Index(line, "END=") + 4
-	if eidx0 == -1 {
-		panic("couldn't find END= in line " + line)
+	if eidx0 == 3 {
+		return line, errors.New("couldn't find END= in line " + line)
 	}
 	eidx1 := strings.Index(line[eidx0:], ";")
 	if eidx1 == -1 {
@@ -264,17 +457,17 @@ func fixStartEnd(line string) string {
 		eidx1 += eidx0
 	}
 	end, err := strconv.Atoi(line[eidx0:eidx1])
-	if start < end {
-		return line
+	if err != nil || start < end {
+		return line, nil
 	}
 	line = line[:sidx0] + line[eidx0:eidx1] + line[sidx1:eidx0] + line[sidx0:sidx1] + line[eidx1:]
-	return line
+	return line, nil
 }
 
 // filter BND variants from in that have < bndSupport
 // also sneak in contig header.
 // and also check and fix END > POS
-func bndFilter(in io.Reader, bndSupport int, fasta string, mapCounts map[string][4]int) io.Reader {
+func bndFilter(in io.Reader, bndSupport int, fasta string, mapCounts map[string][4]int, header []string) io.Reader {
 	r, w := io.Pipe()
 	b := bufio.NewReader(in)
 	wb := bufio.NewWriter(w)
@@ -288,12 +481,18 @@ func bndFilter(in io.Reader, bndSupport int, fasta string, mapCounts map[string]
 				if line[0] == '#' {
 					wb.WriteString(line)
 					if !contigsWritten {
-						writeContigs(wb, fasta)
+						if err := writeContigs(wb, fasta); err != nil {
+							w.CloseWithError(err)
+							return
+						}
 						wb.WriteString(fmt.Sprintf("##smoove_version=%s\n", smoove.Version))
 						wb.WriteString(fmt.Sprintf("##reference=%s\n", fasta))
 						for sample, st := range mapCounts {
 							wb.WriteString(fmt.Sprintf("##smoove_count_stats=%s:%d,%d,%d,%d\n", sample, st[0], st[1], st[2], st[3]))
 						}
+						for _, h := range header {
+							wb.WriteString(h + "\n")
+						}
 						contigsWritten = true
 					}
 
@@ -313,14 +512,21 @@ func bndFilter(in io.Reader, bndSupport int, fasta string, mapCounts map[string]
 						}
 					}
 				} else {
-					line = fixStartEnd(line)
+					var ferr error
+					if line, ferr = fixStartEnd(line); ferr != nil {
+						w.CloseWithError(ferr)
+						return
+					}
 				}
 				wb.WriteString(line)
 			}
 			if err == io.EOF {
 				break
 			}
-			check(err)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
 		}
 
 	}()
@@ -331,52 +537,272 @@ const BndSupportExtra = 2
 
 var excludeNonRef = os.Getenv("SMOOVE_KEEP_ALL") != "KEEP"
 
+func defaultArgs() cliargs {
+	return cliargs{Processes: 3, ExcludeChroms: "hs37d5,~:,~^GL,~decoy", Support: 4}
+}
+
 func Main() {
-	if _, err := exec.LookPath("lumpy"); err != nil {
-		shared.Slogger.Fatal("lumpy executable not found in PATH")
-	}
-	cli := cliargs{Processes: 3, ExcludeChroms: "hs37d5,~:,~^GL,~decoy", Support: 4}
+	cli := defaultArgs()
 	arg.MustParse(&cli)
 	runtime.GOMAXPROCS(cli.Processes)
+	err := call(cli)
+	if rerr := shared.WriteReport(filepath.Join(cli.OutDir, cli.Name+"-smoove.run.json")); rerr != nil {
+		shared.Slogger.Warnf("couldn't write run report: %s", rerr)
+	}
+	if err != nil {
+		shared.Fatal(err)
+	}
+}
+
+// Call runs smoove call with args (without the program name) for use by other sub-commands. Unlike
+// Main, it doesn't set GOMAXPROCS or write a run report.
+func Call(args []string) error {
+	cli := defaultArgs()
+	if err := shared.ParseArgs(&cli, args); err != nil {
+		return err
+	}
+	return call(cli)
+}
+
+func call(cli cliargs) error {
+	if _, err := exec.LookPath("lumpy"); err != nil && !cli.DryRun {
+		return shared.DependencyError(errors.New("lumpy executable not found in PATH"))
+	}
 	filter_chroms := strings.Split(strings.TrimSpace(cli.ExcludeChroms), ",")
 	if cli.OutDir == "" {
 		cli.OutDir = "./"
 	}
 	if cli.Processes >= 3*len(cli.Bams) && len(cli.Bams) > 10 {
-		shared.Slogger.Println("smoove WARNING: smoove can only parallelize certain parts of the process.")
-		shared.Slogger.Println("smoove WARNING: If you are running on many samples in a large cohort, it will be faster...")
-		shared.Slogger.Println("smoove WARNING: to use fewer threads and distribute smoove call jobs across nodes")
+		shared.Slogger.Warnf("smoove can only parallelize certain parts of the process.")
+		shared.Slogger.Warnf("If you are running on many samples in a large cohort, it will be faster...")
+		shared.Slogger.Warnf("to use fewer threads and distribute smoove call jobs across nodes")
 	}
 
-	p := Lumpy(cli.Name, cli.Fasta, cli.OutDir, cli.Bams, nil, cli.Exclude, filter_chroms, !cli.NoExtraFilters, cli.Support)
-	p.cmd.Stderr = shared.Slogger
-	var err error
+	if err := shared.CheckReference(cli.Fasta, cli.Bams); err != nil {
+		return err
+	}
+	if cli.CNVWeight < 0 {
+		return shared.Inputf("--cnv-weight must not be negative")
+	}
+	if cli.DryRun {
+		return plan(shared.NewPlan(os.Stdout), cli)
+	}
+
+	p, err := Lumpy(cli.Name, cli.Fasta, cli.OutDir, cli.Bams, cli.Exclude, filter_chroms, !cli.NoExtraFilters, cli.Support,
+		Evidence{CNV: splitList(cli.CNV), CNVWeight: cli.CNVWeight, Bedpe: splitList(cli.Bedpe), Config: cli.LumpyConfig})
+	if err != nil {
+		return err
+	}
+	p.cmd.Stderr = shared.Slogger.With("sample", cli.Name, "stage", "lumpy", "tool", "lumpy")
 	ivcf, err := p.cmd.StdoutPipe()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := shared.StartCmd(p.cmd); err != nil {
+		return shared.ToolError("lumpy", err)
 	}
-	p.cmd.Start()
 
-	vcf := bndFilter(ivcf, cli.Support+BndSupportExtra, cli.Fasta, p.mapCounts)
+	vcf := bndFilter(ivcf, cli.Support+BndSupportExtra, cli.Fasta, p.mapCounts, p.header)
 
 	if cli.Genotype {
-		svtyper.Svtyper(vcf, cli.Fasta, cli.Bams, cli.OutDir, cli.Name, excludeNonRef, cli.RemovePr, cli.DupHold)
+		err = svtyper.Svtyper(vcf, cli.Fasta, cli.Bams, cli.OutDir, cli.Name, excludeNonRef, cli.RemovePr, cli.DupHold, "")
 	} else {
 		path := filepath.Join(cli.OutDir, cli.Name+"-smoove.vcf.gz")
-		_, wtr := bgzopen(path)
-		defer shared.Slogger.Printf("wrote to %s", path)
-		check(err)
-		defer wtr.Close()
-		io.Copy(wtr, vcf)
+		err = writeBgzip(path, vcf)
+		if err == nil {
+			shared.Slogger.Printf("wrote to %s", path)
+		}
 	}
-	p.cmd.Wait()
+	if err != nil {
+		// nothing reads the lumpy output any more so stop lumpy and the filter instead of waiting on them.
+		shared.KillCmd(p.cmd)
+		if r, ok := vcf.(io.Closer); ok {
+			r.Close()
+		}
+		shared.WaitCmd(p.cmd)
+		return err
+	}
+	if werr := shared.WaitCmd(p.cmd); werr != nil {
+		return shared.ToolError("lumpy", werr)
+	}
+	return nil
 }
 
-func bgzopen(path string) (*os.File, *bgzf.Writer) {
+// plan writes the commands that call would run without running them or writing any files. The
+// insert size statistics are only known after bam_stats so they are shell variables.
+func plan(p *shared.Plan, cli cliargs) error {
+	filters := make([]filter, len(cli.Bams))
+	for i, b := range cli.Bams {
+		f, err := lumpy_filter_cmd(b, cli.OutDir, cli.Fasta)
+		if err != nil {
+			return err
+		}
+		f.params = defaultParams
+		filters[i] = f
+	}
+	cfg, err := readLumpyConfig(cli.LumpyConfig)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(filters, cfg); err != nil {
+		return err
+	}
+	cnvs, err := parseCNVArgs(splitList(cli.CNV), sampleNames(filters))
+	if err != nil {
+		return err
+	}
+	if len(cnvs) > 0 {
+		contigs, err := referenceContigs(cli.Fasta)
+		if err != nil {
+			return err
+		}
+		for _, path := range cnvs {
+			if _, err := readCNVs(path, contigs); err != nil {
+				return err
+			}
+		}
+	}
+	msw, mw := cfg.weights(cli.Support)
+	weight := cnvWeight(cli.CNVWeight, msw, mw)
+	if err := addBedpes(filters, splitList(cli.Bedpe), cli.Fasta); err != nil {
+		return err
+	}
+	for _, f := range filters {
+		switch {
+		case f.linkFrom != "":
+			p.Step("lumpy_filter: link existing split and discordant reads for %s", f.sample)
+			p.Cmd("ln", "-s", f.linkFrom+".split.bam", f.split)
+			p.Cmd("ln", "-s", f.linkFrom+".disc.bam", f.disc)
+		case f.command == "":
+			p.Step("lumpy_filter: use existing %s and %s for %s", f.split, f.disc, f.sample)
+		default:
+			p.Step("lumpy_filter: extract split and discordant reads for %s from %s", f.sample, f.bam)
+			p.Shell(f.command)
+		}
+	}
+
+	if len(cnvs) > 0 {
+		p.Step("cnv")
+		for i, f := range filters {
+			if path, ok := cnvs[f.sample]; ok {
+				del, dup := cnvPaths(cli.OutDir, f.sample)
+				// CNV evidence goes before the --bedpe evidence in the lumpy command.
+				filters[i].cnv = path
+				filters[i].bedpes = append([]bedpe{{path: del, weight: weight, cnv: true}, {path: dup, weight: weight, cnv: true}}, f.bedpes...)
+				p.Note("converts the deletions and duplications in %s to %s and %s (files without any are left out of the lumpy command)", path, del, dup)
+			}
+		}
+	}
+	if cli.Bedpe != "" {
+		p.Step("bedpe")
+		p.Note("checks each BEDPE against the reference and adds it to the lumpy command")
+	}
+
+	p.Step("bam_stats")
+	samples := make([]cs, len(filters))
+	for i, f := range filters {
+		samples[i] = cs{Sample: f.sample, DiscPath: f.disc, SplitPath: f.split, HistPath: f.histpath(cli.OutDir),
+			Mean: fmt.Sprintf("$MEAN_%d", i+1), Std: fmt.Sprintf("$STDEV_%d", i+1), ReadLength: fmt.Sprintf("$READ_LENGTH_%d", i+1),
+			Bedpes: f.bedpes}
+		samples[i].setParams(f.params)
+		if len(f.libs) == 0 {
+			p.Note("calculates insert size statistics for %s and writes %s ($MEAN_%d, $STDEV_%d and $READ_LENGTH_%d below)", f.bam, samples[i].HistPath, i+1, i+1, i+1)
+		}
+		for j, l := range f.libs {
+			v := fmt.Sprintf("%d_%d", i+1, j+1)
+			lc := cs{Sample: f.sample, DiscPath: l.disc, HistPath: l.histo, Mean: "$MEAN_" + v, Std: "$STDEV_" + v, ReadLength: "$READ_LENGTH_" + v}
+			lc.setParams(l.params)
+			samples[i].Libraries = append(samples[i].Libraries, lc)
+			p.Note("calculates insert size statistics for library %s in %s and writes %s ($MEAN_%s, $STDEV_%s and $READ_LENGTH_%s below)", l.name, f.bam, l.histo, v, v, v)
+		}
+	}
+
+	p.Step("filter")
+	maxDepth := getMaxDepth()
+	_, err = exec.LookPath("mosdepth")
+	mosdepth := err == nil && !cli.NoExtraFilters
+	for _, reads := range []string{"disc", "split"} {
+		for _, f := range filters {
+			bam := f.disc
+			if reads == "split" {
+				bam = f.split
+			}
+			if mosdepth {
+				p.Shell(mosdepth_cmd(bam, cli.Fasta, fmt.Sprintf("$TMPDIR/smoove-mosdepth-%s.%s", f.sample, reads), maxDepth))
+				p.Note("removes alignments from %s with depth > %d", bam, maxDepth)
+			}
+			p.Note("removes alignments from %s with low mapq or in excluded regions or chromosomes, bad interchromosomals and orphans", bam)
+			if reads == "disc" && f.params.Orientation == "rf" && len(f.libs) == 0 {
+				p.Note("flips the strands of the discordant reads in %s as the library is rf unless an earlier run already did", bam)
+			}
+			p.Cmd("samtools", "index", "-c", bam)
+		}
+	}
+	for _, f := range filters {
+		if len(f.libs) == 0 {
+			continue
+		}
+		p.Step("split_libraries: %s has %d libraries", f.sample, len(f.libs))
+		for _, l := range f.libs {
+			p.Note("writes the discordant reads in %s from read-groups %s (library %s) to %s", f.disc, strings.Join(l.rgs, ","), l.name, l.disc)
+			if l.params.Orientation == "rf" {
+				p.Note("flips the strands of the discordant reads in %s as the library is rf", l.disc)
+			}
+			p.Cmd("samtools", "index", "-c", l.disc)
+		}
+	}
+
+	p.Step("lumpy")
+	cmdStr, err := lumpy_cmd(samples, msw, mw)
+	if err != nil {
+		return err
+	}
+	lumpyVCF := "$TMPDIR/" + cli.Name + "-lumpy.vcf"
+	p.Note("writes this command (with the insert sizes from bam_stats) to %s", filepath.Join(cli.OutDir, cli.Name+"-lumpy-cmd.sh"))
+	p.Commented(strings.TrimPrefix(cmdStr, "set -euo pipefail\n") + "> " + shared.Quote(lumpyVCF))
+	p.Note("removes BNDs with support < %d from the lumpy output", cli.Support+BndSupportExtra)
+	p.Note("adds ##smoove_lumpy_weights and ##smoove_lumpy_library lines with the parameters above to the VCF header")
+	for _, h := range evidenceHeader(filters, weight) {
+		p.Note("adds %s to the VCF header", h)
+	}
+	if cli.Genotype {
+		svtyper.Plan(p, lumpyVCF, cli.Fasta, cli.Bams, cli.OutDir, cli.Name, excludeNonRef, cli.RemovePr, cli.DupHold, "")
+	} else {
+		p.Note("writes %s", filepath.Join(cli.OutDir, cli.Name+"-smoove.vcf.gz"))
+	}
+	return nil
+}
 
+// splitList splits a comma-delimited argument, ignoring empty entries.
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// writeBgzip writes everything from r to a BGZF file at path.
+func writeBgzip(path string, r io.Reader) error {
 	f, err := os.Create(path)
-	check(err)
+	if err != nil {
+		return shared.InputError(err)
+	}
+	shared.RemoveOnExit(path)
+	defer f.Close()
 	w := bgzf.NewWriter(f, 1)
-	return f, w
-
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	shared.Keep(path)
+	return nil
 }
@@ -1,41 +1,56 @@
 package lumpy
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/smoove/shared"
 
 	. "gopkg.in/check.v1"
 )
 
 func TestStartEndFix(t *testing.T) {
+	fix := func(line string) string {
+		out, err := fixStartEnd(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
 	in := "1	1116265	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116258"
-	out := fixStartEnd(in)
+	out := fix(in)
 	if out != "1	1116258	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265" {
 		t.Errorf("didn't switch")
 	}
 
 	in = "1	1116265	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116258;"
-	if fixStartEnd(in) != "1	1116258	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265;" {
+	if fix(in) != "1	1116258	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265;" {
 		t.Errorf("didn't switch")
 	}
 
 	in = "1	1116258	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265;"
-	if fixStartEnd(in) != in {
+	if fix(in) != in {
 		t.Errorf("unneeded switch")
 	}
 
 	in = "1	1116265	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=111;"
-	if fixStartEnd(in) != "1	111	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265;" {
-		t.Errorf("improper switch: %s", fixStartEnd(in))
+	if fix(in) != "1	111	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265;" {
+		t.Errorf("improper switch: %s", fix(in))
 	}
 
 	in = "1	1116265	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=111"
-	if fixStartEnd(in) != "1	111	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265" {
-		t.Errorf("improper switch: %s", fixStartEnd(in))
+	if fix(in) != "1	111	3510	N	<DEL>	0	.	SVTYPE=DEL;SVLEN=7;END=1116265" {
+		t.Errorf("improper switch: %s", fix(in))
 	}
 
+	if _, err := fixStartEnd("1	x	3510	N	<DEL>	0	.	SVTYPE=DEL;END=111"); err == nil {
+		t.Errorf("expected error for bad position")
+	}
 }
 
 func Test(t *testing.T) { TestingT(t) }
@@ -65,3 +80,63 @@ func (s *LumpyTest) TestNM(c *C) {
 	c.Assert(nm(r), Equals, 0)
 
 }
+
+func TestFlipHeader(t *testing.T) {
+	ref, err := sam.NewReference("1", "", "", 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, flip, err := flipHeader(h)
+	if err != nil || !flip || len(h.Progs()) != 0 {
+		t.Fatalf("expected to flip without changing the original header: %v %v", flip, err)
+	}
+
+	// the @PG must survive writing the bam so that a re-run doesn't flip the reads back.
+	var buf bytes.Buffer
+	w, err := bam.NewWriter(&buf, fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	br, err := bam.NewReader(&buf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	if _, flip, err := flipHeader(br.Header()); err != nil || flip {
+		t.Errorf("expected an already flipped bam to not be flipped again: %v %v", flip, err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	var b strings.Builder
+	outdir := filepath.Join(os.TempDir(), "smoove-plan-test")
+	cli := cliargs{Name: "proj", Fasta: "ref.fa", OutDir: outdir, Support: 4, Genotype: true, Bams: []string{"t.bam"}}
+	if err := plan(shared.NewPlan(&b), cli); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outdir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to not be created", outdir)
+	}
+	for _, want := range []string{"lumpy_filter -f ref.fa t.bam", "samtools index -c " + outdir + "/100016.split.bam",
+		"mean:$MEAN_1,stdev:$STDEV_1", `> "$TMPDIR/proj-lumpy.vcf"`, `svtyper -i "$chunk"`, "gsort /dev/stdin ref.fa.fai"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("expected %q in plan:\n%s", want, b.String())
+		}
+	}
+	// commands that need results from smoove itself are commented out.
+	for _, line := range strings.Split(b.String(), "\n") {
+		if !strings.HasPrefix(line, "#") && (strings.Contains(line, "$MEAN_") || strings.Contains(line, "$chunk") || strings.Contains(line, "/dev/stdin")) {
+			t.Errorf("expected %q to be commented out", line)
+		}
+	}
+	if strings.HasPrefix(b.String(), "#!") || strings.Contains(b.String(), "\nset -euo pipefail\n") {
+		t.Errorf("expected the plan to not claim to be a runnable script:\n%s", b.String())
+	}
+}
@@ -0,0 +1,212 @@
+package lumpy
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/smoove/shared"
+	"github.com/brentp/xopen"
+)
+
+// libParams are the lumpy -pe and -sr parameters for a library.
+type libParams struct {
+	// Orientation is fr for paired-end or rf for mate-pair libraries. The strands of discordant
+	// reads from rf libraries are flipped before lumpy as it only models fr.
+	Orientation    string
+	DiscordantZ    float64
+	PEBackDistance int
+	PEWeight       int
+	SRBackDistance int
+	SRWeight       int
+	// MinNonOverlap of 0 uses the read length.
+	MinNonOverlap int
+}
+
+var defaultParams = libParams{Orientation: "fr", DiscordantZ: 2.75, PEBackDistance: 30, PEWeight: 1, SRBackDistance: 10, SRWeight: 1}
+
+func (p *libParams) set(key, val string) error {
+	if key == "orientation" {
+		if val != "fr" && val != "rf" {
+			return fmt.Errorf("orientation must be fr or rf, got %s", val)
+		}
+		p.Orientation = val
+		return nil
+	}
+	if key == "discordant_z" {
+		z, err := strconv.ParseFloat(val, 64)
+		if err != nil || z <= 0 {
+			return fmt.Errorf("discordant_z must be a positive number, got %s", val)
+		}
+		p.DiscordantZ = z
+		return nil
+	}
+	ints := map[string]*int{"pe_back_distance": &p.PEBackDistance, "pe_weight": &p.PEWeight,
+		"sr_back_distance": &p.SRBackDistance, "sr_weight": &p.SRWeight, "min_non_overlap": &p.MinNonOverlap}
+	v, ok := ints[key]
+	if !ok {
+		return fmt.Errorf("unknown parameter %s", key)
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 || (n == 0 && strings.HasSuffix(key, "_weight")) {
+		return fmt.Errorf("%s must be a non-negative integer (and at least 1 for a weight), got %s", key, val)
+	}
+	*v = n
+	return nil
+}
+
+// header returns the VCF header line describing the parameters used for sample.
+// lib is empty for a sample with a single library.
+func (p libParams) header(sample, lib, readLength string) string {
+	mno := readLength
+	if p.MinNonOverlap > 0 {
+		mno = strconv.Itoa(p.MinNonOverlap)
+	}
+	if lib != "" {
+		sample += ",LB=" + lib
+	}
+	return fmt.Sprintf("##smoove_lumpy_library=<ID=%s,orientation=%s,discordant_z=%g,pe_back_distance=%d,pe_weight=%d,sr_back_distance=%d,sr_weight=%d,min_non_overlap=%s>",
+		sample, p.Orientation, p.DiscordantZ, p.PEBackDistance, p.PEWeight, p.SRBackDistance, p.SRWeight, mno)
+}
+
+// lumpyConfig is read from --lumpy-config. Each line has a sample (or * for all samples or sample:LB for
+// a library of a sample) followed by whitespace-delimited key=value parameters. Sample lines override
+// * lines and library lines override both. msw and mw (the lumpy minimum sample weight and minimum
+// weight for a call) may only be given for *.
+type lumpyConfig struct {
+	msw, mw int
+	lines   []configLine
+}
+
+type configLine struct {
+	target string
+	kvs    [][2]string
+}
+
+func readLumpyConfig(path string) (*lumpyConfig, error) {
+	c := &lumpyConfig{}
+	if path == "" {
+		return c, nil
+	}
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, shared.InputError(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		toks := strings.Fields(scanner.Text())
+		if len(toks) == 0 || toks[0][0] == '#' {
+			continue
+		}
+		if err := c.add(toks[0], toks[1:]); err != nil {
+			return nil, shared.Inputf("error on line %d of %s: %s", i, path, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, shared.InputError(err)
+	}
+	return c, nil
+}
+
+func (c *lumpyConfig) add(target string, kvs []string) error {
+	l := configLine{target: target}
+	var scratch libParams
+	for _, kv := range kvs {
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return fmt.Errorf("expected key=value, got %s", kv)
+		}
+		key, val := kv[:i], kv[i+1:]
+		if key == "msw" || key == "mw" {
+			if target != "*" {
+				return fmt.Errorf("%s applies to all samples so it must be given for *", key)
+			}
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return fmt.Errorf("%s must be a positive integer, got %s", key, val)
+			}
+			if key == "msw" {
+				c.msw = n
+			} else {
+				c.mw = n
+			}
+			continue
+		}
+		if err := scratch.set(key, val); err != nil {
+			return err
+		}
+		l.kvs = append(l.kvs, [2]string{key, val})
+	}
+	c.lines = append(c.lines, l)
+	return nil
+}
+
+// params returns the parameters for sample (and lib if it isn't empty): the defaults updated by * lines,
+// then lines for sample, then lines for sample:lib.
+func (c *lumpyConfig) params(sample, lib string) libParams {
+	p := defaultParams
+	targets := []string{"*", sample}
+	if lib != "" {
+		targets = append(targets, sample+":"+lib)
+	}
+	for _, target := range targets {
+		for _, l := range c.lines {
+			if l.target == target {
+				for _, kv := range l.kvs {
+					p.set(kv[0], kv[1])
+				}
+			}
+		}
+	}
+	return p
+}
+
+// weights returns the lumpy -msw and -mw. Each defaults to support.
+func (c *lumpyConfig) weights(support int) (msw, mw int) {
+	msw, mw = support, support
+	if c.msw > 0 {
+		msw = c.msw
+	}
+	if c.mw > 0 {
+		mw = c.mw
+	}
+	return msw, mw
+}
+
+// check returns an error if the config has a sample (or sample:LB) that isn't in targets.
+func (c *lumpyConfig) check(targets []string) error {
+	var unknown []string
+	for _, l := range c.lines {
+		if l.target != "*" && !hasSample(targets, l.target) {
+			unknown = append(unknown, l.target)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return shared.Inputf("--lumpy-config has samples %s that are not in the bams (%s)", strings.Join(unknown, ","), strings.Join(targets, ","))
+	}
+	return nil
+}
+
+// applyConfig sets the parameters for each filter and library from c.
+func applyConfig(filters []filter, c *lumpyConfig) error {
+	targets := sampleNames(filters)
+	for _, f := range filters {
+		for _, l := range f.libs {
+			targets = append(targets, f.sample+":"+l.name)
+		}
+	}
+	if err := c.check(targets); err != nil {
+		return err
+	}
+	for i, f := range filters {
+		filters[i].params = c.params(f.sample, "")
+		for j, l := range f.libs {
+			filters[i].libs[j].params = c.params(f.sample, l.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package lumpy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLumpyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lumpy.txt")
+	ioutil.WriteFile(path, []byte("# sample\tparameters\nmp orientation=rf discordant_z=4 pe_back_distance=100\n*\tmsw=3 sr_weight=2\n"), 0644)
+
+	c, err := readLumpyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msw, mw := c.weights(5); msw != 3 || mw != 5 {
+		t.Errorf("unexpected weights: %d %d", msw, mw)
+	}
+	mp, pe := c.params("mp", ""), c.params("pe", "")
+	if mp.Orientation != "rf" || mp.DiscordantZ != 4 || mp.PEBackDistance != 100 || mp.SRWeight != 2 {
+		t.Errorf("unexpected params for mp: %+v", mp)
+	}
+	if pe.Orientation != "fr" || pe.DiscordantZ != 2.75 || pe.PEBackDistance != 30 || pe.SRWeight != 2 {
+		t.Errorf("unexpected params for pe: %+v", pe)
+	}
+	if err := c.check([]string{"pe"}); err == nil {
+		t.Errorf("expected an error for an unknown sample")
+	}
+
+	for _, bad := range []string{"mp msw=2", "* orientation=ff", "* pe_weight=0", "* x=1", "* discordant_z"} {
+		toks := strings.Fields(bad)
+		if err := (&lumpyConfig{}).add(toks[0], toks[1:]); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	s := cs{Sample: "mp", ReadLength: "150"}
+	s.setParams(mp)
+	cmd, err := lumpy_cmd([]cs{s}, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"lumpy -msw 3 -mw 5 ", "min_non_overlap:150,discordant_z:4,back_distance:100,weight:1,", "-sr id:mp,bam_file:,back_distance:10,weight:2,"} {
+		if !strings.Contains(cmd, want) {
+			t.Errorf("expected %q in %s", want, cmd)
+		}
+	}
+	if h := mp.header("mp", "", "150"); h != "##smoove_lumpy_library=<ID=mp,orientation=rf,discordant_z=4,pe_back_distance=100,pe_weight=1,sr_back_distance=10,sr_weight=2,min_non_overlap=150>" {
+		t.Errorf("unexpected header: %s", h)
+	}
+}
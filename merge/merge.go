@@ -6,7 +6,6 @@ import (
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -15,6 +14,7 @@ import (
 	arg "github.com/alexflint/go-arg"
 	"github.com/brentp/smoove/shared"
 	"github.com/brentp/xopen"
+	"github.com/pkg/errors"
 )
 
 type cliargs struct {
@@ -22,6 +22,7 @@ type cliargs struct {
 	OutDir string   `arg:"-o,help:output directory."`
 	Fasta  string   `arg:"-f,required,help:fasta file."`
 	VCFs   []string `arg:"positional,required,help:path to vcfs."`
+	DryRun bool     `arg:"--dry-run,help:print the commands that would be run and exit without running them."`
 }
 
 type cliplotargs struct {
@@ -37,15 +38,6 @@ type count struct {
 	disc_after   int
 }
 
-func mustInt(s string) int {
-	r, err := strconv.Atoi(s)
-	if err != nil {
-		panic(err)
-	}
-	return r
-
-}
-
 const tmpl = `
 <!DOCTYPE html>
 <html lang="en">
@@ -92,107 +84,181 @@ Created by <a href="https://github.com/brentp/smoove">smoove</a>
 </html>
 `
 
-func mustMarshal(x interface{}) string {
-	v, err := json.Marshal(x)
-	if err != nil {
-		panic(err)
-	}
-	return string(v)
-}
-
 func PlotCountsMain() {
 	cli := cliplotargs{}
 	arg.MustParse(&cli)
-	plotCounts(cli.VCF, cli.HTML)
+	if err := plotCounts(cli.VCF, cli.HTML); err != nil {
+		shared.Fatal(err)
+	}
 }
 
-func plotCounts(path string, outpath string) {
+var countsPatt = regexp.MustCompile("[,:]")
+
+// parseCounts parses the sample and counts from a line like:
+// ##smoove_count_stats=sample:4494396,7960884,747932,297854
+func parseCounts(line string) (string, [4]int, error) {
+	var counts [4]int
+	line = strings.TrimRight(line, "\r\n")
+	tmp := strings.SplitN(line, "=", 2)
+	info := countsPatt.Split(tmp[len(tmp)-1], -1)
+	if len(tmp) != 2 || len(info) != 5 {
+		return "", counts, fmt.Errorf("expected sample:split_before,disc_before,split_after,disc_after in %s", line)
+	}
+	for i := range counts {
+		var err error
+		if counts[i], err = strconv.Atoi(info[i+1]); err != nil {
+			return "", counts, fmt.Errorf("bad count in %s: %s", line, err)
+		}
+	}
+	return info[0], counts, nil
+}
+
+func plotCounts(path string, outpath string) error {
 	// see: https://plot.ly/javascript/line-and-scatter/
 	f, err := xopen.Ropen(path)
-	defer f.Close()
 	if err != nil {
-		panic(err)
+		return shared.InputError(err)
 	}
+	defer f.Close()
 
 	split_before := make([]int, 0, 16)
 	split_after := make([]int, 0, 16)
 	disc_before := make([]int, 0, 16)
 	disc_after := make([]int, 0, 16)
 	samples := make([]string, 0, 16)
-	patt := regexp.MustCompile("[,:]")
 
 	for {
 		line, err := f.ReadString('\n')
-		if err == io.EOF {
-			break
+		if err != nil && err != io.EOF {
+			return shared.InputError(errors.Wrapf(err, "error reading %s", path))
 		}
-		if line[0] != '#' {
+		if len(line) == 0 || line[0] != '#' {
 			break
 		}
-		if !strings.HasPrefix(line, "##smoove_count_stats=") {
-			continue
+		if strings.HasPrefix(line, "##smoove_count_stats=") {
+			sample, counts, perr := parseCounts(line)
+			if perr != nil {
+				return shared.Inputf("error in header of %s: %s", path, perr)
+			}
+			samples = append(samples, sample)
+			split_before = append(split_before, counts[0])
+			disc_before = append(disc_before, counts[1])
+			split_after = append(split_after, counts[2])
+			disc_after = append(disc_after, counts[3])
+		}
+		if err == io.EOF {
+			break
 		}
-		// ##smoove_count_stats=sample:4494396,7960884,747932,297854
-		tmp := strings.Split(line, "=")
-		info := patt.Split(strings.TrimRight(tmp[1], "\r\n"), -1)
-		samples = append(samples, info[0])
-		split_before = append(split_before, mustInt(info[1]))
-		disc_before = append(disc_before, mustInt(info[2]))
-		split_after = append(split_after, mustInt(info[3]))
-		disc_after = append(disc_after, mustInt(info[4]))
 	}
 	rng := make([]int, len(disc_after))
 	for i := 0; i < len(rng); i++ {
 		rng[i] = i
 	}
+	vals := []interface{}{split_before, disc_before, samples, rng, split_after, disc_after, samples, rng}
+	js := make([]interface{}, len(vals))
+	for i, v := range vals {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		js[i] = string(b)
+	}
+
 	wtr, err := xopen.Wopen(outpath)
 	if err != nil {
-		panic(err)
+		return shared.InputError(err)
 	}
-
-	fmt.Fprintf(wtr, tmpl, mustMarshal(split_before), mustMarshal(disc_before), mustMarshal(samples), mustMarshal(rng), mustMarshal(split_after), mustMarshal(disc_after), mustMarshal(samples), mustMarshal(rng))
-	wtr.Close()
-	shared.Slogger.Printf("wrote html file of disc, split counts to %s", wtr.Name())
-
+	fmt.Fprintf(wtr, tmpl, js...)
+	if err := wtr.Close(); err != nil {
+		return errors.Wrapf(err, "error writing %s", outpath)
+	}
+	shared.Slogger.Printf("wrote html file of disc, split counts to %s", outpath)
+	return nil
 }
 
 func Main() {
 
 	cli := cliargs{OutDir: "./"}
 	arg.MustParse(&cli)
+	if err := merge(cli); err != nil {
+		shared.Fatal(err)
+	}
+}
+
+// Run runs smoove merge with args (without the program name) for use by other sub-commands.
+func Run(args []string) error {
+	cli := cliargs{OutDir: "./"}
+	if err := shared.ParseArgs(&cli, args); err != nil {
+		return err
+	}
+	return merge(cli)
+}
+
+func merge(cli cliargs) error {
+	if err := shared.CheckVCFReference(cli.Fasta, cli.VCFs); err != nil {
+		return err
+	}
+	if cli.DryRun {
+		plan(shared.NewPlan(os.Stdout), cli)
+		return nil
+	}
+	if shared.HasProg("svtools") != "Y" {
+		return shared.DependencyError(fmt.Errorf("svtools is required for smoove merge"))
+	}
 	shared.Slogger.Printf("merging %d files", len(cli.VCFs))
 
 	f, err := xopen.Wopen(filepath.Join(cli.OutDir, cli.Name) + ".lsort.vcf")
 	if err != nil {
-		panic(err)
+		return shared.InputError(err)
 	}
+	shared.RemoveOnExit(f.Name())
 
-	args := []string{"lsort", "-r", "-t", os.TempDir(), "-b", "400"}
-	args = append(args, cli.VCFs...)
+	args := lsortArgs(cli.VCFs)
 	shared.Slogger.Printf("finished sorting %d files; merge starting.", len(cli.VCFs))
 
-	p := exec.Command("svtools", args...)
-	p.Stderr = shared.Slogger
+	p := shared.Command("svtools", args...)
+	p.Stderr = shared.Slogger.With("stage", "merge", "tool", "svtools")
 	p.Stdout = f
 
-	if err := p.Run(); err != nil {
-		log.Fatal(err)
+	if err := shared.RunCmd(p); err != nil {
+		f.Close()
+		return shared.ToolError("svtools lsort", err)
 	}
 	f.Close()
 	of := filepath.Join(cli.OutDir, cli.Name) + ".sites.vcf.gz"
-	p = exec.Command("bash", "-c", fmt.Sprintf("set -euo pipefail; svtools lmerge -f 20 -i %s | grep -v '^##bcftools_viewCommand' | bgzip -c > %s", f.Name(), of))
-	p.Stderr = shared.Slogger
-	p.Stdout = shared.Slogger
-	if err := p.Run(); err != nil {
+	shared.RemoveOnExit(of)
+	p = shared.Command("bash", "-c", lmergeCmd(f.Name(), of))
+	shared.LogOutput(p, shared.Slogger.With("stage", "merge", "tool", "svtools"))
+	if err := shared.RunCmd(p); err != nil {
 		if strings.Contains(err.Error(), "Required tag PREND") {
 			log.Println("[smoove] use e.g.: `for f in *.genotyped.vcf.gz; do echo -n $f' '; bcftools view -H $f | grep -cv PREND; done | awk '$2 != 0'` to find the bad files.")
 		}
 		if strings.Contains(err.Error(), "Required tag PRPOS") {
 			log.Println("[smoove] use e.g.: `for f in *.genotyped.vcf.gz; do echo -n $f' '; bcftools view -H $f | grep -cv PRPOS; done | awk '$2 != 0'` to find the bad files.")
 		}
-		log.Fatal(err)
+		return shared.ToolError("svtools lmerge", err)
 	}
 	os.Remove(f.Name())
+	shared.Keep(f.Name(), of)
 	shared.Slogger.Printf("wrote sites file to %s", of)
-	plotCounts(of, filepath.Join(cli.OutDir, cli.Name)+".smoove-counts.html")
+	return plotCounts(of, filepath.Join(cli.OutDir, cli.Name)+".smoove-counts.html")
+}
+
+func lsortArgs(vcfs []string) []string {
+	return append([]string{"lsort", "-r", "-t", os.TempDir(), "-b", "400"}, vcfs...)
+}
+
+func lmergeCmd(sorted, out string) string {
+	return fmt.Sprintf("set -euo pipefail; svtools lmerge -f 20 -i %s | grep -v '^##bcftools_viewCommand' | bgzip -c > %s", sorted, out)
+}
+
+// plan writes the commands that merge would run.
+func plan(p *shared.Plan, cli cliargs) {
+	prefix := filepath.Join(cli.OutDir, cli.Name)
+	p.Step("merge: sort the sites from %d files", len(cli.VCFs))
+	p.Shell(shared.Quote(append([]string{"svtools"}, lsortArgs(cli.VCFs)...)...) + " > " + shared.Quote(prefix+".lsort.vcf"))
+	p.Step("merge: merge the sorted sites and write %s.sites.vcf.gz", prefix)
+	p.Cmd("bash", "-c", lmergeCmd(prefix+".lsort.vcf", prefix+".sites.vcf.gz"))
+	p.Cmd("rm", prefix+".lsort.vcf")
+	p.Note("plots the split and discordant read counts to %s.smoove-counts.html", prefix)
 }
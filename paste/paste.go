@@ -3,8 +3,7 @@ package paste
 import (
 	"fmt"
 	"io"
-	"log"
-	"os/exec"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -18,18 +17,19 @@ type cliargs struct {
 	Name   string   `arg:"-n,required,help:project name used in output files."`
 	OutDir string   `arg:"-o,help:output directory."`
 	VCFs   []string `arg:"positional,required,help:path to vcfs."`
+	DryRun bool     `arg:"--dry-run,help:print the commands that would be run and exit without running them."`
 }
 
 func (c *cliargs) Description() string {
 	return "square VCF files from different samples with the same number of records"
 }
 
-func countNonHeaderLines(path string) int {
+func countNonHeaderLines(path string) (int, error) {
 	f, err := xopen.Ropen(path)
-	defer f.Close()
 	if err != nil {
-		log.Fatal(err)
+		return 0, shared.InputError(err)
 	}
+	defer f.Close()
 	count := 0
 	for {
 		line, err := f.ReadBytes('\n')
@@ -42,27 +42,34 @@ func countNonHeaderLines(path string) int {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return 0, shared.InputError(fmt.Errorf("error reading %s: %w", path, err))
 		}
 	}
 
-	return count
+	return count, nil
 }
 
-func count(wg *sync.WaitGroup, procs int, vcfs []string) {
+// count checks that each of the vcfs has the same number of variants.
+func count(procs int, vcfs []string) error {
 
 	m := make(map[int][]string, 5)
 	L := sync.Mutex{}
+	var first error
 
+	var wg sync.WaitGroup
 	ch := make(chan string, 3)
 	for i := 0; i < procs; i++ {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for path := range ch {
-				c := countNonHeaderLines(path)
+				c, err := countNonHeaderLines(path)
 				L.Lock()
+				if err != nil && first == nil {
+					first = err
+				}
 				m[c] = append(m[c], path)
 				L.Unlock()
-				wg.Done()
 			}
 
 		}()
@@ -74,6 +81,9 @@ func count(wg *sync.WaitGroup, procs int, vcfs []string) {
 	close(ch)
 
 	wg.Wait()
+	if first != nil {
+		return first
+	}
 	if len(m) != 1 {
 		for k, fs := range m {
 			if k == 0 {
@@ -87,48 +97,76 @@ func count(wg *sync.WaitGroup, procs int, vcfs []string) {
 			}
 
 		}
-		shared.Slogger.Fatal("please make sure that all files have the same number of variants")
+		return shared.Inputf("please make sure that all files have the same number of variants")
 	}
 	for k := range m {
 		shared.Slogger.Printf("all files had %d variants", k)
 	}
+	return nil
 }
 
 func Main() {
 
 	cli := cliargs{OutDir: "./"}
 	arg.MustParse(&cli)
+	if err := paste(cli); err != nil {
+		shared.Fatal(err)
+	}
+}
+
+// Run runs smoove paste with args (without the program name) for use by other sub-commands.
+func Run(args []string) error {
+	cli := cliargs{OutDir: "./"}
+	if err := shared.ParseArgs(&cli, args); err != nil {
+		return err
+	}
+	return paste(cli)
+}
+
+func paste(cli cliargs) error {
 	outvcf := fmt.Sprintf(filepath.Join(cli.OutDir, cli.Name) + ".smoove.square.vcf.gz")
-	var wg *sync.WaitGroup
+	if cli.DryRun {
+		p := shared.NewPlan(os.Stdout)
+		p.Step("paste: square %d files to %s", len(cli.VCFs), outvcf)
+		if !strings.HasSuffix(cli.VCFs[0], ".list") {
+			p.Note("checks that each file has the same number of variants")
+		}
+		p.Cmd(append([]string{"bcftools"}, mergeArgs(outvcf, cli.VCFs)...)...)
+		return nil
+	}
+	var counted chan error
 
 	// TODO: check files in list
 	if !strings.HasSuffix(cli.VCFs[0], ".list") {
-		wg = &sync.WaitGroup{}
-		wg.Add(len(cli.VCFs))
-		procs := 5
-
-		go count(wg, procs, cli.VCFs)
+		counted = make(chan error, 1)
+		go func() { counted <- count(5, cli.VCFs) }()
 		shared.Slogger.Printf("squaring %d files to %s", len(cli.VCFs), outvcf)
 	} else {
 		shared.Slogger.Printf("squaring files from %s to %s", cli.VCFs[0], outvcf)
 	}
 
-	args := []string{"merge", "-o", outvcf, "-O", "z", "--threads", "3"}
-	if strings.HasSuffix(cli.VCFs[0], ".list") && len(cli.VCFs) == 1 {
-		args = append(args, []string{"-l", cli.VCFs[0]}...)
-	} else {
-		args = append(args, cli.VCFs...)
-	}
-
-	p := exec.Command("bcftools", args...)
-	p.Stderr = shared.Slogger
-	p.Stdout = shared.Slogger
+	p := shared.Command("bcftools", mergeArgs(outvcf, cli.VCFs)...)
+	shared.LogOutput(p, shared.Slogger.With("stage", "paste", "tool", "bcftools"))
 
-	if err := p.Run(); err != nil {
-		log.Fatal(err)
+	shared.RemoveOnExit(outvcf)
+	if err := shared.RunCmd(p); err != nil {
+		return shared.ToolError("bcftools merge", err)
 	}
+	if counted != nil {
+		if err := <-counted; err != nil {
+			return err
+		}
+	}
+	shared.Keep(outvcf)
 	shared.Slogger.Printf("wrote squared file to %s", outvcf)
-	if wg != nil {
-		wg.Wait()
+	return nil
+}
+
+// mergeArgs are the arguments to bcftools to merge the vcfs (or the files in a .list) to outvcf.
+func mergeArgs(outvcf string, vcfs []string) []string {
+	args := []string{"merge", "-o", outvcf, "-O", "z", "--threads", "3"}
+	if strings.HasSuffix(vcfs[0], ".list") && len(vcfs) == 1 {
+		return append(args, []string{"-l", vcfs[0]}...)
 	}
+	return append(args, vcfs...)
 }
@@ -0,0 +1,117 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Exit codes. These are documented in the README so that workflow managers can decide whether
+// to retry: only ExitTool is likely to succeed on a retry.
+const (
+	// ExitInput is for bad arguments or input files (e.g. a missing fasta index or an unreadable BAM).
+	ExitInput = 2
+	// ExitDependency is for a required program that is missing or too old.
+	ExitDependency = 3
+	// ExitTool is for an external program (lumpy, svtyper, samtools, ...) that failed.
+	ExitTool = 4
+	// ExitInternal is for a bug in smoove.
+	ExitInternal = 5
+)
+
+// Kind is the category of an Error and determines the exit code.
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindInput
+	KindDependency
+	KindTool
+)
+
+// Error wraps an error with its Kind.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+func wrap(k Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: k, Err: err}
+}
+
+// InputError marks err as caused by the user's arguments or input files. It returns nil if err is nil.
+func InputError(err error) error { return wrap(KindInput, err) }
+
+// DependencyError marks err as caused by a missing or outdated program. It returns nil if err is nil.
+func DependencyError(err error) error { return wrap(KindDependency, err) }
+
+// ToolError marks err as a failure of the external program name. It returns nil if err is nil.
+func ToolError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return wrap(KindTool, fmt.Errorf("error running %s: %w", name, err))
+}
+
+// Inputf returns a new input error.
+func Inputf(format string, args ...interface{}) error {
+	return InputError(fmt.Errorf(format, args...))
+}
+
+// ExitCode returns the exit code for err. Errors without a Kind are categorized by type where
+// possible (e.g. a failed command is a tool error and a missing file is an input error) and are
+// otherwise treated as internal.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		switch e.Kind {
+		case KindInput:
+			return ExitInput
+		case KindDependency:
+			return ExitDependency
+		case KindTool:
+			return ExitTool
+		}
+		return ExitInternal
+	}
+	var je *JobError
+	var ee *exec.ExitError
+	if errors.As(err, &je) || errors.As(err, &ee) {
+		return ExitTool
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return ExitDependency
+	}
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return ExitInput
+	}
+	return ExitInternal
+}
+
+// Fatal logs err, removes temporary files and partial outputs and exits with the code for err.
+// If smoove is being interrupted, the error is likely from a killed child so Fatal waits for the
+// signal handler to exit instead.
+func Fatal(err error) {
+	if super.isStopping() {
+		select {}
+	}
+	code := ExitCode(err)
+	if code == ExitInternal {
+		Slogger.Errorf("internal error (please report at https://github.com/brentp/smoove/issues): %s", err)
+	} else {
+		Slogger.Errorf("%s", err)
+	}
+	super.removePaths()
+	os.Exit(code)
+}
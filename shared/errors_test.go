@@ -0,0 +1,35 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	_, notFound := exec.LookPath("smoove-no-such-program")
+	_, pathErr := os.Open("/no/such/smoove/file")
+	exitErr := exec.Command("false").Run()
+
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{InputError(nil), 0},
+		{Inputf("bad %s", "arg"), ExitInput},
+		{fmt.Errorf("wrapped: %w", DependencyError(errors.New("no lumpy"))), ExitDependency},
+		{ToolError("lumpy", errors.New("segfault")), ExitTool},
+		{&JobError{Name: "chunk", Err: errors.New("failed")}, ExitTool},
+		{exitErr, ExitTool},
+		{notFound, ExitDependency},
+		{pathErr, ExitInput},
+		{errors.New("bug"), ExitInternal},
+	} {
+		if got := ExitCode(tc.err); got != tc.code {
+			t.Errorf("ExitCode(%v): got %d, want %d", tc.err, got, tc.code)
+		}
+	}
+}
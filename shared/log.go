@@ -0,0 +1,305 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "info"
+}
+
+// ParseLevel returns the level for debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q. use debug, info, warn or error", s)
+}
+
+// sink is where all Loggers derived from Slogger write. The format and level are set once
+// by ConfigureLogging.
+type sink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	json  bool
+	level Level
+	now   func() time.Time
+}
+
+// Logger writes levelled messages with fields such as sample, stage, chunk and tool. As an
+// io.Writer (e.g. the Stderr of a child process) each line written is logged as a message so
+// that output from parallel processes can be attributed.
+type Logger struct {
+	s      *sink
+	fields []string
+	// partial holds the end of what was written after the last newline.
+	mu      sync.Mutex
+	partial []byte
+}
+
+// maxPartial is the longest partial line that is held before it is logged without a newline.
+const maxPartial = 64 << 10
+
+const Prefix = "[smoove]"
+
+var Slogger *Logger
+
+func init() {
+	Slogger = &Logger{s: &sink{w: os.Stderr, level: LevelInfo, now: time.Now}}
+}
+
+// ConfigureLogging sets the format (text or json) and the minimum level for all loggers. Output
+// from the standard log package is sent through Slogger so that it has the same format.
+func ConfigureLogging(format string, level Level) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q. use text or json", format)
+	}
+	Slogger.s.mu.Lock()
+	Slogger.s.json = format == "json"
+	Slogger.s.level = level
+	Slogger.s.mu.Unlock()
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(Slogger)
+	return nil
+}
+
+// LogFlags removes --log-format and --log-level (and their values) from args so that they can be
+// given to any sub-command. The values default to $SMOOVE_LOG_FORMAT and $SMOOVE_LOG_LEVEL.
+func LogFlags(args []string) (rest []string, format string, level Level, err error) {
+	format, lvl := os.Getenv("SMOOVE_LOG_FORMAT"), os.Getenv("SMOOVE_LOG_LEVEL")
+	if format == "" {
+		format = "text"
+	}
+	if lvl == "" {
+		lvl = "info"
+	}
+	rest = make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		var val *string
+		switch {
+		case a == "--log-format" || a == "--log-level":
+			if i+1 == len(args) {
+				return nil, format, LevelInfo, fmt.Errorf("%s requires a value", a)
+			}
+			i++
+			if a == "--log-format" {
+				format = args[i]
+			} else {
+				lvl = args[i]
+			}
+			continue
+		case strings.HasPrefix(a, "--log-format="):
+			val = &format
+		case strings.HasPrefix(a, "--log-level="):
+			val = &lvl
+		default:
+			rest = append(rest, a)
+			continue
+		}
+		*val = a[strings.Index(a, "=")+1:]
+	}
+	level, err = ParseLevel(lvl)
+	return rest, format, level, err
+}
+
+// With returns a Logger that adds the key, value pairs to each message. A key that is already set
+// is replaced (e.g. to give a different stage to one command).
+func (l *Logger) With(kv ...string) *Logger {
+	if len(kv)%2 != 0 {
+		kv = append(kv, "")
+	}
+	fields := make([]string, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	for i := 0; i < len(kv); i += 2 {
+		j := 0
+		for ; j < len(fields); j += 2 {
+			if fields[j] == kv[i] {
+				fields[j+1] = kv[i+1]
+				break
+			}
+		}
+		if j == len(fields) {
+			fields = append(fields, kv[i], kv[i+1])
+		}
+	}
+	return &Logger{s: l.s, fields: fields}
+}
+
+// has reports whether the logger already has a value for key.
+func (l *Logger) has(key string) bool {
+	for i := 0; i < len(l.fields); i += 2 {
+		if l.fields[i] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// field returns the value for key or "" if it isn't set.
+func (l *Logger) field(key string) string {
+	for i := 0; i < len(l.fields); i += 2 {
+		if l.fields[i] == key {
+			return l.fields[i+1]
+		}
+	}
+	return ""
+}
+
+func (l *Logger) log(level Level, msg string) {
+	s := l.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if level < s.level {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n")
+	t := s.now()
+	var b bytes.Buffer
+	if s.json {
+		b.WriteString(`{"time":`)
+		writeJSON(&b, t.Format(time.RFC3339))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		for i := 0; i < len(l.fields); i += 2 {
+			b.WriteByte(',')
+			writeJSON(&b, l.fields[i])
+			b.WriteByte(':')
+			writeJSON(&b, l.fields[i+1])
+		}
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		b.WriteString("}\n")
+	} else {
+		b.WriteString(Prefix + " " + t.Format("2006/01/02 15:04:05") + " ")
+		if level != LevelInfo {
+			b.WriteString(strings.ToUpper(level.String()) + ": ")
+		}
+		if len(l.fields) > 0 {
+			b.WriteByte('[')
+			for i := 0; i < len(l.fields); i += 2 {
+				if i > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(l.fields[i] + "=" + l.fields[i+1])
+			}
+			b.WriteString("] ")
+		}
+		b.WriteString(msg)
+		b.WriteByte('\n')
+	}
+	s.w.Write(b.Bytes())
+}
+
+func writeJSON(b *bytes.Buffer, s string) {
+	v, _ := json.Marshal(s)
+	b.Write(v)
+}
+
+// Debugf logs a message that is only shown with --log-level debug.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+// Printf, Print and Println log at the info level as they did when Logger was a log.Logger.
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Print(args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprint(args...))
+}
+
+func (l *Logger) Println(args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintln(args...))
+}
+
+// Write logs each non-empty line of b as a message. b is not treated as a format string. A line
+// that is split across writes is logged once its newline is written or the Logger is closed.
+func (l *Logger) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data := b
+	if len(l.partial) > 0 {
+		data = append(l.partial, b...)
+		l.partial = nil
+	}
+	i := bytes.LastIndexByte(data, '\n')
+	if len(data)-i-1 > maxPartial {
+		i = len(data) - 1
+	}
+	l.logLines(data[:i+1])
+	if rest := data[i+1:]; len(rest) > 0 {
+		l.partial = append([]byte(nil), rest...)
+	}
+	return len(b), nil
+}
+
+// Close logs any partial line that is left from Write. The Logger can still be used.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logLines(l.partial)
+	l.partial = nil
+	return nil
+}
+
+func (l *Logger) logLines(b []byte) {
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			l.log(LevelInfo, line)
+		}
+	}
+}
+
+// Tool returns a Logger for the stderr of the program name.
+func (l *Logger) Tool(name string) *Logger {
+	if l.has("tool") {
+		return l
+	}
+	return l.With("tool", name)
+}
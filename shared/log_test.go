@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLogger(json bool, level Level) (*Logger, *bytes.Buffer) {
+	var b bytes.Buffer
+	now := func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	return &Logger{s: &sink{w: &b, json: json, level: level, now: now}}, &b
+}
+
+func TestLoggerText(t *testing.T) {
+	l, b := testLogger(false, LevelInfo)
+	l.With("sample", "NA12878").Tool("svtyper").Write([]byte("50% done %s\n\nnext line\n"))
+	l.Debugf("hidden")
+	l.Warnf("low depth in %s", "chr1")
+	want := `[smoove] 2020/01/02 03:04:05 [sample=NA12878 tool=svtyper] 50% done %s
+[smoove] 2020/01/02 03:04:05 [sample=NA12878 tool=svtyper] next line
+[smoove] 2020/01/02 03:04:05 WARN: low depth in chr1
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestLoggerPartialLines(t *testing.T) {
+	l, b := testLogger(false, LevelInfo)
+	w := l.Tool("lumpy")
+	for _, s := range []string{"Reading ", "chr1", "...\nReading chr2", "...\r\n", "done"} {
+		w.Write([]byte(s))
+	}
+	want := `[smoove] 2020/01/02 03:04:05 [tool=lumpy] Reading chr1...
+[smoove] 2020/01/02 03:04:05 [tool=lumpy] Reading chr2...
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+	w.Close()
+	if want += "[smoove] 2020/01/02 03:04:05 [tool=lumpy] done\n"; b.String() != want {
+		t.Errorf("expected the partial line to be logged on close. got:\n%s", b.String())
+	}
+
+	// the last line of a command is logged when it exits.
+	b.Reset()
+	cmd := Command("printf", "a\nb")
+	LogOutput(cmd, l.Tool("printf"))
+	if err := RunCmd(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(b.String(), "[tool=printf"); got != 2 || !strings.HasSuffix(b.String(), "] b\n") {
+		t.Errorf("expected 2 lines, got:\n%s", b.String())
+	}
+
+	// partial lines on stdout and stderr of a job are not joined.
+	b.Reset()
+	j := Job{Name: "j", Log: l, Cmds: [][]string{{"bash", "-c", "printf out; printf err >&2; sleep 0.1; printf ' 1'; printf ' 2' >&2"}}}
+	if err := j.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "[tool=bash stream=stdout] out 1\n") || !strings.Contains(b.String(), "[tool=bash] err 2\n") {
+		t.Errorf("expected separate stdout and stderr lines, got:\n%s", b.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, b := testLogger(true, LevelDebug)
+	l.With("stage", "svtyper", "chunk", "3").Tool("bcftools").Tool("ignored").Errorf("bad \"quote\"")
+	var m map[string]string
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatalf("%s: %s", err, b.String())
+	}
+	want := map[string]string{"time": "2020-01-02T03:04:05Z", "level": "error", "stage": "svtyper", "chunk": "3", "tool": "bcftools", "msg": `bad "quote"`}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	rest, format, level, err := LogFlags([]string{"-n", "x", "--log-format", "json", "--log-level=debug", "a.bam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rest, " ") != "-n x a.bam" || format != "json" || level != LevelDebug {
+		t.Errorf("got %v %s %s", rest, format, level)
+	}
+	if _, _, _, err := LogFlags([]string{"--log-level", "loud"}); err == nil {
+		t.Errorf("expected error for unknown level")
+	}
+	if _, _, _, err := LogFlags([]string{"--log-format"}); err == nil {
+		t.Errorf("expected error for missing value")
+	}
+}
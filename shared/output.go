@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/bgzf"
+	"github.com/pkg/errors"
+)
+
+// OpenOutput returns a buffered writer to path (or stdout if path is empty or "-") and a function that
+// flushes and closes it. Paths ending in .gz are written as BGZF and paths ending in .bcf are converted
+// by bcftools; both are indexed with bcftools when it is closed.
+func OpenOutput(path string, procs int) (io.Writer, func() error, error) {
+	if path == "" || path == "-" {
+		b := bufio.NewWriter(os.Stdout)
+		return b, b.Flush, nil
+	}
+	if procs < 1 {
+		procs = 1
+	}
+	if strings.HasSuffix(path, ".bcf") {
+		return openBcf(path, procs)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, InputError(err)
+	}
+	RemoveOnExit(path)
+	if !strings.HasSuffix(path, ".gz") {
+		b := bufio.NewWriter(f)
+		return b, func() error {
+			if err := b.Flush(); err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			Keep(path)
+			return nil
+		}, nil
+	}
+	z := bgzf.NewWriter(f, procs)
+	b := bufio.NewWriterSize(z, 65536)
+	return b, func() error {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		Keep(path)
+		return index(path, procs)
+	}, nil
+}
+
+func openBcf(path string, procs int) (io.Writer, func() error, error) {
+	cmd := Command("bcftools", "view", "-O", "b", "--threads", strconv.Itoa(procs), "-o", path)
+	LogOutput(cmd, Slogger.Tool("bcftools"))
+	p, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	RemoveOnExit(path)
+	if err := StartCmd(cmd); err != nil {
+		p.Close()
+		return nil, nil, DependencyError(errors.Wrapf(err, "error starting bcftools to write %s", path))
+	}
+	b := bufio.NewWriterSize(p, 65536)
+	return b, func() error {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		if err := p.Close(); err != nil {
+			return err
+		}
+		if err := WaitCmd(cmd); err != nil {
+			return ToolError("bcftools", errors.Wrapf(err, "error writing %s", path))
+		}
+		Keep(path)
+		return index(path, procs)
+	}, nil
+}
+
+func index(path string, procs int) error {
+	if HasProg("bcftools") != "Y" {
+		Slogger.Warnf("bcftools not found; not indexing %s", path)
+		return nil
+	}
+	cmd := Command("bcftools", "index", "-f", "--threads", strconv.Itoa(procs), path)
+	LogOutput(cmd, Slogger.Tool("bcftools"))
+	return ToolError("bcftools index", RunCmd(cmd))
+}
@@ -0,0 +1,78 @@
+package shared
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/brentp/smoove"
+)
+
+// Plan writes the external commands that a sub-command would run for --dry-run. It is not a runnable
+// script: steps that smoove does itself (e.g. bam stats or filtering reads) have no shell equivalent
+// and are written as comments starting with "# smoove:", and commands that need their results are
+// written commented out.
+type Plan struct {
+	w io.Writer
+}
+
+// CommandLine is a copy of os.Args from before main removes the sub-command.
+var CommandLine = append([]string(nil), os.Args...)
+
+// NewPlan writes the header of the plan to w.
+func NewPlan(w io.Writer) *Plan {
+	fmt.Fprintf(w, "# commands that smoove %s would run for: %s\n", smoove.Version, Quote(CommandLine...))
+	fmt.Fprintf(w, "# this is not a runnable script. lines starting with \"# smoove:\" are done by smoove itself and\n")
+	fmt.Fprintf(w, "# commands that need their results (e.g. the insert size from bam_stats) start with \"#   \".\n")
+	fmt.Fprintf(w, "TMPDIR=${TMPDIR:-/tmp}\n")
+	return &Plan{w: w}
+}
+
+// Step starts a new section of the script.
+func (p *Plan) Step(format string, args ...interface{}) {
+	fmt.Fprintf(p.w, "\n# %s\n", fmt.Sprintf(format, args...))
+}
+
+// Note describes work done by smoove itself.
+func (p *Plan) Note(format string, args ...interface{}) {
+	fmt.Fprintf(p.w, "# smoove: %s\n", fmt.Sprintf(format, args...))
+}
+
+// Cmd writes a command with its arguments quoted for the shell.
+func (p *Plan) Cmd(args ...string) {
+	fmt.Fprintln(p.w, Quote(args...))
+}
+
+// Shell writes s as is. Use it for commands that smoove already runs with bash -c.
+func (p *Plan) Shell(s string) {
+	fmt.Fprintln(p.w, strings.TrimRight(strings.TrimLeft(s, "\n"), " \n"))
+}
+
+// Commented writes each line of s commented out. Use it for commands that need the results of steps
+// that smoove does itself or that read what smoove sends to them.
+func (p *Plan) Commented(s string) {
+	for _, line := range strings.Split(strings.TrimRight(strings.TrimLeft(s, "\n"), " \n"), "\n") {
+		fmt.Fprintln(p.w, "#   "+line)
+	}
+}
+
+var safe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+var variable = regexp.MustCompile(`^\$[A-Za-z_][A-Za-z0-9_]*[A-Za-z0-9_@%+=:,./-]*$`)
+
+// Quote joins args with spaces, quoting any that contain characters special to the shell. An
+// argument that starts with a variable (e.g. $chunk.vcf) is double-quoted so that it is expanded.
+func Quote(args ...string) string {
+	q := make([]string, len(args))
+	for i, a := range args {
+		if safe.MatchString(a) {
+			q[i] = a
+		} else if variable.MatchString(a) {
+			q[i] = `"` + a + `"`
+		} else {
+			q[i] = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(q, " ")
+}
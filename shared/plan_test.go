@@ -0,0 +1,11 @@
+package shared
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	got := Quote("svtyper", "-B", "a.bam,b c.bam", "-o", "$chunk.vcf", "it's", "$(rm -rf /)")
+	want := `svtyper -B 'a.bam,b c.bam' -o "$chunk.vcf" 'it'\''s' '$(rm -rf /)'`
+	if got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
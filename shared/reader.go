@@ -0,0 +1,387 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/pkg/errors"
+)
+
+// Format is an alignment file format detected from the first bytes of the file.
+type Format int
+
+const (
+	// Other is SAM, a URL, or anything else that is read with samtools.
+	Other Format = iota
+	BAM
+	CRAM
+)
+
+func (f Format) String() string {
+	switch f {
+	case BAM:
+		return "BAM"
+	case CRAM:
+		return "CRAM"
+	}
+	return "other"
+}
+
+// DetectFormat reads the magic bytes of path so that the extension doesn't matter.
+// Remote paths (e.g. http:// or s3://) are always Other.
+func DetectFormat(path string) (Format, error) {
+	if strings.Contains(path, "://") {
+		return Other, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Other, err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return Other, nil
+	}
+	if bytes.Equal(magic, []byte("CRAM")) {
+		return CRAM, nil
+	}
+	if magic[0] != 0x1f || magic[1] != 0x8b {
+		return Other, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Other, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return Other, nil
+	}
+	if _, err := io.ReadFull(gz, magic); err == nil && bytes.Equal(magic, []byte("BAM\x01")) {
+		return BAM, nil
+	}
+	return Other, nil
+}
+
+// SampleName returns the SM of the first read-group in the header of path or, if there is none,
+// the file name without its extension. It is used to label log messages.
+func SampleName(path, fasta string) string {
+	if h, err := readHeader(path, fasta); err == nil {
+		for _, rg := range h.RGs() {
+			if sm := rg.Get(sam.NewTag("SM")); sm != "" {
+				return sm
+			}
+		}
+	}
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Libraries returns the read-group IDs of each library (the LB of each @RG) in the header of path.
+// Read-groups without an LB are in the library "".
+func Libraries(path, fasta string) (map[string][]string, error) {
+	h, err := readHeader(path, fasta)
+	if err != nil {
+		return nil, err
+	}
+	libs := make(map[string][]string)
+	for _, rg := range h.RGs() {
+		lb := rg.Get(sam.NewTag("LB"))
+		libs[lb] = append(libs[lb], rg.Name())
+	}
+	return libs, nil
+}
+
+// Reader is a bam.Reader whose Close also closes the underlying file or samtools process.
+type Reader struct {
+	*bam.Reader
+	c io.Closer
+}
+
+// Close closes the bam.Reader and then the file or process that it reads from.
+func (r *Reader) Close() error {
+	err := r.Reader.Close()
+	if cerr := r.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NewReader returns a bam.Reader from any path that samtools can read. The file or samtools process
+// is closed once it has been read to the end; if it is read only in part it stays open until smoove
+// exits.
+//
+// Deprecated: use Open, whose Close releases the file or process. NewReader is kept for goleft
+// covstats, which needs a *bam.Reader.
+func NewReader(path string, rd int, fasta string, args ...string) (*bam.Reader, error) {
+	r, err := open(path, rd, fasta, true, args)
+	if err != nil {
+		return nil, err
+	}
+	return r.Reader, nil
+}
+
+// Open returns a Reader from any path that samtools can read. BAM files are read directly and
+// others are decoded by samtools with args added to the view command.
+func Open(path string, rd int, fasta string, args ...string) (*Reader, error) {
+	return open(path, rd, fasta, false, args)
+}
+
+func open(path string, rd int, fasta string, atEOF bool, args []string) (*Reader, error) {
+	format, err := DetectFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == BAM {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var src io.Reader = f
+		if atEOF {
+			src = &eofCloser{r: f, c: f}
+		}
+		br, err := bam.NewReader(src, rd)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &Reader{Reader: br, c: f}, nil
+	}
+	s, err := startStream(path, fasta, false, args)
+	if err != nil {
+		return nil, err
+	}
+	return s.reader(rd, nil, atEOF)
+}
+
+// eofCloser closes c when r returns an error (usually io.EOF).
+type eofCloser struct {
+	r   io.Reader
+	c   io.Closer
+	err error
+}
+
+func (e *eofCloser) Read(b []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	k, err := e.r.Read(b)
+	if err != nil {
+		e.err = err
+		if cerr := e.c.Close(); cerr != nil && err == io.EOF {
+			e.err = cerr
+		}
+	}
+	return k, e.err
+}
+
+// OpenLibrary returns a Reader of the alignments from library lib (an @RG LB) in path. It always uses
+// samtools (even for BAM) with args added to the view command.
+func OpenLibrary(path string, rd int, fasta, lib string, args ...string) (*Reader, error) {
+	s, err := startStream(path, fasta, false, append([]string{"-l", lib}, args...))
+	if err != nil {
+		return nil, err
+	}
+	return s.reader(rd, nil, false)
+}
+
+// maxSpool is the largest stream that a ReaderPool keeps to re-read. lumpy only re-opens a path when
+// the first pass of bam stats found no mapped reads after skipping 100000, which usually means the
+// file has fewer records than that. This holds 100000 records of up to 2.5KB each. A path that is
+// re-opened after reading more than this is decoded again by a new samtools process.
+const maxSpool = 256 << 20
+
+// ReaderPool starts a single samtools process per path. What it decodes is spooled to a temporary
+// file so that re-opening the path reads from the start without decoding it again. Only one
+// Reader for a path may be open at a time; Release must be called when done with a path.
+type ReaderPool struct {
+	mu      sync.Mutex
+	fasta   string
+	streams map[string]*stream
+}
+
+// NewReaderPool returns a pool that uses fasta to decode CRAM.
+func NewReaderPool(fasta string) *ReaderPool {
+	return &ReaderPool{fasta: fasta, streams: make(map[string]*stream)}
+}
+
+// Open returns a Reader from the start of path. BAM files are read directly.
+func (p *ReaderPool) Open(path string, rd int, args ...string) (*Reader, error) {
+	if format, err := DetectFormat(path); err != nil || format == BAM {
+		return Open(path, rd, p.fasta, args...)
+	}
+	key := path + "\t" + strings.Join(args, " ")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.streams[key]
+	if ok && (s.active || s.spool == nil) {
+		// the start of the stream is no longer available.
+		s.close()
+		ok = false
+	}
+	if !ok {
+		var err error
+		if s, err = startStream(path, p.fasta, true, args); err != nil {
+			return nil, err
+		}
+		p.streams[key] = s
+	}
+	s.active = true
+	return s.reader(rd, p, false)
+}
+
+// Release stops the samtools processes for path and removes their spooled output.
+func (p *ReaderPool) Release(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	for key, s := range p.streams {
+		if strings.HasPrefix(key, path+"\t") {
+			if cerr := s.close(); err == nil {
+				err = cerr
+			}
+			delete(p.streams, key)
+		}
+	}
+	return err
+}
+
+// stream is the output of a samtools process that is optionally spooled to a file so it can be re-read.
+type stream struct {
+	cmd *exec.Cmd
+	out io.ReadCloser
+	// spool holds all n bytes read from the process or is nil if spooling was not requested or stopped.
+	spool  *os.File
+	n      int64
+	err    error
+	active bool
+	closed bool
+}
+
+func startStream(path, fasta string, spool bool, args []string) (*stream, error) {
+	vargs := []string{"view", "-T", fasta, "-u", path}
+	vargs = append(vargs, args...)
+	cmd := Command("samtools", vargs...)
+	cmd.Stderr = Slogger.With("tool", "samtools", "file", filepath.Base(path))
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting stdout for process")
+	}
+	s := &stream{cmd: cmd, out: pipe}
+	if spool {
+		if s.spool, err = ioutil.TempFile("", "smoove-spool-"); err != nil {
+			return nil, err
+		}
+		RemoveOnExit(s.spool.Name())
+	}
+	if err = StartCmd(cmd); err != nil {
+		pipe.Close()
+		s.removeSpool()
+		return nil, errors.Wrap(err, "error starting process")
+	}
+	return s, nil
+}
+
+// reader returns a Reader of s. If atEOF, s is closed when it has been read to the end.
+func (s *stream) reader(rd int, p *ReaderPool, atEOF bool) (*Reader, error) {
+	sr := &streamReader{s: s, p: p}
+	var src io.Reader = sr
+	if atEOF {
+		src = &eofCloser{r: sr, c: sr}
+	}
+	br, err := bam.NewReader(src, rd)
+	if err != nil {
+		// a pooled stream that is closed is replaced on the next Open.
+		s.close()
+		return nil, err
+	}
+	return &Reader{Reader: br, c: sr}, nil
+}
+
+func (s *stream) removeSpool() {
+	if s.spool != nil {
+		s.spool.Close()
+		os.Remove(s.spool.Name())
+		Keep(s.spool.Name())
+		s.spool = nil
+	}
+}
+
+// readAt reads from the spool if off is before the end of what has been read from the process.
+func (s *stream) readAt(b []byte, off int64) (int, error) {
+	if off < s.n {
+		if s.spool == nil {
+			return 0, errors.New("smoove: spooled samtools output is no longer available")
+		}
+		if int64(len(b)) > s.n-off {
+			b = b[:s.n-off]
+		}
+		return s.spool.ReadAt(b, off)
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	k, err := s.out.Read(b)
+	if k > 0 && s.spool != nil {
+		if s.n+int64(k) > maxSpool {
+			s.removeSpool()
+		} else if _, werr := s.spool.WriteAt(b[:k], s.n); werr != nil {
+			s.removeSpool()
+		}
+	}
+	s.n += int64(k)
+	if err != nil {
+		s.err = err
+	}
+	return k, err
+}
+
+// close waits for a process that has finished or kills one that is still writing.
+func (s *stream) close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	defer s.removeSpool()
+	if s.err == io.EOF {
+		if err := WaitCmd(s.cmd); err != nil {
+			return errors.Wrap(err, "error closing cram reader")
+		}
+		return nil
+	}
+	killGroup(s.cmd, syscall.SIGKILL)
+	WaitCmd(s.cmd)
+	return nil
+}
+
+type streamReader struct {
+	s   *stream
+	off int64
+	// p is nil if the stream isn't pooled and is closed with the reader.
+	p *ReaderPool
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	k, err := r.s.readAt(b, r.off)
+	r.off += int64(k)
+	return k, err
+}
+
+func (r *streamReader) Close() error {
+	if r.p == nil {
+		return r.s.close()
+	}
+	r.p.mu.Lock()
+	r.s.active = false
+	r.p.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,171 @@
+package shared
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+)
+
+func writeBAM(t *testing.T, path string, n int) {
+	ref, err := sam.NewReference("chr1", "", "", 100000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := bam.NewWriter(f, h, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		r, err := sam.NewRecord("r", ref, ref, i*10, i*10, 100, 60, []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 10)},
+			bytes.Repeat([]byte{'A'}, 10), bytes.Repeat([]byte{30}, 10), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func count(t *testing.T, r *Reader) int {
+	var n int
+	for {
+		_, err := r.Read()
+		if err == io.EOF {
+			return n
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	dir := t.TempDir()
+	bpath := filepath.Join(dir, "x.BAM")
+	writeBAM(t, bpath, 1)
+	link := filepath.Join(dir, "noext")
+	if err := os.Symlink(bpath, link); err != nil {
+		t.Fatal(err)
+	}
+	cram := filepath.Join(dir, "x.bam")
+	if err := ioutil.WriteFile(cram, []byte("CRAM\x03\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	samPath := filepath.Join(dir, "x.sam")
+	if err := ioutil.WriteFile(samPath, []byte("@HD\tVN:1.6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]Format{bpath: BAM, link: BAM, cram: CRAM, samPath: Other, "https://example.com/x.bam": Other} {
+		got, err := DetectFormat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+}
+
+// fakeSamtools logs each call and writes the BAM in FAKE_BAM for any input.
+const fakeSamtools = `#!/bin/sh
+echo "$@" >> $RUN_LOG
+cat $FAKE_BAM
+`
+
+func TestReaderPool(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "samtools"), []byte(fakeSamtools), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	runLog := filepath.Join(dir, "runs.log")
+	defer os.Unsetenv("RUN_LOG")
+	os.Setenv("RUN_LOG", runLog)
+	bpath := filepath.Join(dir, "x.bam")
+	writeBAM(t, bpath, 2000)
+	defer os.Unsetenv("FAKE_BAM")
+	os.Setenv("FAKE_BAM", bpath)
+	cram := filepath.Join(dir, "x.cram")
+	if err := ioutil.WriteFile(cram, []byte("CRAM\x03\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewReaderPool("ref.fa")
+	for i := 0; i < 2; i++ {
+		r, err := pool.Open(cram, 1, "--input-fmt-option", "required_fields=506")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, r); n != 2000 {
+			t.Errorf("pass %d: expected 2000 reads, got %d", i, n)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.Release(cram); err != nil {
+		t.Fatal(err)
+	}
+	runs, _ := ioutil.ReadFile(runLog)
+	if c := strings.Count(string(runs), "\n"); c != 1 {
+		t.Errorf("expected a single samtools process, got %d", c)
+	}
+	if !strings.Contains(string(runs), "view -T ref.fa -u "+cram+" --input-fmt-option") {
+		t.Errorf("unexpected samtools call: %s", runs)
+	}
+	if spools, _ := filepath.Glob(filepath.Join(os.TempDir(), "smoove-spool-*")); len(spools) != 0 {
+		t.Errorf("expected spool files to be removed: %v", spools)
+	}
+
+	// BAM is read directly.
+	r, err := pool.Open(bpath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, r); n != 2000 {
+		t.Errorf("expected 2000 reads, got %d", n)
+	}
+	r.Close()
+	runs, _ = ioutil.ReadFile(runLog)
+	if c := strings.Count(string(runs), "\n"); c != 1 {
+		t.Errorf("expected BAM to be read without samtools")
+	}
+}
+
+type countCloser struct{ n int }
+
+func (c *countCloser) Close() error { c.n++; return nil }
+
+func TestEOFCloser(t *testing.T) {
+	c := &countCloser{}
+	e := &eofCloser{r: strings.NewReader("abc"), c: c}
+	b, err := ioutil.ReadAll(e)
+	if err != nil || string(b) != "abc" {
+		t.Fatalf("unexpected read: %q %v", b, err)
+	}
+	if _, err := e.Read(make([]byte, 1)); err != io.EOF || c.n != 1 {
+		t.Errorf("expected a single close at EOF, got %d (%v)", c.n, err)
+	}
+}
@@ -0,0 +1,304 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/cram"
+	"github.com/biogo/hts/fai"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/xopen"
+)
+
+// SkipReferenceCheck disables CheckReference and CheckVCFReference when set to "1".
+const SkipReferenceCheck = "SMOOVE_SKIP_REFERENCE_CHECK"
+
+// contig is a sequence name and length from a fasta index or an input header. length is -1 and m5 is
+// empty if unknown.
+type contig struct {
+	name   string
+	length int
+	m5     string
+}
+
+// readReference returns the contigs in the fasta index and the M5 of each from a sequence
+// dictionary (e.g. ref.dict from picard) if one exists next to the fasta.
+func readReference(fasta string) (map[string]contig, error) {
+	f, err := os.Open(fasta + ".fai")
+	if err != nil {
+		return nil, Inputf("fasta index not found for %s. create it with `samtools faidx %s`", fasta, fasta)
+	}
+	defer f.Close()
+	idx, err := fai.ReadFrom(f)
+	if err != nil {
+		return nil, Inputf("error reading fasta index for %s: %s", fasta, err)
+	}
+	ref := make(map[string]contig, len(idx))
+	for name, r := range idx {
+		ref[name] = contig{name: name, length: r.Length}
+	}
+	base := strings.TrimSuffix(fasta, ".gz")
+	for _, dict := range []string{strings.TrimSuffix(base, filepath.Ext(base)) + ".dict", fasta + ".dict"} {
+		if !xopen.Exists(dict) {
+			continue
+		}
+		df, err := os.Open(dict)
+		if err != nil {
+			return nil, err
+		}
+		var h sam.Header
+		b, rerr := ioutil.ReadAll(df)
+		df.Close()
+		if rerr != nil {
+			return nil, rerr
+		}
+		if err = h.UnmarshalText(b); err != nil {
+			Slogger.Printf("ignoring sequence dictionary %s: %s", dict, err)
+			break
+		}
+		for _, r := range h.Refs() {
+			if c, ok := ref[r.Name()]; ok && len(r.MD5()) > 0 {
+				c.m5 = hex.EncodeToString(r.MD5())
+				ref[r.Name()] = c
+			}
+		}
+		break
+	}
+	return ref, nil
+}
+
+// readHeader returns the header of a BAM or CRAM. CRAM headers are read without samtools when possible.
+func readHeader(path, fasta string) (*sam.Header, error) {
+	format, err := DetectFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case BAM:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		br, err := bam.NewReader(f, 1)
+		if err != nil {
+			return nil, err
+		}
+		defer br.Close()
+		return br.Header(), nil
+	case CRAM:
+		if h, err := cramHeader(path); err == nil {
+			return h, nil
+		}
+	}
+	br, err := Open(path, 1, fasta, "-H")
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	return br.Header(), nil
+}
+
+// cramHeader reads the SAM header from the first block of a CRAM.
+func cramHeader(path string) (*sam.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr, err := cram.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	if !cr.Next() {
+		return nil, fmt.Errorf("no containers in %s: %v", path, cr.Err())
+	}
+	c := cr.Container()
+	if !c.Next() {
+		return nil, fmt.Errorf("no header block in %s: %v", path, c.Err())
+	}
+	v, err := c.Block().Value()
+	if err != nil {
+		return nil, err
+	}
+	h, ok := v.(*sam.Header)
+	if !ok {
+		return nil, fmt.Errorf("first block of %s is not a header", path)
+	}
+	return h, nil
+}
+
+func toggleChr(name string) string {
+	if strings.HasPrefix(name, "chr") {
+		return name[3:]
+	}
+	return "chr" + name
+}
+
+// compareContigs returns a description of each way that the contigs from an input differ from the reference.
+func compareContigs(ref map[string]contig, ctgs []contig) []string {
+	if len(ctgs) == 0 {
+		return []string{"no contigs in header"}
+	}
+	var problems, missing []string
+	var toggled int
+	for _, c := range ctgs {
+		r, ok := ref[c.name]
+		if !ok {
+			missing = append(missing, c.name)
+			if _, ok := ref[toggleChr(c.name)]; ok {
+				toggled++
+			}
+			continue
+		}
+		if c.length >= 0 && r.length != c.length {
+			problems = append(problems, fmt.Sprintf("length of %s is %d but %d in the fasta", c.name, c.length, r.length))
+		}
+		if r.m5 != "" && c.m5 != "" && r.m5 != c.m5 {
+			problems = append(problems, fmt.Sprintf("M5 of %s is %s but %s in the fasta", c.name, c.m5, r.m5))
+		}
+	}
+	if len(missing) == 0 {
+		return problems
+	}
+	if toggled > 0 && toggled*2 >= len(missing) {
+		example := missing[0]
+		for _, m := range missing {
+			if _, ok := ref[toggleChr(m)]; ok {
+				example = m
+				break
+			}
+		}
+		problems = append(problems, fmt.Sprintf("contig names differ by a 'chr' prefix: %s vs %s in the fasta", example, toggleChr(example)))
+		return problems
+	}
+	if len(missing) > 5 {
+		missing = append(missing[:5], fmt.Sprintf("and %d more", len(missing)-5))
+	}
+	return append(problems, "contigs missing from the fasta: "+strings.Join(missing, ", "))
+}
+
+// referenceError collects the problems found for each input.
+func referenceError(fasta string, problems map[string][]string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(problems))
+	for p := range problems {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	fmt.Fprintf(&b, "inputs do not match the reference %s:", fasta)
+	for _, p := range paths {
+		for _, msg := range problems[p] {
+			fmt.Fprintf(&b, "\n  %s: %s", p, msg)
+		}
+	}
+	fmt.Fprintf(&b, "\nset %s=1 to skip this check", SkipReferenceCheck)
+	return InputError(errors.New(b.String()))
+}
+
+// CheckReference compares the @SQ names, lengths and M5 in each BAM or CRAM with the fasta index.
+func CheckReference(fasta string, bams []string) error {
+	if os.Getenv(SkipReferenceCheck) == "1" {
+		return nil
+	}
+	ref, err := readReference(fasta)
+	if err != nil {
+		return err
+	}
+	problems := make(map[string][]string)
+	for _, path := range bams {
+		h, err := readHeader(path, fasta)
+		if err != nil {
+			return Inputf("error reading header from %s: %s", path, err)
+		}
+		ctgs := make([]contig, 0, len(h.Refs()))
+		for _, r := range h.Refs() {
+			c := contig{name: r.Name(), length: r.Len()}
+			if len(r.MD5()) > 0 {
+				c.m5 = hex.EncodeToString(r.MD5())
+			}
+			ctgs = append(ctgs, c)
+		}
+		if ps := compareContigs(ref, ctgs); len(ps) > 0 {
+			problems[path] = ps
+		}
+	}
+	return referenceError(fasta, problems)
+}
+
+// CheckVCFReference compares the ##contig lines in each VCF with the fasta index. VCFs without
+// ##contig lines are not checked.
+func CheckVCFReference(fasta string, vcfs []string) error {
+	if os.Getenv(SkipReferenceCheck) == "1" {
+		return nil
+	}
+	ref, err := readReference(fasta)
+	if err != nil {
+		return err
+	}
+	problems := make(map[string][]string)
+	for _, path := range vcfs {
+		ctgs, err := vcfContigs(path)
+		if err != nil {
+			return InputError(err)
+		}
+		if len(ctgs) == 0 {
+			continue
+		}
+		if ps := compareContigs(ref, ctgs); len(ps) > 0 {
+			problems[path] = ps
+		}
+	}
+	return referenceError(fasta, problems)
+}
+
+func vcfContigs(path string) ([]contig, error) {
+	f, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ctgs []contig
+	for {
+		line, err := f.ReadString('\n')
+		if !strings.HasPrefix(line, "##") {
+			break
+		}
+		if strings.HasPrefix(line, "##contig=<") {
+			c := contig{length: -1}
+			for _, kv := range strings.Split(strings.TrimSuffix(strings.TrimSpace(line)[10:], ">"), ",") {
+				toks := strings.SplitN(kv, "=", 2)
+				if len(toks) != 2 {
+					continue
+				}
+				switch toks[0] {
+				case "ID":
+					c.name = toks[1]
+				case "length":
+					c.length, _ = strconv.Atoi(toks[1])
+				case "md5", "M5":
+					c.m5 = toks[1]
+				}
+			}
+			if c.name != "" {
+				ctgs = append(ctgs, c)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return ctgs, nil
+}
@@ -0,0 +1,62 @@
+package shared
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareContigs(t *testing.T) {
+	ref := map[string]contig{
+		"1": {name: "1", length: 1000, m5: "aa"},
+		"2": {name: "2", length: 2000},
+		"X": {name: "X", length: 500},
+	}
+	for _, c := range []struct {
+		ctgs []contig
+		want string
+	}{
+		{[]contig{{"1", 1000, "aa"}, {"2", 2000, ""}}, ""},
+		{[]contig{{"chr1", 1000, ""}, {"chr2", 2000, ""}, {"chrM", 16569, ""}}, "'chr' prefix: chr1 vs 1"},
+		{[]contig{{"1", 1000, ""}, {"2", 2001, ""}}, "length of 2 is 2001 but 2000"},
+		{[]contig{{"1", 1000, "bb"}}, "M5 of 1 is bb but aa"},
+		{[]contig{{"1", 1000, ""}, {"HLA-A", 3000, ""}}, "missing from the fasta: HLA-A"},
+		{[]contig{{"1", -1, ""}}, ""},
+	} {
+		got := strings.Join(compareContigs(ref, c.ctgs), "; ")
+		if (c.want == "") != (got == "") || !strings.Contains(got, c.want) {
+			t.Errorf("%v: expected %q, got %q", c.ctgs, c.want, got)
+		}
+	}
+}
+
+func TestCheckReference(t *testing.T) {
+	dir := t.TempDir()
+	bpath := filepath.Join(dir, "x.bam")
+	writeBAM(t, bpath, 1)
+	fa := filepath.Join(dir, "ref.fa")
+	if err := ioutil.WriteFile(fa+".fai", []byte("chr1\t100000\t6\t60\t61\nchr2\t500\t101700\t60\t61\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckReference(fa, []string{bpath}); err != nil {
+		t.Errorf("expected matching reference, got %s", err)
+	}
+
+	other := filepath.Join(dir, "other.fa")
+	if err := ioutil.WriteFile(other+".fai", []byte("1\t100000\t6\t60\t61\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := CheckReference(other, []string{bpath})
+	if err == nil || !strings.Contains(err.Error(), bpath+": contig names differ by a 'chr' prefix") {
+		t.Errorf("expected chr prefix error, got %v", err)
+	}
+
+	vcf := filepath.Join(dir, "x.vcf")
+	if err := ioutil.WriteFile(vcf, []byte("##fileformat=VCFv4.2\n##contig=<ID=chr1,length=99999>\n#CHROM\tPOS\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckVCFReference(fa, []string{vcf}); err == nil || !strings.Contains(err.Error(), "length of chr1 is 99999") {
+		t.Errorf("expected length error, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brentp/smoove"
+)
+
+// ProcessUsage is the resource usage of a child process from its rusage.
+type ProcessUsage struct {
+	Tool     string    `json:"tool"`
+	Stage    string    `json:"stage,omitempty"`
+	Sample   string    `json:"sample,omitempty"`
+	Chunk    string    `json:"chunk,omitempty"`
+	Command  string    `json:"command"`
+	Start    time.Time `json:"start"`
+	Wall     float64   `json:"wall_seconds"`
+	User     float64   `json:"user_seconds"`
+	Sys      float64   `json:"sys_seconds"`
+	MaxRSSKB int64     `json:"max_rss_kb"`
+	ExitCode int       `json:"exit_code"`
+}
+
+// StageUsage summarizes a stage. CPU includes smoove itself while the stage was running (which
+// may overlap with other stages) and all child processes labelled with the stage. For stages
+// run by smoove itself, MaxRSSKB is the peak for smoove up to the end of the stage.
+type StageUsage struct {
+	Name      string    `json:"name"`
+	Start     time.Time `json:"start"`
+	Wall      float64   `json:"wall_seconds"`
+	CPU       float64   `json:"cpu_seconds"`
+	MaxRSSKB  int64     `json:"max_rss_kb"`
+	Processes int       `json:"processes"`
+
+	selfCPU float64
+	end     time.Time
+}
+
+// RunReport is written to {name}-smoove.run.json at the end of a run.
+type RunReport struct {
+	Version   string          `json:"version"`
+	Command   []string        `json:"command"`
+	Start     time.Time       `json:"start"`
+	Wall      float64         `json:"wall_seconds"`
+	CPU       float64         `json:"cpu_seconds"`
+	MaxRSSKB  int64           `json:"max_rss_kb"`
+	Stages    []*StageUsage   `json:"stages"`
+	Processes []*ProcessUsage `json:"processes"`
+}
+
+// recorder collects the stages and child processes of this run.
+type recorder struct {
+	mu        sync.Mutex
+	start     time.Time
+	stages    []*StageUsage
+	processes []*ProcessUsage
+}
+
+var usage = &recorder{start: time.Now()}
+
+func seconds(tv syscall.Timeval) float64 {
+	return float64(tv.Sec) + float64(tv.Usec)/1e6
+}
+
+// rusage returns the user+sys seconds and max RSS (in KB on linux) for who.
+func rusage(who int) (float64, int64) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(who, &ru); err != nil {
+		return 0, 0
+	}
+	return seconds(ru.Utime) + seconds(ru.Stime), int64(ru.Maxrss)
+}
+
+// BeginStage records the start of a stage of work done by smoove (e.g. bam_stats) and returns a
+// function to call when it is done. Child processes are added to the stage given in the stage
+// field of the Logger used for their stderr.
+func BeginStage(name string) func() {
+	cpu0, _ := rusage(syscall.RUSAGE_SELF)
+	st := &StageUsage{Name: name, Start: time.Now()}
+	usage.mu.Lock()
+	usage.stages = append(usage.stages, st)
+	usage.mu.Unlock()
+	return func() {
+		cpu1, rss := rusage(syscall.RUSAGE_SELF)
+		usage.mu.Lock()
+		st.end = time.Now()
+		st.selfCPU = cpu1 - cpu0
+		st.MaxRSSKB = rss
+		usage.mu.Unlock()
+	}
+}
+
+// labeller is implemented by a Logger (and writers that embed one) so that child processes can
+// be attributed to a stage and sample.
+type labeller interface {
+	field(key string) string
+}
+
+// record adds the usage of a finished command.
+func (r *recorder) record(cmd *exec.Cmd, start time.Time) {
+	if cmd.ProcessState == nil {
+		return
+	}
+	p := &ProcessUsage{Tool: filepath.Base(cmd.Path), Command: strings.Join(cmd.Args, " "), Start: start,
+		Wall: time.Since(start).Seconds(), ExitCode: cmd.ProcessState.ExitCode()}
+	if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		p.User, p.Sys, p.MaxRSSKB = seconds(ru.Utime), seconds(ru.Stime), int64(ru.Maxrss)
+	}
+	if l, ok := cmd.Stderr.(labeller); ok {
+		if tool := l.field("tool"); tool != "" {
+			p.Tool = tool
+		}
+		p.Stage, p.Sample, p.Chunk = l.field("stage"), l.field("sample"), l.field("chunk")
+	}
+	if len(p.Command) > 1000 {
+		p.Command = p.Command[:1000] + "..."
+	}
+	r.mu.Lock()
+	r.processes = append(r.processes, p)
+	r.mu.Unlock()
+}
+
+// report builds the report from the stages and processes so far. A stage spans the first start
+// to the last end of its BeginStage calls and child processes.
+func (r *recorder) report() *RunReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep := &RunReport{Version: smoove.Version, Command: CommandLine, Start: r.start, Wall: time.Since(r.start).Seconds(),
+		Processes: r.processes}
+	self, selfRSS := rusage(syscall.RUSAGE_SELF)
+	children, childRSS := rusage(syscall.RUSAGE_CHILDREN)
+	rep.CPU = self + children
+	rep.MaxRSSKB = max64(selfRSS, childRSS)
+
+	// stages with the same name (e.g. from each sample) are combined.
+	byName := make(map[string]*StageUsage)
+	for _, st := range r.stages {
+		end := st.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		s, ok := byName[st.Name]
+		if !ok {
+			s = &StageUsage{Name: st.Name, Start: st.Start}
+			byName[st.Name] = s
+			rep.Stages = append(rep.Stages, s)
+		}
+		if st.Start.Before(s.Start) {
+			s.Start = st.Start
+		}
+		if end.After(s.end) {
+			s.end = end
+		}
+		s.CPU += st.selfCPU
+		s.MaxRSSKB = max64(s.MaxRSSKB, st.MaxRSSKB)
+	}
+	for _, p := range r.processes {
+		if p.Stage == "" {
+			continue
+		}
+		s, ok := byName[p.Stage]
+		if !ok {
+			s = &StageUsage{Name: p.Stage, Start: p.Start}
+			byName[p.Stage] = s
+			rep.Stages = append(rep.Stages, s)
+		}
+		if p.Start.Before(s.Start) {
+			s.Start = p.Start
+		}
+		if end := p.Start.Add(time.Duration(p.Wall * float64(time.Second))); end.After(s.end) {
+			s.end = end
+		}
+		s.CPU += p.User + p.Sys
+		s.MaxRSSKB = max64(s.MaxRSSKB, p.MaxRSSKB)
+		s.Processes++
+	}
+	for _, s := range rep.Stages {
+		s.Wall = s.end.Sub(s.Start).Seconds()
+	}
+	sort.SliceStable(rep.Stages, func(i, j int) bool { return rep.Stages[i].Start.Before(rep.Stages[j].Start) })
+	return rep
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// WriteReport writes the stages and child processes of the run so far to path as JSON and logs a
+// summary of each stage. Nothing is written if no stages or commands have run (e.g. smoove failed
+// while checking its arguments).
+func WriteReport(path string) error {
+	rep := usage.report()
+	if len(rep.Stages) == 0 && len(rep.Processes) == 0 {
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	for _, s := range rep.Stages {
+		Slogger.With("stage", s.Name).Printf("%s wall, %s CPU, %s peak RSS, %d processes", duration(s.Wall), duration(s.CPU), memory(s.MaxRSSKB), s.Processes)
+	}
+	Slogger.Printf("total: %s wall, %s CPU, %s peak RSS. wrote run report to %s", duration(rep.Wall), duration(rep.CPU), memory(rep.MaxRSSKB), path)
+	return nil
+}
+
+func duration(s float64) string {
+	return (time.Duration(s*10) * time.Second / 10).String()
+}
+
+func memory(kb int64) string {
+	if kb >= 1<<20 {
+		return fmt.Sprintf("%.1fGB", float64(kb)/(1<<20))
+	}
+	return fmt.Sprintf("%.1fMB", float64(kb)/(1<<10))
+}
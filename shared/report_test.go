@@ -0,0 +1,68 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	saved := usage
+	defer func() { usage = saved }()
+	usage = &recorder{start: saved.start}
+
+	log, _ := testLogger(false, LevelInfo)
+	done := BeginStage("bam_stats")
+	err := Run(context.Background(), 2, Jobs(
+		Job{Name: "a", Log: log.With("sample", "s1", "stage", "lumpy_filter"), Cmds: [][]string{{"sh", "-c", "echo a >&2"}}},
+		Job{Name: "b", Log: log.With("sample", "s2", "stage", "lumpy_filter").With("stage", "mosdepth"), Cmds: [][]string{{"true"}}},
+	))
+	done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "smoove-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "x-smoove.run.json")
+	if err := WriteReport(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep RunReport
+	if err := json.Unmarshal(b, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Processes) != 2 {
+		t.Fatalf("expected 2 processes, got %d", len(rep.Processes))
+	}
+	stages := make(map[string]*StageUsage)
+	for _, s := range rep.Stages {
+		stages[s.Name] = s
+	}
+	for _, name := range []string{"bam_stats", "lumpy_filter", "mosdepth"} {
+		if stages[name] == nil {
+			t.Fatalf("missing stage %s in %s", name, b)
+		}
+	}
+	if stages["lumpy_filter"].Processes != 1 || stages["mosdepth"].Processes != 1 || stages["bam_stats"].Processes != 0 {
+		t.Errorf("unexpected process counts: %s", b)
+	}
+	for _, p := range rep.Processes {
+		if p.Tool != "sh" && p.Tool != "true" {
+			t.Errorf("unexpected tool %s", p.Tool)
+		}
+		if p.MaxRSSKB <= 0 {
+			t.Errorf("expected max RSS for %s", p.Tool)
+		}
+	}
+}
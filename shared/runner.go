@@ -0,0 +1,166 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Job is a unit of work for Run.
+type Job struct {
+	// Name identifies the job in errors (e.g. the BAM or region file).
+	Name string
+	// Cmds are run in order. Each is a program followed by its arguments.
+	Cmds [][]string
+	// Done, if set, is called after all Cmds succeed. It is called from the worker goroutine.
+	Done func() error
+	// Cleanup, if set, is called when the job fails or is skipped because another job failed.
+	Cleanup func()
+	// Retries is the number of times to re-run the commands after a failure before giving up.
+	Retries int
+	// Log, if set, receives the stderr and stdout of the commands and messages about the job
+	// (e.g. Slogger.With("sample", s)). The name of each program is added as the tool field.
+	Log *Logger
+}
+
+// JobError reports which job and command failed along with the end of its stderr.
+type JobError struct {
+	Name   string
+	Cmd    string
+	Err    error
+	Stderr string
+}
+
+func (e *JobError) Error() string {
+	msg := fmt.Sprintf("error running %s for %s: %s", e.Cmd, e.Name, e.Err)
+	if e.Stderr != "" {
+		msg += "\nend of stderr:\n" + e.Stderr
+	}
+	return msg
+}
+
+// Jobs returns a closed channel containing js for use with Run.
+func Jobs(js ...Job) <-chan Job {
+	ch := make(chan Job, len(js))
+	for _, j := range js {
+		ch <- j
+	}
+	close(ch)
+	return ch
+}
+
+// Run runs the jobs from ch with at most procs at a time. The first failure cancels the
+// remaining jobs, kills any running commands and is returned (as a *JobError if a command
+// failed). ch is drained so that a sender is never left blocked.
+func Run(ctx context.Context, procs int, ch <-chan Job) error {
+	if procs < 1 {
+		procs = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var first error
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(procs)
+	for i := 0; i < procs; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				if ctx.Err() != nil {
+					j.cleanup()
+					continue
+				}
+				err := j.run(ctx)
+				for k := 0; err != nil && k < j.Retries && ctx.Err() == nil && !super.isStopping(); k++ {
+					if _, ok := err.(*JobError); !ok {
+						break
+					}
+					j.log().Warnf("retrying %s (attempt %d of %d) after: %s", j.Name, k+2, j.Retries+1, err)
+					err = j.run(ctx)
+				}
+				if err != nil {
+					j.cleanup()
+					// errors after cancellation are from killed processes.
+					if ctx.Err() == nil {
+						fail(err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if first == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return first
+}
+
+func (j Job) cleanup() {
+	if j.Cleanup != nil {
+		j.Cleanup()
+	}
+}
+
+func (j Job) log() *Logger {
+	if j.Log != nil {
+		return j.Log
+	}
+	return Slogger
+}
+
+func (j Job) run(ctx context.Context) error {
+	for _, args := range j.Cmds {
+		tail := &tailWriter{n: 2048}
+		cmd := Command(args[0], args[1:]...)
+		log := j.log().Tool(filepath.Base(args[0]))
+		cmd.Stderr = logTail{log, tail}
+		cmd.Stdout = log.With("stream", "stdout")
+		if err := runContext(ctx, cmd); err != nil {
+			return &JobError{Name: j.Name, Cmd: strings.Join(args, " "), Err: err, Stderr: tail.String()}
+		}
+	}
+	if j.Done != nil {
+		return j.Done()
+	}
+	return nil
+}
+
+// logTail logs stderr and keeps the end of it for a JobError. It embeds the Logger so that the
+// run report can get the sample and stage of the command.
+type logTail struct {
+	*Logger
+	tail *tailWriter
+}
+
+func (l logTail) Write(b []byte) (int, error) {
+	l.tail.Write(b)
+	return l.Logger.Write(b)
+}
+
+// tailWriter keeps the last n bytes written to it.
+type tailWriter struct {
+	n   int
+	buf []byte
+}
+
+func (t *tailWriter) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > t.n {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.n:]...)
+	}
+	return len(b), nil
+}
+
+func (t *tailWriter) String() string {
+	return strings.TrimSpace(string(t.buf))
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunCancelsOnFailure(t *testing.T) {
+	var cleaned int32
+	cleanup := func() { atomic.AddInt32(&cleaned, 1) }
+	jobs := []Job{
+		{Name: "slow1", Cmds: [][]string{{"sleep", "20"}}, Cleanup: cleanup},
+		{Name: "bad.bam", Cmds: [][]string{{"sh", "-c", "sleep 0.2; echo line1 >&2; echo boom >&2; exit 3"}}, Cleanup: cleanup},
+		{Name: "slow2", Cmds: [][]string{{"sleep", "20"}}, Cleanup: cleanup},
+		{Name: "pending", Cmds: [][]string{{"sleep", "20"}}, Cleanup: cleanup},
+	}
+	start := time.Now()
+	err := Run(context.Background(), 3, Jobs(jobs...))
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("running jobs were not killed")
+	}
+	je, ok := err.(*JobError)
+	if !ok {
+		t.Fatalf("expected a *JobError, got %v", err)
+	}
+	if je.Name != "bad.bam" || je.Stderr != "line1\nboom" {
+		t.Errorf("unexpected error: %q %q", je.Name, je.Stderr)
+	}
+	if c := atomic.LoadInt32(&cleaned); c != 4 {
+		t.Errorf("expected cleanup for all 4 jobs, got %d", c)
+	}
+}
+
+func TestRunDone(t *testing.T) {
+	var done int32
+	jobs := make([]Job, 0, 10)
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, Job{Name: "ok", Cmds: [][]string{{"true"}}, Done: func() error {
+			atomic.AddInt32(&done, 1)
+			return nil
+		}})
+	}
+	if err := Run(context.Background(), 4, Jobs(jobs...)); err != nil {
+		t.Fatal(err)
+	}
+	if done != 10 {
+		t.Errorf("expected 10 jobs done, got %d", done)
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	tw := &tailWriter{n: 4}
+	tw.Write([]byte("abc"))
+	tw.Write([]byte("defg"))
+	if tw.String() != "defg" {
+		t.Errorf("expected defg, got %s", tw.String())
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	dir := t.TempDir()
+	// fails the first time and succeeds the second.
+	script := "if [ -e " + dir + "/x ]; then exit 0; fi; touch " + dir + "/x; exit 1"
+	if err := Run(context.Background(), 1, Jobs(Job{Name: "flaky", Cmds: [][]string{{"sh", "-c", script}}, Retries: 1})); err != nil {
+		t.Errorf("expected retry to succeed, got %s", err)
+	}
+	if err := Run(context.Background(), 1, Jobs(Job{Name: "bad", Cmds: [][]string{{"false"}}, Retries: 2})); err == nil {
+		t.Errorf("expected error after retries")
+	}
+}
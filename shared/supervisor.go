@@ -0,0 +1,221 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ExitSignal is added to the signal number to get the exit status after an interrupt, as a shell
+// does: 130 for SIGINT and 143 for SIGTERM.
+const ExitSignal = 128
+
+// grace is how long children have to exit after SIGTERM before they are sent SIGKILL.
+var grace = 5 * time.Second
+
+var errStopping = errors.New("smoove is shutting down")
+
+// supervisor tracks the running child processes and the files that should not be left behind
+// if smoove is interrupted or fails.
+type supervisor struct {
+	mu       sync.Mutex
+	cmds     map[*exec.Cmd]time.Time
+	paths    map[string]bool
+	stopping bool
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{cmds: make(map[*exec.Cmd]time.Time), paths: make(map[string]bool)}
+}
+
+var super = newSupervisor()
+
+// Command returns a command that runs in its own process group so that it and any processes it
+// starts (e.g. from bash -c) can be killed together. Use StartCmd, WaitCmd or RunCmd so that it is
+// tracked and its resource usage is recorded for the run report.
+func Command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// LogOutput logs the stderr and stdout of cmd to log. stdout gets its own Logger so that a partial
+// line on one stream isn't joined to a partial line on the other.
+func LogOutput(cmd *exec.Cmd, log *Logger) {
+	cmd.Stderr = log
+	cmd.Stdout = log.With("stream", "stdout")
+}
+
+// StartCmd starts cmd and tracks it until WaitCmd is called. It fails if smoove is shutting down.
+func StartCmd(cmd *exec.Cmd) error { return super.start(cmd) }
+
+// WaitCmd waits for a command started with StartCmd.
+func WaitCmd(cmd *exec.Cmd) error { return super.wait(cmd) }
+
+// RunCmd starts cmd and waits for it to finish.
+func RunCmd(cmd *exec.Cmd) error {
+	if err := StartCmd(cmd); err != nil {
+		return err
+	}
+	return WaitCmd(cmd)
+}
+
+// runContext runs cmd and kills its process group if ctx is cancelled first.
+func runContext(ctx context.Context, cmd *exec.Cmd) error {
+	if err := StartCmd(cmd); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killGroup(cmd, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := WaitCmd(cmd)
+	close(done)
+	return err
+}
+
+// RemoveOnExit registers temporary files and partial outputs (e.g. .tmp.bam or a VCF that is still
+// being written) to be removed if smoove is interrupted or exits with an error.
+func RemoveOnExit(paths ...string) { super.add(paths) }
+
+// Keep unregisters paths once they are complete (or have been removed).
+func Keep(paths ...string) { super.keep(paths) }
+
+// HandleSignals installs the signal handler. On SIGINT, SIGTERM, SIGQUIT or SIGHUP it terminates
+// each child's process group, removes the registered files and temporary directories and exits
+// with ExitSignal plus the signal number. Temporary files must be registered with RemoveOnExit as
+// this is the only handler.
+func HandleSignals() {
+	sigs := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		sig := <-c
+		Slogger.Printf("received %s. stopping child processes and removing partial output", sig)
+		super.stop(syscall.SIGTERM, grace)
+		code := ExitSignal
+		if s, ok := sig.(syscall.Signal); ok {
+			code += int(s)
+		}
+		os.Exit(code)
+	}()
+}
+
+func (s *supervisor) start(cmd *exec.Cmd) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return errStopping
+	}
+	t := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.cmds[cmd] = t
+	return nil
+}
+
+func (s *supervisor) wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	// log the last line from a child that didn't end it with a newline.
+	for _, w := range []io.Writer{cmd.Stderr, cmd.Stdout} {
+		switch l := w.(type) {
+		case *Logger:
+			l.Close()
+		case logTail:
+			l.Close()
+		}
+	}
+	s.mu.Lock()
+	t := s.cmds[cmd]
+	delete(s.cmds, cmd)
+	s.mu.Unlock()
+	usage.record(cmd, t)
+	return err
+}
+
+func (s *supervisor) add(paths []string) {
+	s.mu.Lock()
+	for _, p := range paths {
+		s.paths[p] = true
+	}
+	s.mu.Unlock()
+}
+
+func (s *supervisor) keep(paths []string) {
+	s.mu.Lock()
+	for _, p := range paths {
+		delete(s.paths, p)
+	}
+	s.mu.Unlock()
+}
+
+// isStopping reports whether stop has been called.
+func (s *supervisor) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// stop prevents new commands from starting, sends sig to the process group of each running command,
+// sends SIGKILL to any that are still running after grace and then removes the registered paths.
+func (s *supervisor) stop(sig syscall.Signal, grace time.Duration) {
+	s.mu.Lock()
+	s.stopping = true
+	for cmd := range s.cmds {
+		killGroup(cmd, sig)
+	}
+	s.mu.Unlock()
+
+	for t := time.Now(); time.Since(t) < grace; time.Sleep(50 * time.Millisecond) {
+		s.mu.Lock()
+		n := len(s.cmds)
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+	}
+	s.mu.Lock()
+	for cmd := range s.cmds {
+		killGroup(cmd, syscall.SIGKILL)
+	}
+	s.mu.Unlock()
+	s.removePaths()
+}
+
+func (s *supervisor) removePaths() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.paths {
+		if _, err := os.Lstat(p); err == nil && os.RemoveAll(p) == nil {
+			Slogger.Printf("removed %s", p)
+		}
+		delete(s.paths, p)
+	}
+}
+
+// KillCmd kills cmd (started with StartCmd) and any processes that it started. WaitCmd must still be
+// called.
+func KillCmd(cmd *exec.Cmd) { killGroup(cmd, syscall.SIGKILL) }
+
+// killGroup sends sig to the process group of cmd, or to its process if it has no group of its own.
+func killGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if cmd.Process == nil {
+		return
+	}
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		syscall.Kill(-cmd.Process.Pid, sig)
+		return
+	}
+	cmd.Process.Signal(sig)
+}
@@ -0,0 +1,100 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// running reports whether pid exists and is not a zombie waiting to be reaped by init.
+func running(pid int) bool {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	// the state follows the command name, which is in parentheses.
+	s := string(b)
+	i := strings.LastIndex(s, ")")
+	return i < 0 || i+2 >= len(s) || s[i+2] != 'Z'
+}
+
+func TestSupervisorStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-supervisor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	partial := filepath.Join(dir, "x.tmp.bam")
+	done := filepath.Join(dir, "x.bam")
+	for _, p := range []string{partial, done} {
+		if err := ioutil.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newSupervisor()
+	s.add([]string{partial, done})
+	s.keep([]string{done})
+
+	// bash ignores SIGTERM so it is only stopped by the SIGKILL after the grace period.
+	cmd := Command("bash", "-c", "trap '' TERM; sleep 30 & wait")
+	if err := s.start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- s.wait(cmd) }()
+	time.Sleep(100 * time.Millisecond)
+
+	s.stop(syscall.SIGTERM, 200*time.Millisecond)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command was not killed")
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", partial)
+	}
+	if _, err := os.Stat(done); err != nil {
+		t.Errorf("expected %s to be kept: %s", done, err)
+	}
+	if err := s.start(Command("true")); err != errStopping {
+		t.Errorf("expected no new commands after stop, got: %v", err)
+	}
+}
+
+func TestRunContextKillsGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoove-supervisor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidf := filepath.Join(dir, "pid")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	cmd := Command("bash", "-c", "sleep 30 & echo $! > "+pidf+"; wait")
+	if err := runContext(ctx, cmd); err == nil {
+		t.Fatal("expected an error from a killed command")
+	}
+	b, err := ioutil.ReadFile(pidf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	for i := 0; i < 50 && running(child); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if running(child) {
+		t.Errorf("child %d of the cancelled command is still running", child)
+	}
+}
@@ -2,19 +2,23 @@ package svtyper
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
 	arg "github.com/alexflint/go-arg"
-	"github.com/brentp/go-athenaeum/tempclean"
+	"github.com/brentp/smoove/duphold"
 	"github.com/brentp/smoove/shared"
 	"github.com/brentp/xopen"
+	"github.com/pkg/errors"
 )
 
 type cliargs struct {
@@ -23,23 +27,13 @@ type cliargs struct {
 	Fasta     string   `arg:"-f,required,help:fasta file."`
 	RemovePr  bool     `arg:"-x,help:remove PRPOS and PREND tags from INFO."`
 	DupHold   bool     `arg:"-d,help:run duphold on output."`
+	SNPs      string   `arg:"-s,help:optional SNP VCF for these samples. with -d deletions with het SNPs are flagged (DHZC and FILTER SNP_ZYGOSITY)."`
 	Processes int      `arg:"-p,help:number of processors to use."`
 	VCF       string   `arg:"-v,required,help:vcf to genotype (use - for stdin)."`
+	DryRun    bool     `arg:"--dry-run,help:print the commands that would be run and exit without running them."`
 	Bams      []string `arg:"positional,required,help:path to bam to call."`
 }
 
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
-}
-
-func checkWrite(i int, e error) {
-	if e != nil {
-		panic(e)
-	}
-}
-
 const chunkSize = 600
 
 // cant orphan BNDs or svtyper won't genotype.
@@ -51,30 +45,42 @@ func isFirstBnd(line string) bool {
 	return strings.HasSuffix(toks[2], "_1")
 }
 
-func writeTmp(header []string, lines []string) string {
+func writeTmp(header []string, lines []string) (string, error) {
 	f, err := xopen.Wopen("tmp:smoove-tmp")
-	check(err)
+	if err != nil {
+		return "", err
+	}
 	for _, h := range header {
-		checkWrite(f.WriteString(h))
+		if _, err := f.WriteString(h); err != nil {
+			return f.Name(), err
+		}
 	}
 	for _, l := range lines {
-		checkWrite(f.WriteString(l))
+		if _, err := f.WriteString(l); err != nil {
+			return f.Name(), err
+		}
 	}
-	f.Close()
-	return f.Name()
+	return f.Name(), f.Close()
 }
 
-// Svtyper parellelizes genotyping of the vcf and writes the the writer.
-// p is optional. If set, then it is assumed that vcf is nil and the stdout of p will be used as the vcf.
-func Svtyper(vcf io.Reader, reference string, bam_paths []string, outdir, name string, excludeNonRef bool, removePR bool, duphold bool) {
+// Svtyper parellelizes genotyping of the vcf and writes a sorted, indexed VCF to {outdir}/{name}-smoove.genotyped.vcf.gz.
+func Svtyper(vcf io.Reader, reference string, bam_paths []string, outdir, name string, excludeNonRef bool, removePR bool, dh bool, snps string) error {
 	b := bufio.NewReader(vcf)
 	header := make([]string, 0, 512)
 	lines := make([]string, 0, chunkSize+1)
 	ch := make(chan string, runtime.GOMAXPROCS(0))
 
+	if !(shared.HasProg("gsort") == "Y" && shared.HasProg("bcftools") == "Y") {
+		return shared.DependencyError(fmt.Errorf("gsort and bcftools required for svtyper"))
+	}
+	stageDone := shared.BeginStage("svtyper")
 	if !xopen.Exists(outdir) {
-		os.MkdirAll(outdir, 0755)
+		if err := os.MkdirAll(outdir, 0755); err != nil {
+			return shared.InputError(err)
+		}
 	}
+	// readErr is set if reading or chunking the input fails. it is checked after ch is closed.
+	var readErr error
 	// read directly from the vcf (or process) and send off to a channel.
 	// svtyper will receive from that channel to allow for parallelization.
 	go func() {
@@ -96,17 +102,32 @@ func Svtyper(vcf io.Reader, reference string, bam_paths []string, outdir, name s
 					continue
 				}
 				// send chunk off for genotyping
-				ch <- writeTmp(header, lines)
+				f, err := writeTmp(header, lines)
+				if err != nil {
+					os.Remove(f)
+					readErr = err
+					return
+				}
+				ch <- f
 				// reset lines array.
 				lines = lines[:0]
 			}
 			if err == io.EOF {
 				break
 			}
-			check(err)
+			if err != nil {
+				readErr = err
+				return
+			}
 		}
 		if len(lines) > 0 {
-			ch <- writeTmp(header, lines)
+			f, err := writeTmp(header, lines)
+			if err != nil {
+				os.Remove(f)
+				readErr = err
+				return
+			}
+			ch <- f
 		}
 	}()
 
@@ -115,156 +136,245 @@ func Svtyper(vcf io.Reader, reference string, bam_paths []string, outdir, name s
 
 	// need a multiwriter to write to both stdout and potentially to the gsort+bcftools process
 
-	if !(shared.HasProg("gsort") == "Y" && shared.HasProg("bcftools") == "Y") {
-		shared.Slogger.Fatal("gsort and bcftools required for svtyper")
-	}
 	o := filepath.Join(outdir, name) + "-smoove.genotyped.vcf.gz"
-	shared.Slogger.Printf("writing sorted, indexed file to %s", o)
-	exRef := ""
+	log := shared.Slogger.With("sample", name, "stage", "svtyper")
+	log.Printf("writing sorted, indexed file to %s", o)
 	if excludeNonRef {
-		shared.Slogger.Printf("excluding variants with all unknown or homozygous reference genotypes")
-		exRef = " -c 1"
-	}
-	var cmd string
-	if removePR {
-		if excludeNonRef {
-			cmd = fmt.Sprintf("set -euo pipefail; gsort /dev/stdin %s.fai | bcftools annotate -x INFO/PRPOS,INFO/PREND -Ou | bcftools view -c 1 -Oz %s -o %s", reference, exRef, o)
-		} else {
-			cmd = fmt.Sprintf("set -euo pipefail; gsort /dev/stdin %s.fai | bcftools annotate -x INFO/PRPOS,INFO/PREND -Oz -o %s", reference, o)
-		}
-	} else {
-		cmd = fmt.Sprintf("set -euo pipefail; gsort /dev/stdin %s.fai | bcftools view -O z%s -o %s", reference, exRef, o)
+		log.Printf("excluding variants with all unknown or homozygous reference genotypes")
 	}
-	cmd += fmt.Sprintf("; bcftools index -f --threads %d %s", 3, o)
-	psort = exec.Command("bash", "-c", cmd)
-	psort.Stderr = shared.Slogger
+	psort = shared.Command("bash", "-c", sortCmd(reference, o, excludeNonRef, removePR))
+	psort.Stderr = log.Tool("gsort")
 	var err error
 	si, err = psort.StdinPipe()
-	check(err)
+	if err != nil {
+		return err
+	}
 	out := bufio.NewWriter(si)
-	defer out.Flush()
-	check(psort.Start())
+	// the output is removed if genotyping fails or is interrupted before it is complete.
+	shared.RemoveOnExit(o, o+".csi")
+	if err := shared.StartCmd(psort); err != nil {
+		return shared.ToolError("gsort", err)
+	}
+	// stop sorting (and drain the reader) if we return early.
+	defer func() {
+		if psort.ProcessState == nil {
+			shared.KillCmd(psort)
+			shared.WaitCmd(psort)
+		}
+	}()
 	var mu sync.Mutex
 	var headerPrinted = false
-	flib, err := tempclean.TempFile("", "svtype-lib")
-	check(err)
-	check(flib.Close())
-	check(os.Remove(flib.Name()))
+	flib, err := ioutil.TempFile("", "svtype-lib")
+	if err != nil {
+		return err
+	}
+	flib.Close()
+	os.Remove(flib.Name())
 	lib := flib.Name()
+	shared.RemoveOnExit(lib)
+	defer func() {
+		os.Remove(lib)
+		shared.Keep(lib)
+	}()
 
 	// run svtyper the first time to get the lib
-	p := exec.Command("svtyper", "-B", strings.Join(bam_paths, ","), "-T", reference, "-l", lib, "-o", "-")
-	p.Stderr = shared.Slogger
-	p.Stdout = shared.Slogger
-	check(p.Run())
+	ctx := context.Background()
+	if err := shared.Run(ctx, 1, shared.Jobs(shared.Job{Name: "library", Log: log.With("chunk", "library"), Cmds: [][]string{libraryArgs(bam_paths, reference, lib)}})); err != nil {
+		for f := range ch {
+			os.Remove(f)
+		}
+		return err
+	}
 
-	var wg sync.WaitGroup
 	// read from the channel to svtype in parallel.
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		wg.Add(1)
-		go func() {
-			for tmpf := range ch {
-				f := tmpf
-				t, err := tempclean.TempFile("", "smoove-svtyper-tmp-")
-				check(err)
-				t.Close()
-				var p *exec.Cmd
-				if os.Getenv("SMOOVE_NO_MAX_CI") == "" {
-					p = exec.Command("svtyper", "-i", f, "-B", strings.Join(bam_paths, ","), "--max_reads", "50000", "-T", reference, "-l", lib, "-o", t.Name(), "--max_ci_dist", "0")
-				} else {
-					p = exec.Command("svtyper", "-i", f, "-B", strings.Join(bam_paths, ","), "--max_reads", "50000", "-T", reference, "-l", lib, "-o", t.Name())
-				}
-				p.Stderr = shared.Slogger
-				p.Stdout = shared.Slogger
-				check(p.Run())
-				// TODO: add check here to make sure n output variants is same as n input variants
-				rdr, err := xopen.Ropen(t.Name())
-				defer rdr.Close()
-				check(err)
-				mu.Lock()
-				if !headerPrinted {
-					// rdr also contains all the variants from the first chunk so those get printed as well.
-					_, err = io.Copy(out, rdr)
-					headerPrinted = true
-					check(out.Flush())
-					mu.Unlock()
-					os.Remove(t.Name())
-					os.Remove(f)
-					continue
-				}
-				// already printed header...
-				// so skip past it.
-				for {
-					line, err := rdr.ReadString('\n')
-					if len(line) != 0 {
-						if line[0] == '#' {
-							continue
-						}
-						checkWrite(out.WriteString(line))
-						_, err := io.Copy(out, rdr)
-						check(err)
-						break
-					}
-					if err == io.EOF {
-						break
-					}
-					check(err)
-				}
-				check(out.Flush())
-				mu.Unlock()
-				os.Remove(t.Name())
+	jobs := make(chan shared.Job)
+	go func() {
+		defer close(jobs)
+		i := 0
+		for f := range ch {
+			i++
+			t, err := ioutil.TempFile("", "smoove-svtyper-tmp-")
+			if err != nil {
 				os.Remove(f)
+				jobs <- shared.Job{Name: f, Done: func() error { return err }}
+				continue
+			}
+			t.Close()
+			args := svtyperArgs(f, bam_paths, reference, lib, t.Name())
+			f, tname := f, t.Name()
+			shared.RemoveOnExit(tname)
+			remove := func() {
+				os.Remove(f)
+				os.Remove(tname)
+				shared.Keep(tname)
+			}
+			jobs <- shared.Job{Name: f, Cmds: [][]string{args}, Log: log.With("chunk", strconv.Itoa(i)),
+				Done: func() error {
+					defer remove()
+					mu.Lock()
+					defer mu.Unlock()
+					return writeChunk(out, tname, &headerPrinted)
+				},
+				Cleanup: remove,
 			}
-			check(out.Flush())
-			wg.Done()
-		}()
+		}
+	}()
+	if err := shared.Run(ctx, runtime.GOMAXPROCS(0), jobs); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return shared.InputError(errors.Wrap(readErr, "error reading VCF to genotype"))
+	}
+	if err := out.Flush(); err != nil {
+		return shared.ToolError("gsort", err)
 	}
-	wg.Wait()
-	out.Flush()
-	if psort != nil {
-		check(si.Close())
-		check(psort.Wait())
+	if err := si.Close(); err != nil {
+		return err
 	}
-	if duphold {
-		args := []string{"duphold", "-o", o + ".tmp.vcf.gz", "-v", o, "-f", reference}
-		args = append(args, bam_paths...)
-		cmd := exec.Command("smoove", args...)
-		cmd.Stderr = shared.Slogger
-		cmd.Stdout = shared.Slogger
-		if err := cmd.Run(); err != nil {
-			tempclean.Fatalf(err.Error())
+	if err := shared.WaitCmd(psort); err != nil {
+		return shared.ToolError("gsort | bcftools", err)
+	}
+	stageDone()
+	if dh {
+		if err := duphold.AnnotateInPlace(o, reference, bam_paths, snps, runtime.GOMAXPROCS(0)); err != nil {
+			return err
 		}
+	}
+	shared.Keep(o, o+".csi")
+	log.Printf("wrote sorted, indexed file to %s", o)
+	return nil
+}
 
-		cmd = exec.Command("mv", o+".tmp.vcf.gz", o)
-		cmd.Stderr = shared.Slogger
-		cmd.Stdout = shared.Slogger
-		if err := cmd.Run(); err != nil {
-			tempclean.Fatalf(err.Error())
+// Plan writes the commands that Svtyper would run on vcf to p.
+func Plan(p *shared.Plan, vcf string, reference string, bam_paths []string, outdir, name string, excludeNonRef bool, removePR bool, dh bool, snps string) {
+	o := filepath.Join(outdir, name) + "-smoove.genotyped.vcf.gz"
+	p.Step("svtyper: genotype %s and write %s", vcf, o)
+	p.Shell("lib=$(mktemp)")
+	p.Shell(shared.Quote(libraryArgs(bam_paths, reference, "$lib")...) + " < /dev/null")
+	p.Note("writes the variants from %s to $TMPDIR/smoove-tmp* in chunks of %d and genotypes %d chunks at a time with:", vcf, chunkSize, runtime.GOMAXPROCS(0))
+	p.Commented(`for chunk in "$TMPDIR"/smoove-tmp*; do`)
+	p.Commented("    " + shared.Quote(svtyperArgs("$chunk", bam_paths, reference, "$lib", "$chunk.genotyped.vcf")...))
+	p.Commented("done")
+	p.Note("sends the header and variants of the genotyped chunks to:")
+	p.Commented(shared.Quote("bash", "-c", sortCmd(reference, o, excludeNonRef, removePR)))
+	if dh {
+		p.Step("duphold")
+		p.Note("annotates %s with depth changes from %s", o, strings.Join(bam_paths, ","))
+	}
+}
+
+// sortCmd returns the script that sorts the genotyped VCF from stdin and writes it to o with an index.
+func sortCmd(reference, o string, excludeNonRef, removePR bool) string {
+	exRef := ""
+	if excludeNonRef {
+		exRef = " -c 1"
+	}
+	var cmd string
+	if removePR {
+		if excludeNonRef {
+			cmd = fmt.Sprintf("set -euo pipefail; gsort /dev/stdin %s.fai | bcftools annotate -x INFO/PRPOS,INFO/PREND -Ou | bcftools view -c 1 -Oz %s -o %s", reference, exRef, o)
+		} else {
+			cmd = fmt.Sprintf("set -euo pipefail; gsort /dev/stdin %s.fai | bcftools annotate -x INFO/PRPOS,INFO/PREND -Oz -o %s", reference, o)
 		}
+	} else {
+		cmd = fmt.Sprintf("set -euo pipefail; gsort /dev/stdin %s.fai | bcftools view -O z%s -o %s", reference, exRef, o)
+	}
+	return cmd + fmt.Sprintf("; bcftools index -f --threads %d %s", 3, o)
+}
 
-		_ = os.Remove(o + ".tmp.vcf.gz.csi")
+// libraryArgs is the svtyper command that writes the library information for the bams to lib.
+func libraryArgs(bam_paths []string, reference, lib string) []string {
+	return []string{"svtyper", "-B", strings.Join(bam_paths, ","), "-T", reference, "-l", lib, "-o", "-"}
+}
+
+// svtyperArgs is the svtyper command that genotypes the variants in chunk and writes them to out.
+func svtyperArgs(chunk string, bam_paths []string, reference, lib, out string) []string {
+	args := []string{"svtyper", "-i", chunk, "-B", strings.Join(bam_paths, ","), "--max_reads", "50000", "-T", reference, "-l", lib, "-o", out}
+	if os.Getenv("SMOOVE_NO_MAX_CI") == "" {
+		args = append(args, "--max_ci_dist", "0")
+	}
+	return args
+}
 
-		cmd = exec.Command("bcftools", "index", "--threads", "3", o)
-		cmd.Stderr = shared.Slogger
-		cmd.Stdout = shared.Slogger
-		if err := cmd.Run(); err != nil {
-			tempclean.Fatalf(err.Error())
+// writeChunk copies the svtyper output in path to out, skipping the header if it has already been written.
+func writeChunk(out *bufio.Writer, path string, headerPrinted *bool) error {
+	// TODO: add check here to make sure n output variants is same as n input variants
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	if !*headerPrinted {
+		// rdr also contains all the variants from the first chunk so those get printed as well.
+		if _, err := io.Copy(out, rdr); err != nil {
+			return err
 		}
+		*headerPrinted = true
+		return out.Flush()
 	}
-	shared.Slogger.Printf("wrote sorted, indexed file to %s", o)
+	// already printed header...
+	// so skip past it.
+	for {
+		line, err := rdr.ReadString('\n')
+		if len(line) != 0 && line[0] != '#' {
+			if _, err := out.WriteString(line); err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, rdr); err != nil {
+				return err
+			}
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
 }
 
 const BndSupport = 6
 
 func Main() {
 	cli := cliargs{VCF: "-", Processes: 3}
-	p := arg.MustParse(&cli)
-	if _, err := exec.LookPath("svtyper"); err != nil {
-		p.Fail(shared.Prefix + " svtyper not found on PATH")
+	arg.MustParse(&cli)
+	runtime.GOMAXPROCS(cli.Processes)
+	err := genotype(cli)
+	if rerr := shared.WriteReport(filepath.Join(cli.OutDir, cli.Name+"-smoove.run.json")); rerr != nil {
+		shared.Slogger.Warnf("couldn't write run report: %s", rerr)
+	}
+	if err != nil {
+		shared.Fatal(err)
+	}
+}
+
+// Run runs smoove genotype with args (without the program name) for use by other sub-commands.
+// Unlike Main, it doesn't set GOMAXPROCS or write a run report.
+func Run(args []string) error {
+	cli := cliargs{VCF: "-", Processes: 3}
+	if err := shared.ParseArgs(&cli, args); err != nil {
+		return err
+	}
+	return genotype(cli)
+}
+
+func genotype(cli cliargs) error {
+	if _, err := exec.LookPath("svtyper"); err != nil && !cli.DryRun {
+		return shared.DependencyError(errors.New("svtyper not found on PATH"))
+	}
+	if err := shared.CheckReference(cli.Fasta, cli.Bams); err != nil {
+		return err
+	}
+	if cli.DryRun {
+		Plan(shared.NewPlan(os.Stdout), cli.VCF, cli.Fasta, cli.Bams, cli.OutDir, cli.Name, false, cli.RemovePr, cli.DupHold, cli.SNPs)
+		return nil
 	}
 	rdr, err := xopen.Ropen(cli.VCF)
-	check(err)
+	if err != nil {
+		return shared.InputError(err)
+	}
 	defer rdr.Close()
-	runtime.GOMAXPROCS(cli.Processes)
-	Svtyper(rdr, cli.Fasta, cli.Bams, cli.OutDir, cli.Name, false, cli.RemovePr, cli.DupHold)
+	return Svtyper(rdr, cli.Fasta, cli.Bams, cli.OutDir, cli.Name, false, cli.RemovePr, cli.DupHold, cli.SNPs)
 }